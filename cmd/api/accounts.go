@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/torenware/go-stripe/internal/urlsigner"
+)
+
+// AccountLoginLink emails a customer a link that logs them in to their
+// account. The answer is the same whether or not we know the address, so
+// this can't be used to find out who our customers are.
+func (app *application) AccountLoginLink(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(payload.Email))
+
+	known, err := app.DB.HasCustomerEmail(email)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	if known {
+		link := fmt.Sprintf("%s/account/verify?email=%s", app.config.frontend, url.QueryEscape(email))
+		sign := urlsigner.Signer{
+			Secret: []byte(app.config.secretkey),
+		}
+		var data struct {
+			Link string
+		}
+		data.Link = sign.GenerateTokenFromString(link)
+
+		err = app.SendMail("info@widgets.com", email, "Your Widgets Co. login link", "account-login", data)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	var output struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	output.Message = "If we have orders for that address, we've sent it a link to log in."
+	_ = app.writeJSON(w, http.StatusOK, output)
+}
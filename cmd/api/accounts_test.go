@@ -0,0 +1,28 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// An address we don't know gets the same answer as one we do, and no mail.
+func TestAccountLoginLinkUnknown(t *testing.T) {
+	app, fake, _ := testApp(t)
+	var asked []driver.Value
+	fake.Handle("from customers where email").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		asked = args
+		return fakedb.RowsFrom(q, map[string]driver.Value{"count(*)": int64(0)})
+	}
+
+	w := post(t, app.AccountLoginLink, map[string]string{"email": " Nobody@Example.com "}, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "If we have orders") {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+	if len(asked) != 1 || asked[0] != "nobody@example.com" {
+		t.Errorf("looked up %v", asked)
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/torenware/go-stripe/internal/cards"
 	"github.com/torenware/go-stripe/internal/driver"
 	"github.com/torenware/go-stripe/internal/models"
 	mail "github.com/xhit/go-simple-mail/v2"
@@ -17,17 +20,24 @@ import (
 const version = "1.0.0"
 
 type config struct {
-	port int
-	env  string // development | production
-	db   struct {
+	port    int
+	env     string // development | production
+	gateway string // stripe | fake
+	db      struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret        string
+		key           string
+		webhookSecret string
 	}
 	secretkey string
 	frontend  string
+	dunning   struct {
+		// maxFailures is how many failed renewals in a row we put up
+		// with before cancelling a subscription.
+		maxFailures int
+	}
 }
 
 // receiver type
@@ -38,6 +48,7 @@ type application struct {
 	version    string
 	DB         *models.DBModel
 	mailServer *mail.SMTPServer
+	gateway    cards.PaymentGateway
 }
 
 func (app *application) serve() error {
@@ -56,12 +67,32 @@ func (app *application) serve() error {
 
 }
 
+// newGateway returns the payment gateway the config asks for. The fake
+// keeps its cards and payments in memory, so it is for trying the site
+// out without Stripe, never for production.
+func newGateway(config config) (cards.PaymentGateway, error) {
+	switch config.gateway {
+	case "stripe":
+		return &cards.Card{
+			Secret: config.stripe.secret,
+			Key:    config.stripe.key,
+		}, nil
+	case "fake":
+		if config.env == "production" {
+			return nil, errors.New("the fake gateway cannot be used in production")
+		}
+		return cards.NewFakeGateway(), nil
+	}
+	return nil, fmt.Errorf("unknown gateway %q", config.gateway)
+}
+
 func main() {
 	var config config
 	//var dsn string
 
 	flag.IntVar(&config.port, "port", 4001, "Port number")
 	flag.StringVar(&config.env, "env", "development", "development|production")
+	flag.StringVar(&config.gateway, "gateway", "stripe", "stripe|fake")
 	flag.Parse()
 
 	// https://preslav.me/2020/11/10/use-dotenv-files-when-developing-your-golang-apps/
@@ -72,6 +103,10 @@ func main() {
 
 	config.stripe.key = os.Getenv("STRIPE_KEY")
 	config.stripe.secret = os.Getenv("STRIPE_SECRET")
+	config.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if config.stripe.webhookSecret == "" {
+		infoLog.Println("STRIPE_WEBHOOK_SECRET is not set; webhooks will be rejected")
+	}
 
 	// crypto keys
 	config.secretkey = os.Getenv("SECRET_KEY")
@@ -83,6 +118,15 @@ func main() {
 		errorLog.Fatalln("FRONT_END must be in environment")
 	}
 
+	config.dunning.maxFailures = 3
+	if failures := os.Getenv("DUNNING_MAX_FAILURES"); failures != "" {
+		n, err := strconv.Atoi(failures)
+		if err != nil || n < 1 {
+			errorLog.Fatalln("DUNNING_MAX_FAILURES must be a positive number")
+		}
+		config.dunning.maxFailures = n
+	}
+
 	var err error
 	dsn, err := driver.ConstructDSN()
 	if err != nil {
@@ -98,6 +142,11 @@ func main() {
 	infoLog.Println("Database is UP")
 	defer conn.Close()
 
+	gateway, err := newGateway(config)
+	if err != nil {
+		errorLog.Fatalln(err)
+	}
+
 	server, err := initMailserver()
 	if err != nil {
 		errorLog.Println(err)
@@ -111,6 +160,7 @@ func main() {
 		version:    version,
 		DB:         &models.DBModel{DB: conn},
 		mailServer: server,
+		gateway:    gateway,
 	}
 
 	err = app.serve()
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/torenware/go-stripe/internal/cards"
+)
+
+// The fake gateway is there for trying the site out, never for taking
+// real orders.
+func TestNewGateway(t *testing.T) {
+	var cfg config
+	cfg.env = "development"
+	cfg.gateway = "fake"
+	gateway, err := newGateway(cfg)
+	if _, ok := gateway.(*cards.FakeGateway); !ok || err != nil {
+		t.Errorf("development: got %T, %v", gateway, err)
+	}
+
+	cfg.env = "production"
+	if _, err := newGateway(cfg); err == nil {
+		t.Error("fake gateway allowed in production")
+	}
+
+	cfg.gateway = "paypal"
+	if _, err := newGateway(cfg); err == nil {
+		t.Error("unknown gateway allowed")
+	}
+}
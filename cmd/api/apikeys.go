@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+// ListAPIKeys lists every API key. The keys themselves aren't kept, so
+// only their prefixes are shown.
+func (app *application) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.DB.GetAPIKeys()
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if keys == nil {
+		keys = []*models.APIKey{}
+	}
+
+	var out struct {
+		Error bool             `json:"error"`
+		Keys  []*models.APIKey `json:"keys"`
+	}
+	out.Keys = keys
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// CreateAPIKey makes an API key that acts as the signed in admin, limited
+// to the scopes asked for. The key is in the answer, and can't be seen
+// again after that.
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name   string              `json:"name"`
+		Scopes []models.Permission `json:"scopes"`
+		// Expiry may be left out for a key that doesn't expire.
+		Expiry time.Time `json:"expiry"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		_ = app.badRequest(w, r, errors.New("the key needs a name"))
+		return
+	}
+	if len(input.Scopes) == 0 {
+		_ = app.badRequest(w, r, errors.New("the key needs at least one scope"))
+		return
+	}
+	for _, scope := range input.Scopes {
+		switch {
+		case !scope.Valid():
+			_ = app.badRequest(w, r, fmt.Errorf("%q is not a scope", scope))
+			return
+		case scope == models.PermManageAPIKeys:
+			_ = app.badRequest(w, r, errors.New("API keys can't manage API keys"))
+			return
+		case !user.Can(scope):
+			_ = app.badRequest(w, r, fmt.Errorf("you can't give a key the %q scope", scope))
+			return
+		}
+	}
+	if !input.Expiry.IsZero() && input.Expiry.Before(time.Now()) {
+		_ = app.badRequest(w, r, errors.New("expiry must be in the future"))
+		return
+	}
+
+	key, err := models.GenerateAPIKey(user.ID, input.Name, input.Scopes, input.Expiry)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.InsertAPIKey(key)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, errors.New("could not save the key"))
+		return
+	}
+	key.UserName = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
+	key.CreatedAt = time.Now()
+
+	var out struct {
+		Error   bool           `json:"error"`
+		Message string         `json:"message"`
+		Key     *models.APIKey `json:"key"`
+	}
+	out.Message = fmt.Sprintf("key %q created; copy it now, it won't be shown again", key.Name)
+	out.Key = key
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// RevokeAPIKey deletes an API key, so it stops working at once.
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("URI must specify ID"))
+		return
+	}
+
+	err = app.DB.DeleteAPIKey(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return
+		}
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	out.Message = fmt.Sprintf("key %d was revoked", id)
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
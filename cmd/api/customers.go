@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/urlsigner"
+)
+
+// gatewayCustomer returns the gateway customer to bill for an email
+// address, with pm as their card. A customer logged in to their account
+// keeps their gateway customer; anyone else, or a customer the gateway
+// has lost track of, gets a new one. Knowing an email address is not
+// enough to add a card to its customer.
+func (app *application) gatewayCustomer(pm, email string, verified *models.Customer, idemKey string) (*stripe.Customer, string, error) {
+	if verified != nil && verified.GatewayCustomerID != "" {
+		existing := verified.GatewayCustomerID
+		cust, msg, err := app.gateway.AttachPaymentMethod(existing, pm, idemKey)
+		if !isNotFound(err) {
+			return cust, msg, err
+		}
+		app.errorLog.Printf("gateway customer %s for %s is gone: %v", existing, email, err)
+	}
+
+	return app.gateway.CreateCustomer(pm, email, idemKey)
+}
+
+// createPaymentIntent starts a payment for the buyer's gateway customer,
+// falling back to an anonymous payment if the gateway has lost them.
+func (app *application) createPaymentIntent(req cards.PaymentIntentRequest) (*stripe.PaymentIntent, string, error) {
+	pi, msg, err := app.gateway.CreatePaymentIntent(req)
+	if req.Customer != "" && isNotFound(err) {
+		app.errorLog.Printf("gateway customer %s is gone: %v", req.Customer, err)
+		req.Customer = ""
+		if req.IdempotencyKey != "" {
+			// The gateway won't take the same key with other parameters.
+			req.IdempotencyKey += ":anonymous"
+		}
+		return app.gateway.CreatePaymentIntent(req)
+	}
+	return pi, msg, err
+}
+
+// isNotFound reports whether the gateway couldn't find what we asked for.
+func isNotFound(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound
+}
+
+// verifiedCustomer is the customer a checkout is for, if the page it came
+// from shows they are logged in to their account as the buyer's email
+// address. It is nil for anyone else.
+func (app *application) verifiedCustomer(payload stripePayload) *models.Customer {
+	if payload.CardClaim == nil || payload.Email == "" {
+		return nil
+	}
+	customer, err := app.claimedCustomer(payload.CardClaim)
+	if err != nil {
+		return nil
+	}
+	if customer.Email != models.NormalizeEmail(payload.Email) {
+		return nil
+	}
+	return customer
+}
+
+// savedCardsClaim must match the one in cmd/web.
+func savedCardsClaim(customerID int, expires int64) string {
+	return fmt.Sprintf("saved-cards:%d:%d", customerID, expires)
+}
+
+// cardClaim comes from the checkout page of a customer logged in to their
+// account. The API can't see their session, so the page is handed a hash
+// that shows which customer's saved cards it may use.
+type cardClaim struct {
+	CustomerID int    `json:"customer_id"`
+	Expires    int64  `json:"expires"`
+	Hash       string `json:"hash"`
+}
+
+// claimedCustomer checks a card claim, and returns the customer it is for.
+func (app *application) claimedCustomer(claim *cardClaim) (*models.Customer, error) {
+	if claim == nil {
+		return nil, errors.New("please log in to your account to use saved cards")
+	}
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+	if !sign.CheckMAC(claim.Hash, savedCardsClaim(claim.CustomerID, claim.Expires)) || time.Now().Unix() > claim.Expires {
+		return nil, errors.New("this page has expired; please reload it and try again")
+	}
+	return app.DB.GetCustomer(claim.CustomerID)
+}
+
+// checkoutCard works out which gateway customer a checkout bills, and the
+// saved card it pays with, if any. Only a customer logged in to their
+// account may pay with a saved card or save a new one.
+func (app *application) checkoutCard(payload stripePayload) (string, *models.PaymentMethod, error) {
+	if payload.SavedCard == 0 && !payload.SaveCard {
+		// An anonymous checkout is charged without a gateway customer.
+		if customer := app.verifiedCustomer(payload); customer != nil {
+			return customer.GatewayCustomerID, nil, nil
+		}
+		return "", nil, nil
+	}
+
+	customer, err := app.claimedCustomer(payload.CardClaim)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if payload.SavedCard != 0 {
+		saved, err := app.DB.GetPaymentMethod(payload.SavedCard)
+		if err != nil || saved.CustomerID != customer.ID || customer.GatewayCustomerID == "" {
+			return "", nil, errors.New("no such card")
+		}
+		return customer.GatewayCustomerID, saved, nil
+	}
+
+	// A card can only be saved to a gateway customer.
+	if customer.GatewayCustomerID == "" {
+		gc, _, err := app.gateway.CreateCustomer("", customer.Email, "")
+		if err != nil {
+			return "", nil, err
+		}
+		err = app.DB.SetGatewayCustomerID(customer.ID, gc.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		customer.GatewayCustomerID = gc.ID
+	}
+	return customer.GatewayCustomerID, nil, nil
+}
+
+// paymentMethodRecord is what we keep of a card saved with the gateway.
+func paymentMethodRecord(pm *stripe.PaymentMethod) *models.PaymentMethod {
+	if pm == nil || pm.Card == nil {
+		return nil
+	}
+	return &models.PaymentMethod{
+		GatewayPaymentMethodID: pm.ID,
+		Fingerprint:            pm.Card.Fingerprint,
+		Brand:                  string(pm.Card.Brand),
+		LastFour:               pm.Card.Last4,
+		ExpiryMonth:            int(pm.Card.ExpMonth),
+		ExpiryYear:             int(pm.Card.ExpYear),
+	}
+}
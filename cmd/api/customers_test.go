@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+	"github.com/torenware/go-stripe/internal/urlsigner"
+)
+
+// A card claim is good for the customer and time the web app signed it
+// for, and nothing else.
+func TestClaimedCustomer(t *testing.T) {
+	app, fake, _ := testApp(t)
+	app.config.secretkey = "abcdefghijklmnopqrstuvwxyz012345"
+	fake.Handle("from customers").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":                  args[0],
+			"first_name":          "Jane",
+			"last_name":           "Doe",
+			"email":               "jane@example.com",
+			"gateway_customer_id": "cus_1",
+			"created_at":          time.Now(),
+			"updated_at":          time.Now(),
+		})
+	}
+
+	signer := urlsigner.Signer{Secret: []byte(app.config.secretkey)}
+	expires := time.Now().Add(time.Hour).Unix()
+	claim := &cardClaim{CustomerID: 4, Expires: expires, Hash: signer.MAC(savedCardsClaim(4, expires))}
+	expired := time.Now().Add(-time.Minute).Unix()
+
+	customer, err := app.claimedCustomer(claim)
+	if err != nil || customer.ID != 4 {
+		t.Fatalf("got %+v, %v", customer, err)
+	}
+
+	for name, bad := range map[string]*cardClaim{
+		"another customer": {CustomerID: 5, Expires: expires, Hash: claim.Hash},
+		"extended":         {CustomerID: 4, Expires: expires + 60, Hash: claim.Hash},
+		"expired":          {CustomerID: 4, Expires: expired, Hash: signer.MAC(savedCardsClaim(4, expired))},
+	} {
+		if _, err := app.claimedCustomer(bad); err == nil {
+			t.Errorf("%s: claim accepted", name)
+		}
+	}
+	if fake.Ran("from customers") != 1 {
+		t.Error("a bad claim was looked up")
+	}
+}
+
+// A claim only makes the buyer their customer if they buy as that email.
+func TestVerifiedCustomer(t *testing.T) {
+	app, fake, _ := testApp(t)
+	app.config.secretkey = "abcdefghijklmnopqrstuvwxyz012345"
+	fake.Handle("from customers").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":                  args[0],
+			"first_name":          "Jane",
+			"last_name":           "Doe",
+			"email":               "jane@example.com",
+			"gateway_customer_id": "cus_1",
+			"created_at":          time.Now(),
+			"updated_at":          time.Now(),
+		})
+	}
+
+	signer := urlsigner.Signer{Secret: []byte(app.config.secretkey)}
+	expires := time.Now().Add(time.Hour).Unix()
+	claim := &cardClaim{CustomerID: 4, Expires: expires, Hash: signer.MAC(savedCardsClaim(4, expires))}
+
+	if app.verifiedCustomer(stripePayload{Email: "jane@example.com"}) != nil {
+		t.Error("verified without a claim")
+	}
+	if app.verifiedCustomer(stripePayload{Email: "bob@example.com", CardClaim: claim}) != nil {
+		t.Error("verified as someone else's address")
+	}
+	if customer := app.verifiedCustomer(stripePayload{Email: " Jane@Example.com", CardClaim: claim}); customer == nil || customer.GatewayCustomerID != "cus_1" {
+		t.Errorf("got %+v", customer)
+	}
+}
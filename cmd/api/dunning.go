@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/urlsigner"
+)
+
+// updateCardClaim is what the update card page signs to show that it
+// came from a good link. cmd/web builds the same string.
+func updateCardClaim(orderID int, expires int64) string {
+	return fmt.Sprintf("update-card:%d:%d", orderID, expires)
+}
+
+// dunningEmail is what the dunning emails are rendered with.
+type dunningEmail struct {
+	FirstName   string
+	Plan        string
+	Amount      string
+	Attempt     int
+	MaxFailures int
+	NextAttempt string
+	Link        string
+}
+
+// invoicePaymentFailed is Stripe telling us a renewal didn't go through.
+// The subscription goes past due and the customer is sent a link to fix
+// their card, until it has failed maxFailures times, when we give up and
+// cancel it.
+func (app *application) invoicePaymentFailed(event stripe.Event) error {
+	var invoice stripe.Invoice
+	err := json.Unmarshal(event.Data.Raw, &invoice)
+	if err != nil {
+		return err
+	}
+	if invoice.Subscription == nil {
+		return nil
+	}
+
+	order, err := app.orderForSubscription(invoice.Subscription.ID)
+	if err != nil || order == nil {
+		return err
+	}
+	if order.StatusID == models.OrderCancelled {
+		return nil
+	}
+
+	attempt := models.DunningAttempt{
+		OrderID:   order.ID,
+		InvoiceID: invoice.ID,
+		Attempt:   int(invoice.AttemptCount),
+		Amount:    int(invoice.AmountDue),
+		Currency:  string(invoice.Currency),
+	}
+	if invoice.NextPaymentAttempt > 0 {
+		attempt.NextAttemptAt = time.Unix(invoice.NextPaymentAttempt, 0)
+	}
+	saved, failures, err := app.DB.RecordFailedRenewal(attempt)
+	if err != nil {
+		return err
+	}
+
+	giveUp := failures >= app.config.dunning.maxFailures
+	if giveUp {
+		err = app.cancelForNonPayment(invoice.Subscription.ID)
+		if err != nil {
+			return err
+		}
+		err = app.DB.SetOrderStatus(order.ID, models.OrderCancelled, models.OrderEvent{
+			Kind:             models.EventCancellation,
+			GatewayReference: invoice.ID,
+			Reason:           fmt.Sprintf("renewal failed %d times", failures),
+		})
+	} else {
+		err = app.DB.SetOrderStatus(order.ID, models.OrderPastDue, models.OrderEvent{
+			GatewayReference: invoice.ID,
+			Reason:           "renewal payment failed",
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if saved.Emailed {
+		return nil
+	}
+	err = app.sendDunningEmail(order, saved, giveUp)
+	if err != nil {
+		// Not worth having Stripe send the event again for.
+		app.errorLog.Printf("dunning: could not email about order %d: %s", order.ID, err)
+		return nil
+	}
+	return app.DB.MarkDunningEmailed(saved.ID)
+}
+
+// cancelForNonPayment cancels a subscription at the gateway, unless
+// Stripe's own retry settings got there first.
+func (app *application) cancelForNonPayment(subID string) error {
+	subscription, err := app.gateway.GetSubscription(subID)
+	if err != nil {
+		return err
+	}
+	if subscription.Status != stripe.SubscriptionStatusCanceled {
+		subscription, err = app.gateway.CancelSubscription(subID)
+		if err != nil {
+			return err
+		}
+	}
+	return app.syncSubscription(subscription)
+}
+
+func (app *application) sendDunningEmail(order *models.Order, attempt *models.DunningAttempt, cancelled bool) error {
+	data := dunningEmail{
+		FirstName:   order.Customer.FirstName,
+		Plan:        order.Widget.Name,
+		Amount:      fmt.Sprintf("$%.2f", float64(attempt.Amount)/100),
+		Attempt:     attempt.Attempt,
+		MaxFailures: app.config.dunning.maxFailures,
+	}
+	if !attempt.NextAttemptAt.IsZero() {
+		data.NextAttempt = attempt.NextAttemptAt.Format("January 2, 2006")
+	}
+
+	if cancelled {
+		return app.SendMail("info@widgets.com", order.Customer.Email,
+			"Your subscription has been cancelled", "subscription-cancelled", data)
+	}
+
+	link := fmt.Sprintf("%s/update-card?order=%d", app.config.frontend, order.ID)
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+	data.Link = sign.GenerateTokenFromString(link)
+	return app.SendMail("info@widgets.com", order.Customer.Email,
+		"We couldn't renew your subscription", "payment-failed", data)
+}
+
+// invoicePaid clears a subscription's failed renewals once one goes
+// through, whether Stripe's own retry worked or the customer fixed their
+// card.
+func (app *application) invoicePaid(event stripe.Event) error {
+	var invoice stripe.Invoice
+	err := json.Unmarshal(event.Data.Raw, &invoice)
+	if err != nil {
+		return err
+	}
+	if invoice.Subscription == nil {
+		return nil
+	}
+
+	order, err := app.orderForSubscription(invoice.Subscription.ID)
+	if err != nil || order == nil {
+		return err
+	}
+
+	resolved, err := app.DB.ResolveDunning(order.ID)
+	if err != nil {
+		return err
+	}
+	if resolved > 0 {
+		app.infoLog.Printf("dunning: order %d is paid up", order.ID)
+	}
+	if order.StatusID != models.OrderPastDue {
+		return nil
+	}
+	return app.DB.SetOrderStatus(order.ID, models.OrderCharged, models.OrderEvent{
+		GatewayReference: invoice.ID,
+		Reason:           "renewal paid",
+	})
+}
+
+// updateCardPayload is what the update card page sends. Hash and Expires
+// come from the web app, which checked the link in the dunning email.
+type updateCardPayload struct {
+	OrderID     int    `json:"order_id"`
+	Expires     int64  `json:"expires"`
+	Hash        string `json:"hash"`
+	SetupIntent string `json:"setup_intent"`
+}
+
+// subscriptionForCardUpdate checks an update card request, and returns
+// the order and its subscription.
+func (app *application) subscriptionForCardUpdate(w http.ResponseWriter, r *http.Request, payload *updateCardPayload) (*models.Order, *stripe.Subscription, bool) {
+	err := app.readJSON(w, r, payload)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return nil, nil, false
+	}
+
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+	err = sign.ConfirmHashForString(payload.Hash, updateCardClaim(payload.OrderID, payload.Expires))
+	if err != nil || time.Now().Unix() > payload.Expires {
+		_ = app.badRequest(w, r, errors.New("this link is no longer valid; please use the one in your latest email"))
+		return nil, nil, false
+	}
+
+	order, err := app.DB.GetSubscription(payload.OrderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return nil, nil, false
+		}
+		_ = app.badRequest(w, r, err)
+		return nil, nil, false
+	}
+	if order.StatusID == models.OrderCancelled {
+		_ = app.badRequest(w, r, errors.New("this subscription has been cancelled"))
+		return nil, nil, false
+	}
+
+	subID, err := gatewaySubscriptionID(order)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return nil, nil, false
+	}
+	subscription, err := app.gateway.GetSubscription(subID)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return nil, nil, false
+	}
+	return order, subscription, true
+}
+
+// UpdateCardSetupIntent starts saving a new card for a subscription.
+func (app *application) UpdateCardSetupIntent(w http.ResponseWriter, r *http.Request) {
+	var payload updateCardPayload
+	_, subscription, ok := app.subscriptionForCardUpdate(w, r, &payload)
+	if !ok {
+		return
+	}
+
+	si, err := app.gateway.CreateSetupIntent(subscription.Customer.ID, idempotencyKey(r, "update-card", ""))
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error        bool   `json:"error"`
+		ClientSecret string `json:"client_secret"`
+	}
+	out.ClientSecret = si.ClientSecret
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// UpdateCard bills a subscription to the card saved by a setup intent,
+// and tries the unpaid renewal again with it.
+func (app *application) UpdateCard(w http.ResponseWriter, r *http.Request) {
+	var payload updateCardPayload
+	order, subscription, ok := app.subscriptionForCardUpdate(w, r, &payload)
+	if !ok {
+		return
+	}
+
+	si, err := app.gateway.RetrieveSetupIntent(payload.SetupIntent)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if si.Status != stripe.SetupIntentStatusSucceeded || si.PaymentMethod == nil ||
+		si.Customer == nil || si.Customer.ID != subscription.Customer.ID {
+		_ = app.badRequest(w, r, errors.New("the card was not saved"))
+		return
+	}
+
+	subscription, err = app.gateway.SetDefaultPaymentMethod(subscription.ID, si.PaymentMethod.ID)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if err := app.syncSubscription(subscription); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	var out struct {
+		Error        bool   `json:"error"`
+		Message      string `json:"message"`
+		ClientSecret string `json:"client_secret,omitempty"`
+	}
+	out.Message = "Your card has been updated."
+
+	inv := subscription.LatestInvoice
+	if inv != nil && inv.Status == stripe.InvoiceStatusOpen {
+		_, msg, err := app.gateway.PayInvoice(inv.ID)
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.PaymentIntent != nil &&
+			cards.PaymentIntentOutcome(stripeErr.PaymentIntent) == cards.PaymentNeedsAction {
+			// The page has the customer authenticate the payment, and the
+			// invoice.paid webhook takes it from there.
+			out.Message = "Your card has been updated. Please confirm the payment with your bank."
+			out.ClientSecret = stripeErr.PaymentIntent.ClientSecret
+			_ = app.writeJSON(w, http.StatusOK, out)
+			return
+		}
+		if err != nil {
+			app.errorLog.Printf("update card: order %d still unpaid: %s", order.ID, err)
+			if msg == "" {
+				msg = "We could not charge the new card."
+			}
+			_ = app.badRequest(w, r, errors.New(msg))
+			return
+		}
+		// The invoice.paid webhook clears the failed attempts.
+		out.Message = "Your card has been updated, and your subscription is paid up."
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"testing"
+)
+
+// The dunning emails are only sent when a renewal fails, so a mistake in
+// them would otherwise go unnoticed until then.
+func TestDunningEmailTemplates(t *testing.T) {
+	data := dunningEmail{
+		FirstName:   "Jane",
+		Plan:        "Bronze",
+		Amount:      "$10.00",
+		Attempt:     1,
+		MaxFailures: 3,
+		NextAttempt: "April 2, 2022",
+		Link:        "http://localhost:4000/update-card?order=7",
+	}
+	for _, name := range []string{"payment-failed", "subscription-cancelled"} {
+		for _, file := range []string{"%s.html.gohtml", "%s.plain.tmpl"} {
+			path := "templates/" + fmt.Sprintf(file, name)
+			tmpl, err := template.ParseFS(emailTemplatesFS, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			err = tmpl.ExecuteTemplate(&out, "body", data)
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			if !strings.Contains(out.String(), "Bronze") {
+				t.Errorf("%s doesn't name the plan:\n%s", path, out.String())
+			}
+		}
+	}
+}
@@ -20,7 +20,13 @@ import (
 )
 
 const (
-	AuthTokenTTL = 24 * time.Hour
+	// Access tokens don't last long; the refresh token renews them.
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	// The most of one widget that can be bought at once.
+	maxQuantity = 99
+	// How long stock is held for a payment that hasn't gone through.
+	reservationTTL = 30 * time.Minute
 )
 
 type stripePayload struct {
@@ -35,8 +41,14 @@ type stripePayload struct {
 	ExpiryYear    int    `json:"exp_year"`
 	LastFour      string `json:"last_four"`
 	ProductID     int    `json:"product_id"`
+	Quantity      int    `json:"quantity"`
 	FirstName     string `json:"first_name"`
 	LastName      string `json:"last_name"`
+	// SavedCard is the ID of a saved card to pay with, and SaveCard keeps
+	// a new one. Both need the claim from a logged in checkout page.
+	SavedCard int        `json:"saved_card"`
+	SaveCard  bool       `json:"save_card"`
+	CardClaim *cardClaim `json:"card_claim"`
 }
 
 type jsonResponse struct {
@@ -44,6 +56,9 @@ type jsonResponse struct {
 	Message string `json:"message,omitempty"`
 	Content string `json:"content,omitempty"`
 	ID      int    `json:"id,omitempty"`
+	// ClientSecret is set when the customer has to confirm a payment in
+	// the browser, usually to authenticate it with their bank.
+	ClientSecret string `json:"client_secret,omitempty"`
 }
 
 func (app *application) StripeParams(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +78,21 @@ func (app *application) StripeParams(w http.ResponseWriter, r *http.Request) {
 			app.badRequest(w, r, err)
 			return
 		}
+		if widget.IsArchived {
+			app.badRequest(w, r, errors.New("no such product"))
+			return
+		}
+		if !widget.IsRecurring {
+			available, err := app.DB.AvailableInventory(widgetID)
+			if err != nil {
+				app.badRequest(w, r, err)
+				return
+			}
+			if available <= 0 {
+				app.badRequest(w, r, &models.OutOfStockError{WidgetID: widget.ID, Name: widget.Name})
+				return
+			}
+		}
 		output.Widget = &widget
 	}
 	output.Error = false
@@ -76,23 +106,76 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 
 	err := json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
-		// stub this until we implement a more reasonable
-		// error handling strategy
-		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	idemKey := idempotencyKey(r, "payment-intent", "")
+	claimed := false
+
+	var req cards.PaymentIntentRequest
+	if payload.ProductID == 0 {
+		// Only the virtual terminal gets to name its own amount, and only
+		// for a logged in user.
+		user, err := app.getAuthenticatedUser(r)
+		if err != nil || user == nil {
+			_ = app.invalidCredentials(w)
+			return
+		}
+		if payload.Amount <= 0 {
+			_ = app.badRequest(w, r, errors.New("amount must be positive"))
+			return
+		}
+		req = cards.PaymentIntentRequest{
+			Currency: payload.Currency,
+			Amount:   payload.Amount,
+			Metadata: map[string]string{"user_id": strconv.Itoa(user.ID)},
+		}
+	} else {
+		customer, saved, err := app.checkoutCard(payload)
+		if err != nil {
+			_ = app.badRequest(w, r, err)
+			return
+		}
+
+		// Each try reserves stock under a new order reference, so a retry
+		// gets the intent the first try made rather than trying again.
+		if idemKey != "" {
+			if !app.claimIdempotencyKey(w, r, idemKey, payload) {
+				return
+			}
+			claimed = true
+		}
+
+		req, err = app.widgetPaymentRequest(payload.ProductID, payload.Quantity)
+		if err != nil {
+			if claimed {
+				if err := app.DB.ReleaseIdempotencyKey(idemKey); err != nil {
+					app.errorLog.Println(err)
+				}
+			}
+			_ = app.badRequest(w, r, err)
+			return
+		}
+		req.Customer = customer
+		if saved != nil {
+			req.PaymentMethod = saved.GatewayPaymentMethodID
+		} else {
+			req.SaveCard = payload.SaveCard
+		}
 	}
+	req.IdempotencyKey = idemKey
 
 	okay := true // optimism
 
-	pi, msg, err := card.Charge(payload.Currency, payload.Amount)
+	pi, msg, err := app.createPaymentIntent(req)
 	if err != nil {
 		okay = false
+		if reference := req.Metadata["order_reference"]; reference != "" {
+			if err := app.DB.ReleaseInventory(reference); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
 	}
 
 	if okay {
@@ -100,12 +183,26 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 		if err != nil {
 			// again, replace later
 			app.errorLog.Println(err)
+			if claimed {
+				_ = app.DB.ReleaseIdempotencyKey(idemKey)
+			}
 			return
 		}
 
+		if claimed {
+			if err := app.DB.CompleteIdempotencyKey(idemKey, 0, string(out)); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write(out)
 	} else {
+		if claimed {
+			// Let the customer try again.
+			if err := app.DB.ReleaseIdempotencyKey(idemKey); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
 		j := jsonResponse{
 			OK:      false,
 			Message: msg,
@@ -123,29 +220,97 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 
 }
 
+// widgetPaymentRequest prices a widget purchase from the database, so that
+// the browser can't choose what it pays.
+func (app *application) widgetPaymentRequest(widgetID, quantity int) (cards.PaymentIntentRequest, error) {
+	var req cards.PaymentIntentRequest
+
+	if quantity == 0 {
+		quantity = 1
+	}
+	if quantity < 0 || quantity > maxQuantity {
+		return req, fmt.Errorf("quantity must be between 1 and %d", maxQuantity)
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return req, errors.New("no such product")
+		}
+		return req, err
+	}
+	if widget.IsArchived {
+		return req, errors.New("no such product")
+	}
+	if widget.IsRecurring {
+		return req, errors.New("subscriptions cannot be bought this way")
+	}
+
+	reference, err := models.NewOrderReference()
+	if err != nil {
+		return req, err
+	}
+
+	// Hold the stock while the customer pays.
+	err = app.DB.ReserveInventory(reference, reservationTTL, []models.OrderItem{
+		{WidgetID: widget.ID, Quantity: quantity},
+	})
+	if err != nil {
+		return req, err
+	}
+
+	req = cards.PaymentIntentRequest{
+		Currency: widget.Currency,
+		Amount:   widget.Price * quantity,
+		Metadata: map[string]string{
+			"widget_id":       strconv.Itoa(widget.ID),
+			"quantity":        strconv.Itoa(quantity),
+			"amount":          strconv.Itoa(widget.Price * quantity),
+			"order_reference": reference,
+		},
+	}
+	return req, nil
+}
+
 func (app *application) ProcessSubscription(w http.ResponseWriter, r *http.Request) {
 	var payload stripePayload
 
 	err := json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
 		_ = app.badRequest(w, r, err)
+		return
 	}
 
 	debug, _ := json.MarshalIndent(payload, "", "    ")
 	app.infoLog.Println(string(debug))
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	// The plan and its price come from our widget, not from the browser.
+	widget, err := app.DB.GetWidget(payload.ProductID)
+	if err != nil || !widget.IsRecurring || widget.IsArchived {
+		app.errorLog.Println("not a subscription product:", payload.ProductID, err)
+		_ = app.badRequest(w, r, errors.New("no such plan"))
+		return
+	}
+	payload.PlanID = widget.PlanID
+	payload.Amount = widget.Price
+	payload.Currency = widget.Currency
+
+	// A payment method can only be attached to one customer, so it makes a
+	// good natural key when the client does not send one.
+	idemKey := idempotencyKey(r, "subscribe", payload.PaymentMethod)
+	if idemKey != "" && !app.claimIdempotencyKey(w, r, idemKey, payload) {
+		return
 	}
 
 	ok := true
 	retCode := http.StatusOK // optimism
 	var subscription *stripe.Subscription
+	var orderID int
+	var clientSecret string
 	txnMsg := "Transaction is successful"
 
-	cust, msg, err := card.CreateCustomer(payload.PaymentMethod, payload.Email)
+	verified := app.verifiedCustomer(payload)
+	cust, card, msg, err := app.subscriptionCard(&payload, verified, idemKey)
 	if err != nil {
 		app.errorLog.Println(msg, err)
 		ok = false
@@ -153,7 +318,14 @@ func (app *application) ProcessSubscription(w http.ResponseWriter, r *http.Reque
 		retCode = http.StatusBadRequest
 	}
 	if ok {
-		subscription, err = card.SubscribeCustomer(cust, payload.PlanID, payload.Email, payload.LastFour, "")
+		subscription, err = app.gateway.SubscribeCustomer(cards.SubscriptionRequest{
+			Customer:       cust,
+			Plan:           payload.PlanID,
+			PaymentMethod:  payload.PaymentMethod,
+			LastFour:       payload.LastFour,
+			TrialDays:      widget.TrialDays,
+			IdempotencyKey: idemKey,
+		})
 		if err != nil {
 			app.errorLog.Println(msg, err)
 			ok = false
@@ -162,62 +334,48 @@ func (app *application) ProcessSubscription(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	// Update the record to save a few fields. We use the PaymentsIntent field to hold the sub ID,
-	// and save the pm as well.
+	// Stripe makes the subscription whatever happens to the first
+	// payment, leaving it incomplete if the payment didn't go through.
 	if ok {
-		// save to DB...
-		sp := payload
-		custID, err := app.SaveCustomer(sp.FirstName, sp.LastName, sp.Email)
-		if err != nil {
-			app.errorLog.Println(err)
-			txnMsg = "We could not process your request"
-			_ = app.badRequest(w, r, errors.New(txnMsg))
-		}
-		txn := models.Transaction{
-			Amount:              sp.Amount,
-			Currency:            sp.Currency,
-			PaymentMethod:       sp.PaymentMethod,
-			PaymentIntent:       subscription.ID, // we reuse this field. Not my idea :-)
-			LastFour:            sp.LastFour,
-			ExpiryMonth:         sp.ExpiryMonth,
-			ExpiryYear:          sp.ExpiryYear,
-			TransactionStatusID: 2,
-			CreatedAt:           time.Now(),
-			UpdatedAt:           time.Now(),
-		}
-		txnID, err := app.SaveTxn(txn)
-		if err != nil {
-			app.errorLog.Println(err)
-			txnMsg = "We could not process your request"
-			_ = app.badRequest(w, r, errors.New(txnMsg))
+		if pi := firstPaymentIntent(subscription); pi != nil {
+			switch cards.PaymentIntentOutcome(pi) {
+			case cards.PaymentFailed:
+				app.errorLog.Printf("first payment for %s failed (%s)", subscription.ID, pi.Status)
+				if _, err := app.gateway.CancelSubscription(subscription.ID); err != nil {
+					app.errorLog.Println(err)
+				}
+				ok = false
+				txnMsg = "Your card was declined"
+				retCode = http.StatusBadRequest
+			case cards.PaymentNeedsAction:
+				// The order is pending until the customer authenticates
+				// the payment, and the webhooks tell us it went through.
+				clientSecret = pi.ClientSecret
+				txnMsg = "Please confirm the payment with your bank"
+			}
 		}
+	}
+
+	// Update the record to save a few fields, including the pm.
+	if ok {
+		// save to DB...
+		orderID, err = app.saveSubscriptionOrder(payload, verified != nil, cust, card, subscription)
 		if err != nil {
 			app.errorLog.Println(err)
+			ok = false
 			txnMsg = "We could not process your request"
-			_ = app.badRequest(w, r, errors.New(txnMsg))
-		}
-		order := models.Order{
-			WidgetID:      payload.ProductID,
-			TransactionID: txnID,
-			CustomerID:    custID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        sp.Amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
-		}
-		_, err = app.SaveOrder(order)
-		if err != nil {
-			app.errorLog.Println(err)
-			txnMsg = "We could not process your request"
-			_ = app.badRequest(w, r, errors.New(txnMsg))
+			if app.undoSubscription(subscription) {
+				txnMsg = "We could not process your request; your payment has been refunded"
+			}
+			retCode = http.StatusBadRequest
 		}
 	}
 
-	// stub
 	j := jsonResponse{
-		OK:      ok,
-		Message: txnMsg,
+		OK:           ok,
+		Message:      txnMsg,
+		ID:           orderID,
+		ClientSecret: clientSecret,
 	}
 	out, err := json.MarshalIndent(j, "", "  ")
 	if err != nil {
@@ -225,46 +383,181 @@ func (app *application) ProcessSubscription(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if idemKey != "" {
+		if ok || subscription != nil {
+			// Once Stripe has made a subscription under the key, a retry
+			// with it would only get that subscription back, cancelled or
+			// not, so the retry is given this answer instead.
+			err = app.DB.CompleteIdempotencyKey(idemKey, orderID, string(out))
+		} else {
+			// Let the customer try again, perhaps with another card.
+			err = app.DB.ReleaseIdempotencyKey(idemKey)
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(retCode)
 	_, _ = w.Write(out)
 
 }
 
-// Rather than share the wrapper routines, we choose to copy the code. At least in
-// theory, they could diverge between their backend and frontend versions. In any
-// case, it's a PITA to do so, since we have two different "main" packages so we
-// can create two different apps. So here we go:
-
-// Helper routines for DB writes
+// subscriptionCard returns the gateway customer for a new subscription,
+// and the card to save for them. A saved card fills in the card details
+// of the payload, and there is nothing new to save. Only a verified
+// customer keeps their gateway customer.
+func (app *application) subscriptionCard(payload *stripePayload, verified *models.Customer, idemKey string) (*stripe.Customer, *models.PaymentMethod, string, error) {
+	if payload.SavedCard != 0 {
+		customer, saved, err := app.checkoutCard(*payload)
+		if err != nil {
+			return nil, nil, err.Error(), err
+		}
+		payload.PaymentMethod = saved.GatewayPaymentMethodID
+		payload.CardBrand = saved.Brand
+		payload.LastFour = saved.LastFour
+		payload.ExpiryMonth = saved.ExpiryMonth
+		payload.ExpiryYear = saved.ExpiryYear
+		return &stripe.Customer{ID: customer}, nil, "", nil
+	}
 
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
+	cust, msg, err := app.gatewayCustomer(payload.PaymentMethod, payload.Email, verified, idemKey)
+	if err != nil {
+		return nil, nil, msg, err
 	}
-	id, err := app.DB.InsertCustomer(customer)
+
+	// The card is attached to the customer now, so it is saved.
+	pm, err := app.gateway.GetPaymentMethod(payload.PaymentMethod)
 	if err != nil {
-		return 0, err
+		app.errorLog.Println(err)
+		return cust, nil, "", nil
 	}
-	return id, nil
+	return cust, paymentMethodRecord(pm), "", nil
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// undoSubscription cancels a new subscription we couldn't record, and
+// gives back its first payment if that went through, so the customer
+// isn't billed for an order we don't have. It returns whether there was a
+// payment and it was refunded.
+func (app *application) undoSubscription(subscription *stripe.Subscription) bool {
+	_, err := app.gateway.CancelSubscription(subscription.ID)
 	if err != nil {
-		return 0, err
+		app.errorLog.Println("could not cancel", subscription.ID, err)
+	}
+
+	pi := firstPaymentIntent(subscription)
+	if pi == nil || cards.PaymentIntentOutcome(pi) != cards.PaymentSucceeded {
+		return false
 	}
-	return id, nil
+	_, err = app.gateway.Refund(cards.RefundRequest{
+		PaymentIntent:  pi.ID,
+		Amount:         int(pi.Amount),
+		Reason:         "order not taken",
+		IdempotencyKey: "not-taken:" + pi.ID,
+	})
+	if err != nil {
+		app.errorLog.Println("could not refund", pi.ID, err)
+		return false
+	}
+	return true
 }
 
-func (app *application) SaveTxn(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
+// firstPaymentIntent is the payment intent for a new subscription's first
+// invoice, if it has one. Trials don't.
+func firstPaymentIntent(subscription *stripe.Subscription) *stripe.PaymentIntent {
+	if subscription.LatestInvoice == nil {
+		return nil
+	}
+	return subscription.LatestInvoice.PaymentIntent
+}
+
+// saveSubscriptionOrder records the customer, transaction and order for a
+// new subscription, and returns the order ID. Nothing is charged during a
+// free trial, so its transaction stays pending, as it does for a first
+// payment that hasn't gone through yet. Verified is set for a customer
+// logged in to their account, whose record the order may update.
+func (app *application) saveSubscriptionOrder(sp stripePayload, verified bool, cust *stripe.Customer, card *models.PaymentMethod, subscription *stripe.Subscription) (int, error) {
+	txnStatusID := models.TxnCleared
+	if subscription.Status == stripe.SubscriptionStatusTrialing {
+		txnStatusID = models.TxnPending
+	}
+
+	var pi string
+	if intent := firstPaymentIntent(subscription); intent != nil {
+		pi = intent.ID
+		if cards.PaymentIntentOutcome(intent) != cards.PaymentSucceeded {
+			txnStatusID = models.TxnPending
+		}
+	}
+	record := subscriptionRecord(subscription)
+
+	_, _, orderID, err := app.DB.RecordPurchase(models.Purchase{
+		Customer: models.Customer{
+			FirstName:         sp.FirstName,
+			LastName:          sp.LastName,
+			Email:             sp.Email,
+			GatewayCustomerID: cust.ID,
+		},
+		Transaction: models.Transaction{
+			Amount:              sp.Amount,
+			Currency:            sp.Currency,
+			PaymentMethod:       sp.PaymentMethod,
+			PaymentIntent:       pi,
+			LastFour:            sp.LastFour,
+			ExpiryMonth:         sp.ExpiryMonth,
+			ExpiryYear:          sp.ExpiryYear,
+			TransactionStatusID: txnStatusID,
+		},
+		Order: &models.Order{
+			WidgetID: sp.ProductID,
+			StatusID: cards.SubscriptionOrderStatus(subscription),
+			Quantity: 1,
+			Amount:   sp.Amount,
+		},
+		CustomerVerified: verified,
+		Subscription:     &record,
+		PaymentMethod:    card,
+	})
+	return orderID, err
+}
+
+// claimIdempotencyKey claims idemKey for a request before its work is
+// done. It returns false if the work must not be done: the request was
+// made before, and the first response has been replayed, or the key was
+// first used by someone else or for something else, and is refused.
+func (app *application) claimIdempotencyKey(w http.ResponseWriter, r *http.Request, idemKey string, payload interface{}) bool {
+	prior, isNew, err := app.DB.ClaimIdempotencyKey(idemKey, app.requestHash(r, payload))
+	if errors.Is(err, models.ErrIdempotencyKeyReused) {
+		_ = app.writeJSON(w, http.StatusUnprocessableEntity, jsonResponse{OK: false, Message: "This Idempotency-Key was already used for a different request"})
+		return false
+	}
 	if err != nil {
-		return 0, err
+		app.errorLog.Println(err)
+		_ = app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "We could not process your request"})
+		return false
+	}
+	if !isNew {
+		app.replayIdempotent(w, prior)
+		return false
+	}
+	return true
+}
+
+// replayIdempotent answers a repeated request with the response we gave
+// the first time. If the first request hasn't finished yet, the client
+// is told to wait.
+func (app *application) replayIdempotent(w http.ResponseWriter, prior *models.IdempotencyKey) {
+	if prior.Response == "" {
+		_ = app.writeJSON(w, http.StatusConflict, jsonResponse{OK: false, Message: "This request is already being processed"})
+		return
 	}
-	return id, nil
+
+	app.infoLog.Printf("replaying response for %s (order %d)", prior.Key, prior.OrderID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(prior.Response))
 }
 
 // Authentication
@@ -301,27 +594,30 @@ func (app *application) PasswordLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Every request counts against the throttle, since each one can send
+	// an email. Resets are counted apart from logins.
+	keys := []models.ThrottleKey{models.ResetKey(payload.Email), models.ResetIPKey(clientIP(r))}
+	if _, ok := app.reserveAttempt(w, keys); !ok {
+		return
+	}
+
 	var output struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
 	}
 
-	// See if we have such a user
+	// The answer is the same whether or not we have such a user, so this
+	// can't be used to find out who has an account.
 	user, err := app.DB.GetUserByEmail(payload.Email)
-	if err != nil {
-		_ = app.invalidCredentials(w)
-		return
-	}
-
-	err = app.sendPasswordEmail(user)
-	if err != nil {
-		app.errorLog.Println(err)
-		_ = app.badRequest(w, r, err)
-		return
+	if err == nil {
+		err = app.sendPasswordEmail(user)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
 	}
 
 	output.Error = false
-	output.Message = "We've sent you an email with a link"
+	output.Message = "If there is an account for that address, we've sent it an email with a link."
 
 	_ = app.writeJSON(w, http.StatusOK, output)
 }
@@ -384,6 +680,8 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	var userInput struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// Label names the device, for the user's list of sessions.
+		Label string `json:"label"`
 	}
 
 	err := app.readJSON(w, r, &userInput)
@@ -392,48 +690,62 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// See if we have such a user
+	keys := loginKeys(r, userInput.Email)
+	locked, ok := app.reserveAttempt(w, keys)
+	if !ok {
+		return
+	}
+
+	// See if we have such a user. A password is checked even if we don't,
+	// so the answer takes as long either way.
 	user, err := app.DB.GetUserByEmail(userInput.Email)
+	hash := user.Password
 	if err != nil {
+		hash = dummyHash
+	}
+	matches, pwErr := app.passwordsMatch(hash, userInput.Password)
+	if pwErr != nil {
+		// Exceptional case
+		app.errorLog.Println(pwErr)
+	}
+	if err != nil || !matches {
+		app.attemptFailed(locked)
 		_ = app.invalidCredentials(w)
 		return
 	}
-	matches, err := app.passwordsMatch(user.Password, userInput.Password)
+	app.attemptSucceeded(keys)
+	// Users with two-factor login, or who the policy says must have it,
+	// have a second step to pass first.
+	required, err := app.DB.Require2FA()
 	if err != nil {
-		// Exceptional case
 		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
 		return
 	}
-	if !matches {
-		_ = app.invalidCredentials(w)
+	if user.TOTPEnabled || required {
+		app.startLoginChallenge(w, r, user, userInput.Label)
 		return
 	}
-	// Now generate our token
-	token, err := models.GenerateToken(user.ID, AuthTokenTTL, models.ScopeAuthentication)
+	err = app.DB.ClearThrottle(models.AccountKey(user.Email))
 	if err != nil {
 		app.errorLog.Println(err)
-		_ = app.badRequest(w, r, err)
-		return
 	}
 
-	err = app.DB.InsertToken(token, user)
+	// Now generate our tokens
+	access, refresh, err := app.DB.NewSession(user, userInput.Label, r.UserAgent(), AccessTokenTTL, RefreshTokenTTL)
 	if err != nil {
 		app.errorLog.Println(err)
 		_ = app.badRequest(w, r, err)
+		return
 	}
 
-	var payload struct {
-		Error   bool          `json:"error"`
-		Message string        `json:"message"`
-		Token   *models.Token `json:"authentication_token"`
-		UserID  int           `json:"user_id,omitempty"`
+	payload := tokenPayload{
+		Message: fmt.Sprintf("token for %s created", userInput.Email),
+		Token:   access,
+		Refresh: refresh,
+		UserID:  user.ID,
+		RoleID:  user.RoleID,
 	}
-
-	payload.Error = false
-	payload.Message = fmt.Sprintf("token for %s created", userInput.Email)
-	payload.Token = token
-	payload.UserID = user.ID
-
 	err = app.writeJSON(w, http.StatusOK, payload)
 	if err != nil {
 		app.errorLog.Println(err)
@@ -447,14 +759,11 @@ func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Reque
 		Authorized bool   `json:"authorized"`
 	}
 
-	authHdr := r.Header.Get("Authorization")
-	prefixLen := len("Bearer ")
-
-	if authHdr[:prefixLen] == "Bearer " {
-		token := authHdr[prefixLen:]
-		user, err := app.DB.GetUserFromToken(token, AuthTokenTTL)
+	token := bearerToken(r)
+	if token != "" {
+		user, err := app.DB.GetUserFromToken(token, models.ScopeAuthentication)
 		if err != nil {
-			if err.Error() != "token expired" {
+			if !errors.Is(err, models.ErrTokenExpired) {
 				app.errorLog.Println(err)
 				payload.Error = true
 			}
@@ -473,13 +782,22 @@ func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Reque
 
 func (app *application) CreateNewUser(w http.ResponseWriter, r *http.Request) {
 	var userInput struct {
-		FirstName string `json:"first_name"`
-		LastName  string `json:"last_name"`
-		Email     string `json:"email"`
-		Password  string `json:"password"`
+		FirstName string      `json:"first_name"`
+		LastName  string      `json:"last_name"`
+		Email     string      `json:"email"`
+		Password  string      `json:"password"`
+		RoleID    models.Role `json:"role_id"`
 	}
 
 	err := app.readJSON(w, r, &userInput)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if userInput.RoleID != 0 && !userInput.RoleID.Valid() {
+		_ = app.badRequest(w, r, errors.New("no such role"))
+		return
+	}
 
 	// Does the user already exist on this email?
 	user, err := app.DB.GetUserByEmail(userInput.Email)
@@ -517,6 +835,7 @@ func (app *application) CreateNewUser(w http.ResponseWriter, r *http.Request) {
 	u.LastName = userInput.LastName
 	u.Email = userInput.Email
 	u.Password = string(newHash)
+	u.RoleID = userInput.RoleID
 
 	uid, err := app.DB.InsertUser(u)
 	if err != nil {
@@ -545,6 +864,9 @@ func (app *application) CreateNewUser(w http.ResponseWriter, r *http.Request) {
 	_ = app.writeJSON(w, http.StatusCreated, out)
 }
 
+// VTermSuccessHandler records a virtual terminal payment once the browser
+// has confirmed it. A payment still processing is recorded as pending, and
+// the payment_intent.succeeded webhook clears it.
 func (app *application) VTermSuccessHandler(w http.ResponseWriter, r *http.Request) {
 	var txnData struct {
 		PaymentAmount   int    `json:"payment_amount"`
@@ -566,19 +888,29 @@ func (app *application) VTermSuccessHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(txnData.PaymentIntent)
+	pi, err := app.gateway.RetrievePaymentIntent(txnData.PaymentIntent)
 	if err != nil {
 		app.errorLog.Println("RPI", err)
 		_ = app.badRequest(w, r, err)
 		return
 	}
 
-	pm, err := card.GetPaymentMethod(txnData.PaymentMethod)
+	txnStatusID := models.TxnCleared
+	switch cards.PaymentIntentOutcome(pi) {
+	case cards.PaymentPending:
+		txnStatusID = models.TxnPending
+	case cards.PaymentNeedsAction:
+		_ = app.badRequest(w, r, errors.New("the payment has not been authenticated by the card holder"))
+		return
+	case cards.PaymentFailed:
+		_ = app.badRequest(w, r, fmt.Errorf("the payment did not go through (%s)", pi.Status))
+		return
+	}
+	// What was actually paid, not what the browser says.
+	txnData.PaymentAmount = int(pi.Amount)
+	txnData.PaymentCurrency = pi.Currency
+
+	pm, err := app.gateway.GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
 		app.errorLog.Println("GPM", err)
 		_ = app.badRequest(w, r, err)
@@ -588,7 +920,7 @@ func (app *application) VTermSuccessHandler(w http.ResponseWriter, r *http.Reque
 	txnData.LastFour = pm.Card.Last4
 	txnData.ExpiryMonth = int(pm.Card.ExpMonth)
 	txnData.ExpiryYear = int(pm.Card.ExpYear)
-	txnData.BankReturnCode = pi.Charges.Data[0].ID
+	txnData.BankReturnCode = cards.ChargeID(pi)
 
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
@@ -599,10 +931,10 @@ func (app *application) VTermSuccessHandler(w http.ResponseWriter, r *http.Reque
 		BankReturnCode:      txnData.BankReturnCode,
 		PaymentIntent:       txnData.PaymentIntent,
 		PaymentMethod:       txnData.PaymentMethod,
-		TransactionStatusID: 2,
+		TransactionStatusID: txnStatusID,
 	}
 
-	id, err := app.SaveTxn(txn)
+	id, err := app.DB.InsertTransaction(txn)
 	if err != nil {
 		app.errorLog.Println("STX", err)
 		_ = app.badRequest(w, r, err)
@@ -749,12 +1081,40 @@ func (app *application) SingleSubscription(w http.ResponseWriter, r *http.Reques
 	_ = app.writeJSON(w, http.StatusOK, item)
 }
 
+// OrderEvents returns an order's history: its status changes, refunds and
+// cancellations, oldest first. It works for subscriptions as well as sales.
+func (app *application) OrderEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("url param must be an integer"))
+		return
+	}
+	_, err = app.DB.GetOrder(id, true, 0)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return
+		}
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	events, err := app.DB.GetOrderEvents(id)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if events == nil {
+		events = []*models.OrderEvent{}
+	}
+	_ = app.writeJSON(w, http.StatusOK, events)
+}
+
 func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	var chargeToRefund struct {
-		ID            int    `json:"id"` // order_Id
-		PaymentIntent string `json:"pi"`
-		Amount        int    `json:"amount"` // 0 for full.
-		Currency      string `json:"currency"`
+		ID     int    `json:"id"`     // order_Id
+		Amount int    `json:"amount"` // 0 for whatever is left.
+		Reason string `json:"reason"`
 	}
 	err := app.readJSON(w, r, &chargeToRefund)
 	if err != nil {
@@ -762,6 +1122,12 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
 	// Let's validate the request.
 	order, err := app.DB.GetSale(chargeToRefund.ID)
 	if err != nil {
@@ -773,50 +1139,100 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if chargeToRefund.Amount == 0 {
-		chargeToRefund.Amount = order.Amount
-	} else if chargeToRefund.Amount > order.Amount {
-		// fraud
-		app.errorLog.Println("FRAUD: overrefunding a charge")
-		_ = app.badRequest(w, r, errors.New("rejected"))
-		return
-	}
-
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
+	// The refund is saved as pending first, so that it counts against the
+	// balance while Stripe works on it; a second refund of the same order
+	// has to wait for this one, and can't spend the same money.
+	refundID, amount, balance, err := app.DB.BeginRefund(models.Refund{
+		OrderID:  order.ID,
+		Amount:   chargeToRefund.Amount,
 		Currency: order.Transaction.Currency,
-	}
-	err = card.Refund(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+		Reason:   chargeToRefund.Reason,
+		UserID:   user.ID,
+	})
 	if err != nil {
+		if errors.Is(err, models.ErrRefundExceedsBalance) {
+			balance, _ = app.DB.RefundableBalance(order.ID)
+			err = fmt.Errorf("can refund at most %d", balance)
+		}
 		_ = app.badRequest(w, r, err)
 		return
 	}
-	err = app.DB.SetOrderStatusID(order.ID, cards.STATUS_REFUNDED)
+
+	// The payment intent comes from our records, not from the request.
+	refund, err := app.gateway.Refund(cards.RefundRequest{
+		PaymentIntent:  order.Transaction.PaymentIntent,
+		Amount:         amount,
+		Reason:         chargeToRefund.Reason,
+		RefundID:       refundID,
+		IdempotencyKey: fmt.Sprintf("refund:%d", refundID),
+	})
 	if err != nil {
+		if err := app.DB.FailRefund(refundID); err != nil {
+			app.errorLog.Println(err)
+		}
 		_ = app.badRequest(w, r, err)
 		return
 	}
 
+	// The money has gone back, so the refund has to be recorded. If it
+	// can't be yet, it stays pending, still counted against the balance,
+	// and Stripe's webhook for it records it.
+	message := "Refund created"
+	statusID := order.StatusID
+	for try := 0; try < 3; try++ {
+		statusID, err = app.DB.RecordRefund(models.Refund{
+			ID:              refundID,
+			OrderID:         order.ID,
+			Amount:          int(refund.Amount),
+			Currency:        string(refund.Currency),
+			Reason:          chargeToRefund.Reason,
+			GatewayRefundID: refund.ID,
+			UserID:          user.ID,
+		})
+		if err == nil {
+			break
+		}
+		app.errorLog.Printf("recording refund %d (%s): %v", refundID, refund.ID, err)
+		time.Sleep(time.Duration(try+1) * 200 * time.Millisecond)
+	}
+	if err != nil {
+		statusID = order.StatusID
+		message = "Refund created; it will show on the order once Stripe confirms it"
+	}
+
 	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+		Error    bool               `json:"error"`
+		Message  string             `json:"message"`
+		StatusID models.OrderStatus `json:"status_id"`
+		Balance  int                `json:"balance"`
 	}
 
 	resp.Error = false
-	resp.Message = "Refund created"
+	resp.Message = message
+	resp.StatusID = statusID
+	resp.Balance = balance - int(refund.Amount)
 	_ = app.writeJSON(w, http.StatusCreated, resp)
 }
 
+// CancelSubscription ends a subscription, either right away or, with
+// "at_period_end" set, when the period the customer has paid for is up.
 func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		OrderID int `json:"id"`
+		OrderID     int    `json:"id"`
+		AtPeriodEnd bool   `json:"at_period_end"`
+		Reason      string `json:"reason"`
 	}
 	err := app.readJSON(w, r, &payload)
 	if err != nil {
 		_ = app.badRequest(w, r, err)
 		return
 	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
 	order, err := app.DB.GetSubscription(payload.OrderID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -826,31 +1242,123 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		_ = app.badRequest(w, r, err)
 		return
 	}
+	if order.StatusID == models.OrderCancelled {
+		_ = app.badRequest(w, r, errors.New("subscription is already cancelled"))
+		return
+	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: order.Transaction.Currency,
+	subID, err := gatewaySubscriptionID(order)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var subscription *stripe.Subscription
+	if payload.AtPeriodEnd {
+		subscription, err = app.gateway.SetCancelAtPeriodEnd(subID, true)
+	} else {
+		subscription, err = app.gateway.CancelSubscription(subID)
 	}
-	// We stash the subID in the paymentIntent:
-	err = card.CancelSubscription(order.Transaction.PaymentIntent)
 	if err != nil {
 		_ = app.badRequest(w, r, err)
 		return
 	}
+	if err := app.syncSubscription(subscription); err != nil {
+		app.errorLog.Println(err)
+	}
 
 	// update order status
-	err = app.DB.SetOrderStatusID(order.ID, cards.STATUS_CANCELLED_SUB)
+	statusID := cards.SubscriptionOrderStatus(subscription)
+	err = app.DB.SetOrderStatus(order.ID, statusID, models.OrderEvent{
+		Kind:             models.EventCancellation,
+		UserID:           user.ID,
+		GatewayReference: subscription.ID,
+		Reason:           payload.Reason,
+	})
 	if err != nil {
 		_ = app.badRequest(w, r, err)
 		return
 	}
 
 	var out struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+		Error    bool               `json:"error"`
+		Message  string             `json:"message"`
+		StatusID models.OrderStatus `json:"status_id"`
 	}
 	out.Message = "unsubscribe successful"
+	if payload.AtPeriodEnd {
+		out.Message = "subscription will end with the current period"
+	}
+	out.StatusID = statusID
+
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// ResumeSubscription takes back a cancellation scheduled for the end of
+// the period.
+func (app *application) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		OrderID int    `json:"id"`
+		Reason  string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	order, err := app.DB.GetSubscription(payload.OrderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return
+		}
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if order.StatusID != models.OrderCancelsAtPeriodEnd {
+		_ = app.badRequest(w, r, errors.New("subscription is not scheduled to cancel"))
+		return
+	}
+
+	subID, err := gatewaySubscriptionID(order)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	subscription, err := app.gateway.SetCancelAtPeriodEnd(subID, false)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if err := app.syncSubscription(subscription); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	statusID := cards.SubscriptionOrderStatus(subscription)
+	err = app.DB.SetOrderStatus(order.ID, statusID, models.OrderEvent{
+		UserID:           user.ID,
+		GatewayReference: subscription.ID,
+		Reason:           payload.Reason,
+	})
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error    bool               `json:"error"`
+		Message  string             `json:"message"`
+		StatusID models.OrderStatus `json:"status_id"`
+	}
+	out.Message = "subscription resumed"
+	out.StatusID = statusID
 
 	_ = app.writeJSON(w, http.StatusOK, out)
 }
@@ -888,6 +1396,14 @@ func (app *application) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		user.Email = payload.Email
 	}
 
+	if payload.RoleID != 0 {
+		if !payload.RoleID.Valid() {
+			_ = app.badRequest(w, r, errors.New("no such role"))
+			return
+		}
+		user.RoleID = payload.RoleID
+	}
+
 	err = app.DB.EditUser(*user)
 	if err != nil {
 		_ = app.badRequest(w, r, err)
@@ -926,7 +1442,11 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	status := http.StatusOK // optimism
-	if err != nil {
+	if errors.Is(err, models.ErrLastOwner) {
+		out.Error = true
+		out.Message = err.Error()
+		status = http.StatusBadRequest
+	} else if err != nil {
 		out.Error = true
 		out.Message = fmt.Sprintf("deletion of user %d failed", user.ID)
 		app.errorLog.Println(err)
@@ -6,6 +6,8 @@ import (
 	"io"
 	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/torenware/go-stripe/internal/models"
 	"golang.org/x/crypto/bcrypt"
@@ -78,6 +80,33 @@ func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err e
 	return nil
 }
 
+// idempotencyKey returns the key for a request that creates an order: the
+// client's Idempotency-Key header if it sent one, or else a natural key
+// such as a payment method ID. The scope keeps different kinds of request
+// from colliding.
+func idempotencyKey(r *http.Request, scope, natural string) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = natural
+	}
+	if key == "" {
+		return ""
+	}
+	return scope + ":" + key
+}
+
+// requestHash identifies who made a request under an idempotency key, and
+// what they asked for, so that nobody else is given its response. A logged
+// in user is who they are; an anonymous caller is known only by what they
+// asked for.
+func (app *application) requestHash(r *http.Request, payload interface{}) string {
+	caller := ""
+	if user, err := app.getAuthenticatedUser(r); err == nil && user != nil {
+		caller = "user:" + strconv.Itoa(user.ID)
+	}
+	return models.RequestHash(caller, payload)
+}
+
 func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Error   bool   `json:"error"`
@@ -110,6 +139,19 @@ func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	return err
 }
 
+// forbidden is for a signed in user whose role doesn't allow the request.
+func (app *application) forbidden(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	payload.Error = true
+	payload.Message = "you do not have permission to do that"
+
+	err := app.writeJSON(w, http.StatusForbidden, &payload)
+	return err
+}
+
 func (app *application) passwordsMatch(hash, offeredPW string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(offeredPW))
 	if err != nil {
@@ -122,20 +164,40 @@ func (app *application) passwordsMatch(hash, offeredPW string) (bool, error) {
 }
 
 func (app *application) getAuthenticatedUser(r *http.Request) (*models.User, error) {
-	authHdr := r.Header.Get("Authorization")
-	prefixLen := len("Bearer ")
-
-	if len(authHdr) > 0 && authHdr[:prefixLen] == "Bearer " {
-		token := authHdr[prefixLen:]
-		user, err := app.DB.GetUserFromToken(token, AuthTokenTTL)
-		if err != nil {
-			if err.Error() != "token expired" {
-				app.errorLog.Println(err)
-				return nil, err
-			}
-			return nil, nil
-		}
+	// AuthHandler has already looked the user up.
+	if user, ok := r.Context().Value(userContextKey).(*models.User); ok {
 		return user, nil
 	}
-	return nil, errors.New("must supply auth header")
+
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errors.New("must supply auth header")
+	}
+
+	var user *models.User
+	var err error
+	if strings.HasPrefix(token, models.APIKeyPrefix) {
+		user, err = app.DB.GetUserFromAPIKey(token)
+	} else {
+		user, err = app.DB.GetUserFromToken(token, models.ScopeAuthentication)
+	}
+	if err != nil {
+		if !errors.Is(err, models.ErrTokenExpired) {
+			app.errorLog.Println(err)
+			return nil, err
+		}
+		return nil, nil
+	}
+	return user, nil
+}
+
+// bearerToken returns the token from the request's Authorization header,
+// or "" if there isn't one.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	authHdr := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHdr, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(authHdr[len(prefix):])
 }
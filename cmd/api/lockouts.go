@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+// dummyHash is checked against when there is no such user, so a login for
+// an unknown address takes as long as one with a wrong password.
+const dummyHash = "$2a$12$QjBTH05QA2HMBPprNBAT1uj2k2Vp7XazLA.oPtUfOAypwstjWeLs."
+
+// clientIP returns the address the request came from. cmd/web has the
+// same.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginKeys are what a login to email counts against.
+func loginKeys(r *http.Request, email string) []models.ThrottleKey {
+	return []models.ThrottleKey{models.AccountKey(email), models.IPKey(clientIP(r))}
+}
+
+// reserveAttempt counts an attempt against keys before it is checked, so
+// that guesses made at the same time can't get round the limit. If keys
+// have to wait first, it writes the error response itself and returns
+// false. Otherwise the caller settles the attempt with attemptFailed or
+// attemptSucceeded.
+func (app *application) reserveAttempt(w http.ResponseWriter, keys []models.ThrottleKey) ([]*models.Throttle, bool) {
+	wait, locked, err := app.DB.ReserveAttempt(keys...)
+	if err != nil {
+		// Better to let the attempt through than lock everyone out.
+		app.errorLog.Println(err)
+		return nil, true
+	}
+	if wait > 0 {
+		_ = app.tooManyAttempts(w, wait)
+		return nil, false
+	}
+	return locked, true
+}
+
+// attemptFailed tells the owner of an account if the failed attempt
+// locked it.
+func (app *application) attemptFailed(locked []*models.Throttle) {
+	for _, t := range locked {
+		app.infoLog.Printf("%s %s locked out until %s", t.Kind, t.Key, t.LockedUntil.Format(time.RFC3339))
+		if t.Kind != models.ThrottleAccount {
+			continue
+		}
+		err := app.sendLockoutEmail(t)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+}
+
+// attemptSucceeded takes back the attempt counted against keys.
+func (app *application) attemptSucceeded(keys []models.ThrottleKey) {
+	err := app.DB.ForgiveAttempt(keys...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// sendLockoutEmail tells a user their account was locked out. There is
+// nobody to tell if the address isn't one of ours.
+func (app *application) sendLockoutEmail(t *models.Throttle) error {
+	user, err := app.DB.GetUserByEmail(t.Key)
+	if err != nil {
+		return nil
+	}
+
+	var data struct {
+		Failures int
+		Until    string
+		Link     string
+	}
+	data.Failures = t.Failures
+	data.Until = t.LockedUntil.Format("3:04 PM MST on January 2, 2006")
+	data.Link = fmt.Sprintf("%s/forgot-password", app.config.frontend)
+	return app.SendMail("info@widgets.com", user.Email, "Your account has been locked", "account-locked", data)
+}
+
+// tooManyAttempts is for a client that has to wait before it tries again.
+func (app *application) tooManyAttempts(w http.ResponseWriter, wait time.Duration) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	payload.Error = true
+	if wait < time.Minute {
+		payload.Message = fmt.Sprintf("too many failed attempts; try again in %d seconds", int(math.Ceil(wait.Seconds())))
+	} else {
+		payload.Message = fmt.Sprintf("too many failed attempts; try again in %d minutes", int(math.Ceil(wait.Minutes())))
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return app.writeJSON(w, http.StatusTooManyRequests, &payload)
+}
+
+// ListLockouts lists the accounts, addresses and IPs with failed attempts
+// that still count, including the ones locked out.
+func (app *application) ListLockouts(w http.ResponseWriter, r *http.Request) {
+	throttles, err := app.DB.GetThrottles()
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if throttles == nil {
+		throttles = []*models.Throttle{}
+	}
+
+	var out struct {
+		Error    bool               `json:"error"`
+		Lockouts []*models.Throttle `json:"lockouts"`
+	}
+	out.Lockouts = throttles
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// ClearLockout forgets the failed attempts against one key, unlocking it.
+func (app *application) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("URI must specify ID"))
+		return
+	}
+
+	err = app.DB.DeleteThrottle(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return
+		}
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	out.Message = fmt.Sprintf("lockout %d was cleared", id)
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// fakeThrottles keeps login_throttles in memory, by kind and key.
+func fakeThrottles(fake *fakedb.DB, throttles map[models.ThrottleKey]*models.Throttle) {
+	fake.Handle("from login_throttles").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		t, ok := throttles[models.ThrottleKey{Kind: models.ThrottleKind(args[0].(string)), Key: args[1].(string)}]
+		if !ok {
+			return fakedb.RowsFrom(q)
+		}
+		var lockedUntil driver.Value
+		if !t.LockedUntil.IsZero() {
+			lockedUntil = t.LockedUntil
+		}
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":              int64(1),
+			"kind":            string(t.Kind),
+			"throttle_key":    t.Key,
+			"failures":        int64(t.Failures),
+			"last_failure_at": t.LastFailure,
+			"locked_until":    lockedUntil,
+		})
+	}
+	fake.Handle("insert into login_throttles").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		key := models.ThrottleKey{Kind: models.ThrottleKind(args[0].(string)), Key: args[1].(string)}
+		throttles[key] = &models.Throttle{
+			Kind:        key.Kind,
+			Key:         key.Key,
+			Failures:    int(args[2].(int64)),
+			LastFailure: args[3].(time.Time),
+		}
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+}
+
+func TestCreateAuthTokenThrottled(t *testing.T) {
+	login := map[string]string{"email": "Jane@Example.com", "password": "wrong"}
+
+	t.Run("locked out", func(t *testing.T) {
+		app, fake, _ := testApp(t)
+		fakeThrottles(fake, map[models.ThrottleKey]*models.Throttle{
+			models.AccountKey("jane@example.com"): {
+				Kind:        models.ThrottleAccount,
+				Key:         "jane@example.com",
+				Failures:    10,
+				LastFailure: time.Now(),
+				LockedUntil: time.Now().Add(15 * time.Minute),
+			},
+		})
+
+		w := post(t, app.CreateAuthToken, login, nil)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("got %d %s", w.Code, w.Body)
+		}
+		if fake.Ran("from users") != 0 {
+			t.Error("the password was checked while locked out")
+		}
+	})
+
+	t.Run("failure counted", func(t *testing.T) {
+		app, fake, _ := testApp(t)
+		throttles := map[models.ThrottleKey]*models.Throttle{}
+		fakeThrottles(fake, throttles)
+		fake.Handle("from users")
+
+		w := post(t, app.CreateAuthToken, login, nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("got %d %s", w.Code, w.Body)
+		}
+		account := throttles[models.AccountKey("jane@example.com")]
+		ip := throttles[models.IPKey("192.0.2.1")]
+		if account == nil || account.Failures != 1 || ip == nil || ip.Failures != 1 {
+			t.Errorf("throttles: %v", throttles)
+		}
+	})
+}
+
+// Asking for reset links counts against resets from the address, not
+// against logging in from it.
+func TestPasswordLinkThrottled(t *testing.T) {
+	app, fake, _ := testApp(t)
+	throttles := map[models.ThrottleKey]*models.Throttle{}
+	fakeThrottles(fake, throttles)
+	fake.Handle("from users")
+
+	w := post(t, app.PasswordLink, map[string]string{"email": "jane@example.com"}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if throttles[models.ResetIPKey("192.0.2.1")] == nil || throttles[models.ResetKey("jane@example.com")] == nil {
+		t.Errorf("throttles: %v", throttles)
+	}
+	if throttles[models.IPKey("192.0.2.1")] != nil {
+		t.Error("a reset link counted against logins")
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+
+	"github.com/torenware/go-stripe/internal/models"
 )
 
+type contextKey string
+
+// userContextKey holds the *models.User that AuthHandler let in.
+const userContextKey = contextKey("user")
+
 func (app *application) AuthHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user, _ := app.getAuthenticatedUser(r)
@@ -13,6 +21,38 @@ func (app *application) AuthHandler(next http.Handler) http.Handler {
 			app.invalidCredentials(w)
 			return
 		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequirePermission lets through only users whose role grants p. It has
+// to come after AuthHandler, which finds the user.
+func (app *application) RequirePermission(p models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, _ := r.Context().Value(userContextKey).(*models.User)
+			if user == nil || !user.Can(p) {
+				app.infoLog.Printf("permission %s denied", p)
+				_ = app.forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession turns away requests made with an API key, for routes
+// that only make sense for someone who logged in. It has to come after
+// AuthHandler.
+func (app *application) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := r.Context().Value(userContextKey).(*models.User)
+		if user == nil || user.Scopes != nil {
+			app.infoLog.Println("API key used for a session route")
+			_ = app.forbidden(w)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -5,6 +5,8 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+
+	"github.com/torenware/go-stripe/internal/models"
 )
 
 func (app *application) routes() http.Handler {
@@ -13,7 +15,7 @@ func (app *application) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "PUT", "POST", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Allow", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Allow", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
 		AllowCredentials: false,
 		MaxAge:           300,
 		Debug:            false,
@@ -21,35 +23,79 @@ func (app *application) routes() http.Handler {
 
 	mux.Post("/api/payment-intent", app.GetPaymentIntent)
 	mux.Get("/api/sparams/{widgetID}", app.StripeParams)
+	mux.Get("/api/widgets", app.ListWidgets)
 	mux.Post("/api/create-customer-and-subscribe-to-plan", app.ProcessSubscription)
 
+	// Stripe calls this; requests are verified by signature, not by token.
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
+
+	// From the signed link in dunning emails; checked against the link's hash.
+	mux.Post("/api/update-card/setup-intent", app.UpdateCardSetupIntent)
+	mux.Post("/api/update-card", app.UpdateCard)
+
 	// Auth
 	mux.Post("/api/authenticate", app.CreateAuthToken)
+	mux.Post("/api/authenticate/2fa", app.CompleteLogin)
+	mux.Post("/api/authenticate/2fa/setup", app.LoginTwoFactorSetup)
+	mux.Post("/api/refresh-token", app.RefreshAuthToken)
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
 	mux.Post("/api/password-link", app.PasswordLink)
 	mux.Post("/api/reset-password", app.ResetPassword)
+	mux.Post("/api/account/login-link", app.AccountLoginLink)
 
 	// To apply an auth middleware on a group of routes, we use the Router
 	// method to create a sub-router
 
+	// Apart from the user's own sessions, every route here needs a
+	// permission from the user's role as well. Requests may use an API key
+	// instead of a token; then the key's scopes must allow it too.
 	mux.Route("/api/auth", func(mux chi.Router) {
 		mux.Use(app.AuthHandler)
+		can := app.RequirePermission
+
+		mux.With(app.RequireSession).Post("/logout", app.Logout)
+		mux.With(app.RequireSession).Get("/sessions", app.ListSessions)
+		mux.With(app.RequireSession).Delete("/sessions/{id}", app.RevokeSession)
+		mux.With(app.RequireSession).Post("/revoke-sessions", app.RevokeAllSessions)
+		mux.With(app.RequireSession).Get("/2fa", app.TwoFactorStatus)
+		mux.With(app.RequireSession).Post("/2fa/setup", app.SetupTwoFactor)
+		mux.With(app.RequireSession).Post("/2fa/enable", app.EnableTwoFactor)
+		mux.With(app.RequireSession).Post("/2fa/disable", app.DisableTwoFactor)
+		mux.With(app.RequireSession).Post("/2fa/recovery-codes", app.NewRecoveryCodes)
+
+		mux.With(can(models.PermVirtualTerminal)).Post("/vterm-success-handler", app.VTermSuccessHandler)
+		mux.With(can(models.PermViewSales)).Post("/list-sales", app.ListSales)
+		mux.With(can(models.PermViewSales)).Post("/list-subs", app.ListSubscriptions)
+		mux.With(can(models.PermViewUsers)).Post("/list-users", app.ListUsers)
+
+		mux.With(can(models.PermViewSales)).Get("/sale/{id}", app.SingleSale)
+		mux.With(can(models.PermViewSales)).Get("/sale/{id}/events", app.OrderEvents)
+		mux.With(can(models.PermViewSales)).Get("/subscription/{id}", app.SingleSubscription)
 
-		mux.Post("/vterm-success-handler", app.VTermSuccessHandler)
-		mux.Post("/list-sales", app.ListSales)
-		mux.Post("/list-subs", app.ListSubscriptions)
-		mux.Post("/list-users", app.ListUsers)
+		mux.With(can(models.PermRefund)).Post("/refund", app.RefundCharge)
+		mux.With(can(models.PermManageSubscriptions)).Post("/cancel-subscription", app.CancelSubscription)
+		mux.With(can(models.PermManageSubscriptions)).Post("/resume-subscription", app.ResumeSubscription)
+		mux.With(can(models.PermManageSubscriptions)).Post("/subscription/{id}/change-plan", app.ChangePlan)
 
-		mux.Get("/sale/{id}", app.SingleSale)
-		mux.Get("/subscription/{id}", app.SingleSubscription)
+		mux.With(can(models.PermManageUsers)).Post("/new-user", app.CreateNewUser)
+		mux.With(can(models.PermViewUsers)).Get("/user/{id}", app.SingleUser)
+		mux.With(can(models.PermManageUsers)).Post("/user/{id}", app.UpdateUser)
+		mux.With(can(models.PermManageUsers)).Delete("/user/{id}", app.DeleteUser)
+		mux.With(can(models.PermManageUsers)).Post("/user/{id}/revoke-sessions", app.RevokeUserSessions)
+		mux.With(can(models.PermManageUsers)).Post("/user/{id}/reset-2fa", app.ResetUserTwoFactor)
+		mux.With(app.RequireSession, can(models.PermManageUsers)).Put("/2fa-policy", app.SetTwoFactorPolicy)
+		mux.With(can(models.PermManageUsers)).Get("/lockouts", app.ListLockouts)
+		mux.With(can(models.PermManageUsers)).Delete("/lockouts/{id}", app.ClearLockout)
 
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
+		mux.With(can(models.PermManageAPIKeys)).Get("/api-keys", app.ListAPIKeys)
+		mux.With(can(models.PermManageAPIKeys)).Post("/api-keys", app.CreateAPIKey)
+		mux.With(can(models.PermManageAPIKeys)).Delete("/api-keys/{id}", app.RevokeAPIKey)
 
-		mux.Post("/new-user", app.CreateNewUser)
-		mux.Get("/user/{id}", app.SingleUser)
-		mux.Post("/user/{id}", app.UpdateUser)
-		mux.Delete("/user/{id}", app.DeleteUser)
+		mux.With(can(models.PermViewWidgets)).Get("/widgets", app.ListAllWidgets)
+		mux.With(can(models.PermManageWidgets)).Post("/widgets", app.CreateWidget)
+		mux.With(can(models.PermViewWidgets)).Get("/widgets/{id}", app.SingleWidget)
+		mux.With(can(models.PermManageWidgets)).Put("/widgets/{id}", app.UpdateWidget)
+		mux.With(can(models.PermManageWidgets)).Delete("/widgets/{id}", app.ArchiveWidget)
 	})
 
 	return mux
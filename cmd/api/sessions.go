@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+// tokenPayload is the answer to a login or a refresh.
+type tokenPayload struct {
+	Error   bool          `json:"error"`
+	Message string        `json:"message"`
+	Token   *models.Token `json:"authentication_token"`
+	Refresh *models.Token `json:"refresh_token"`
+	UserID  int           `json:"user_id,omitempty"`
+	RoleID  models.Role   `json:"role_id,omitempty"`
+	// RecoveryCodes is set when a login also turned on two-factor login.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// RefreshAuthToken trades a refresh token for a new access token and
+// refresh token. The old refresh token can't be used again.
+func (app *application) RefreshAuthToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	access, refresh, err := app.DB.RefreshSession(input.RefreshToken, AccessTokenTTL, RefreshTokenTTL)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, models.ErrTokenExpired) {
+			app.errorLog.Println(err)
+		}
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	payload := tokenPayload{
+		Message: "token refreshed",
+		Token:   access,
+		Refresh: refresh,
+		UserID:  int(access.UserID),
+	}
+	err = app.writeJSON(w, http.StatusOK, payload)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Logout revokes the session the request's token belongs to.
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	err := app.DB.RevokeSession(bearerToken(r))
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, errors.New("could not log out"))
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	out.Message = "logged out"
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// ListSessions lists the devices the user is logged in on.
+func (app *application) ListSessions(w http.ResponseWriter, r *http.Request) {
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	sessions, err := app.DB.GetSessions(user.ID, bearerToken(r))
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if sessions == nil {
+		sessions = []*models.Session{}
+	}
+
+	var out struct {
+		Error    bool              `json:"error"`
+		Sessions []*models.Session `json:"sessions"`
+	}
+	out.Sessions = sessions
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// RevokeSession logs the user out of one of their sessions, such as one
+// on a lost device.
+func (app *application) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("URI must specify ID"))
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	err = app.DB.RevokeUserSession(user.ID, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return
+		}
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	out.Message = fmt.Sprintf("session %d was revoked", id)
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// RevokeAllSessions logs the user out everywhere, this device included.
+func (app *application) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+	app.revokeAllSessions(w, r, user.ID)
+}
+
+// RevokeUserSessions logs another user out everywhere, say if their
+// token was stolen.
+func (app *application) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("URI must specify ID"))
+		return
+	}
+
+	user, err := app.DB.GetUserByID(uid)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.notFound(w, r)
+		return
+	}
+	app.revokeAllSessions(w, r, user.ID)
+}
+
+func (app *application) revokeAllSessions(w http.ResponseWriter, r *http.Request, userID int) {
+	err := app.DB.RevokeAllSessions(userID)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, errors.New("could not revoke sessions"))
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	out.Message = fmt.Sprintf("all sessions for user %d were revoked", userID)
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
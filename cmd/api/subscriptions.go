@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+// subscriptionRecord is what we keep of a gateway subscription.
+func subscriptionRecord(subscription *stripe.Subscription) models.Subscription {
+	record := models.Subscription{
+		GatewaySubscriptionID: subscription.ID,
+		Status:                string(subscription.Status),
+	}
+	if subscription.Customer != nil {
+		record.GatewayCustomerID = subscription.Customer.ID
+	}
+	if price, err := subscriptionPrice(subscription); err == nil {
+		record.PriceID = price
+	}
+	if subscription.CurrentPeriodStart > 0 {
+		record.CurrentPeriodStart = time.Unix(subscription.CurrentPeriodStart, 0)
+	}
+	if subscription.CurrentPeriodEnd > 0 {
+		record.CurrentPeriodEnd = time.Unix(subscription.CurrentPeriodEnd, 0)
+	}
+	switch {
+	case subscription.CancelAt > 0:
+		record.CancelAt = time.Unix(subscription.CancelAt, 0)
+	case subscription.CancelAtPeriodEnd && subscription.CurrentPeriodEnd > 0:
+		record.CancelAt = time.Unix(subscription.CurrentPeriodEnd, 0)
+	}
+	return record
+}
+
+// subscriptionPrice returns the price a subscription is on. We sell them
+// with a single item.
+func subscriptionPrice(subscription *stripe.Subscription) (string, error) {
+	if subscription.Items == nil || len(subscription.Items.Data) != 1 {
+		return "", fmt.Errorf("subscription %s does not have exactly one item", subscription.ID)
+	}
+	item := subscription.Items.Data[0]
+	switch {
+	case item.Price != nil:
+		return item.Price.ID, nil
+	case item.Plan != nil:
+		return item.Plan.ID, nil
+	}
+	return "", fmt.Errorf("subscription %s has no price", subscription.ID)
+}
+
+// syncSubscription saves what the gateway just told us about a
+// subscription.
+func (app *application) syncSubscription(subscription *stripe.Subscription) error {
+	return app.DB.UpdateSubscription(subscriptionRecord(subscription))
+}
+
+// gatewaySubscriptionID returns the gateway's ID for a subscription order.
+func gatewaySubscriptionID(order *models.Order) (string, error) {
+	if order.Subscription == nil {
+		return "", fmt.Errorf("order %d has no subscription", order.ID)
+	}
+	return order.Subscription.GatewaySubscriptionID, nil
+}
+
+// ChangePlan moves a subscription to another plan. With "preview" set it
+// only reports what the change would cost. Committing should pass back
+// the preview's proration_date, so the customer is charged what they
+// were shown.
+func (app *application) ChangePlan(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		WidgetID      int   `json:"widget_id"`
+		Preview       bool  `json:"preview"`
+		ProrationDate int64 `json:"proration_date"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("URI must specify ID"))
+		return
+	}
+	order, err := app.DB.GetSubscription(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return
+		}
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	switch order.StatusID {
+	case models.OrderCharged, models.OrderPastDue, models.OrderTrialing:
+	default:
+		_ = app.badRequest(w, r, errors.New("subscription is not active"))
+		return
+	}
+
+	widget, err := app.DB.GetWidget(payload.WidgetID)
+	if err != nil || !widget.IsRecurring || widget.IsArchived {
+		_ = app.badRequest(w, r, errors.New("no such plan"))
+		return
+	}
+	if widget.ID == order.WidgetID {
+		_ = app.badRequest(w, r, errors.New("subscription is already on that plan"))
+		return
+	}
+	if widget.Currency != order.Transaction.Currency {
+		_ = app.badRequest(w, r, fmt.Errorf("plan is billed in %s, not %s", widget.Currency, order.Transaction.Currency))
+		return
+	}
+
+	subID, err := gatewaySubscriptionID(order)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	req := cards.PlanChangeRequest{
+		SubscriptionID: subID,
+		PriceID:        widget.PlanID,
+		ProrationDate:  payload.ProrationDate,
+	}
+
+	preview, err := app.gateway.PreviewPlanChange(req)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error            bool   `json:"error"`
+		Message          string `json:"message"`
+		FromWidgetID     int    `json:"from_widget_id"`
+		ToWidgetID       int    `json:"to_widget_id"`
+		Amount           int    `json:"amount"`
+		Proration        int64  `json:"proration"`
+		NextInvoiceTotal int64  `json:"next_invoice_total"`
+		Currency         string `json:"currency"`
+		ProrationDate    int64  `json:"proration_date"`
+		ChangeID         int    `json:"change_id,omitempty"`
+	}
+	resp.FromWidgetID = order.WidgetID
+	resp.ToWidgetID = widget.ID
+	resp.Amount = widget.Price
+	resp.Proration = preview.Proration
+	resp.NextInvoiceTotal = preview.NextInvoiceTotal
+	resp.Currency = preview.Currency
+	resp.ProrationDate = preview.ProrationDate
+
+	if payload.Preview {
+		resp.Message = "preview"
+		_ = app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	req.ProrationDate = preview.ProrationDate
+	req.IdempotencyKey = idempotencyKey(r, "change-plan",
+		fmt.Sprintf("%d:%d:%d", order.ID, widget.ID, preview.ProrationDate))
+	subscription, err := app.gateway.ChangePlan(req)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if err := app.syncSubscription(subscription); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	changeID, err := app.DB.ChangeSubscriptionPlan(models.PlanChange{
+		OrderID:      order.ID,
+		FromWidgetID: order.WidgetID,
+		ToWidgetID:   widget.ID,
+		FromAmount:   order.Amount,
+		ToAmount:     widget.Price,
+		Proration:    int(preview.Proration),
+		Currency:     preview.Currency,
+		UserID:       user.ID,
+	})
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	resp.Message = fmt.Sprintf("subscription moved to %s", widget.Name)
+	resp.ChangeID = changeID
+	_ = app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// fakeSubscription fakes subscription order 7 on widget 1, for the
+// gateway subscription subID. It returns the order's status, which starts
+// as charged.
+func fakeSubscription(fake *fakedb.DB, subID string) *models.OrderStatus {
+	status := models.OrderCharged
+	fake.Handle("from orders o").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"amount":           int64(1000),
+			"quantity":         int64(1),
+			"price":            int64(1000),
+			"currency":         "cad",
+			"order_id":         int64(7),
+			"widget_id":        int64(1),
+			"transaction_id":   int64(3),
+			"customer_id":      int64(4),
+			"created_at":       time.Now(),
+			"status_id":        int64(status),
+			"reference":        "ORD-TEST",
+			"item":             "Bronze",
+			"description":      "A monthly plan.",
+			"is_recurring":     true,
+			"last_four":        "4242",
+			"expiry_month":     int64(12),
+			"expiry_year":      int64(2030),
+			"payment_intent":   "pi_first",
+			"bank_return_code": "",
+			"first_name":       "Jane",
+			"last_name":        "Doe",
+			"email":            "jane@example.com",
+		})
+	}
+	fake.Handle("from order_items")
+	fake.Handle("from refunds")
+	fake.Handle("from plan_changes")
+	fake.Handle("from dunning_attempts")
+	fake.Handle("from subscriptions where order_id").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":                      int64(2),
+			"order_id":                int64(7),
+			"customer_id":             int64(4),
+			"gateway_subscription_id": subID,
+			"gateway_customer_id":     "cus_1",
+			"price_id":                "price_bronze",
+			"status":                  "active",
+			"current_period_start":    time.Now(),
+			"current_period_end":      time.Now().AddDate(0, 1, 0),
+			"cancel_at":               nil,
+			"created_at":              time.Now(),
+			"updated_at":              time.Now(),
+		})
+	}
+	fake.Handle("update subscriptions set")
+	fake.Handle("select status_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status_id": int64(status)})
+	}
+	fake.Handle("update orders set status_id").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		status = models.OrderStatus(args[0].(int64))
+		return fakedb.Result{Affected: 1}, nil
+	}
+	fake.Handle("insert into order_events")
+	return &status
+}
+
+// changePlan posts a plan change for order 7 through the API's route.
+func changePlan(t *testing.T, app *application, header http.Header, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	out, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := chi.NewRouter()
+	mux.Post("/api/admin/subscription/{id}/change-plan", app.ChangePlan)
+	r := httptest.NewRequest(http.MethodPost, "/api/admin/subscription/7/change-plan", bytes.NewReader(out))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+type planChangeResponse struct {
+	Message       string `json:"message"`
+	Proration     int64  `json:"proration"`
+	ProrationDate int64  `json:"proration_date"`
+	ChangeID      int    `json:"change_id"`
+}
+
+// Committing a plan change charges the proration the preview showed, and
+// records it.
+func TestChangePlan(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	admin := asAdmin(fake)
+	gateway.AddPrice("price_bronze", 1000, "cad", true)
+	gateway.AddPrice("price_silver", 2000, "cad", true)
+	card := gateway.AddCard("visa", "4242", 12, 2030)
+	cust, _, err := gateway.CreateCustomer(card.ID, "jane@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := gateway.SubscribeCustomer(cards.SubscriptionRequest{Customer: cust, Plan: "price_bronze"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeSubscription(fake, subscription.ID)
+	fake.Handle("from widgets").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		widget := widgetRecord(args[0].(int64))
+		widget["name"] = "Silver"
+		widget["price"] = int64(2000)
+		widget["is_recurring"] = true
+		widget["plan_id"] = "price_silver"
+		return fakedb.RowsFrom(q, widget)
+	}
+	var recorded []driver.Value
+	fake.Handle("update orders set widget_id")
+	fake.Handle("update order_items")
+	fake.Handle("insert into plan_changes").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		recorded = args
+		return fakedb.Result{ID: 3, Affected: 1}, nil
+	}
+
+	var preview planChangeResponse
+	w := changePlan(t, app, admin, map[string]interface{}{"widget_id": 2, "preview": true})
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("preview: got %d %s", w.Code, w.Body)
+	}
+	if preview.Proration <= 0 || recorded != nil {
+		t.Fatalf("preview: got %+v, recorded %v", preview, recorded)
+	}
+
+	var done planChangeResponse
+	w = changePlan(t, app, admin, map[string]interface{}{"widget_id": 2, "proration_date": preview.ProrationDate})
+	if err := json.Unmarshal(w.Body.Bytes(), &done); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("change: got %d %s", w.Code, w.Body)
+	}
+	if done.Proration != preview.Proration || done.ChangeID != 3 {
+		t.Errorf("previewed %+v, changed %+v", preview, done)
+	}
+	if recorded == nil || recorded[2] != int64(2) || recorded[5] != preview.Proration {
+		t.Errorf("recorded %v", recorded)
+	}
+
+	item := subscription.Items.Data[0]
+	if item.Price == nil || item.Price.ID != "price_silver" {
+		t.Errorf("subscription is on %+v", item.Price)
+	}
+}
+
+// A cancellation scheduled for the end of the period leaves the
+// subscription running until then, and can be taken back.
+func TestCancelAtPeriodEnd(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	gateway.AddPrice("price_bronze", 1000, "cad", true)
+	card := gateway.AddCard("visa", "4242", 12, 2030)
+	cust, _, err := gateway.CreateCustomer(card.ID, "jane@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := gateway.SubscribeCustomer(cards.SubscriptionRequest{Customer: cust, Plan: "price_bronze", TrialDays: 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := fakeSubscription(fake, subscription.ID)
+	*status = models.OrderTrialing
+	admin := asAdmin(fake)
+
+	w := post(t, app.CancelSubscription, map[string]interface{}{"id": 7, "at_period_end": true}, admin)
+	if w.Code != http.StatusOK || *status != models.OrderCancelsAtPeriodEnd {
+		t.Fatalf("cancel: got %d %s, status %s", w.Code, w.Body, status.Name())
+	}
+	if subscription.Status == stripe.SubscriptionStatusCanceled || !subscription.CancelAtPeriodEnd {
+		t.Errorf("subscription is %s, cancel at period end %v", subscription.Status, subscription.CancelAtPeriodEnd)
+	}
+	if fake.Ran("update subscriptions set") != 1 {
+		t.Error("the subscription's cancellation date was not saved")
+	}
+
+	w = post(t, app.ResumeSubscription, map[string]interface{}{"id": 7}, admin)
+	if w.Code != http.StatusOK || *status != models.OrderTrialing || subscription.CancelAtPeriodEnd {
+		t.Errorf("resume: got %d %s, status %s", w.Code, w.Body, status.Name())
+	}
+
+	w = post(t, app.ResumeSubscription, map[string]interface{}{"id": 7}, admin)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("resumed twice: got %d %s", w.Code, w.Body)
+	}
+}
+
+// A cancellation scheduled for the end of the period is kept as the date
+// the subscription ends.
+func TestSubscriptionRecord(t *testing.T) {
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	subscription := &stripe.Subscription{
+		ID:                 "sub_1",
+		Status:             stripe.SubscriptionStatusActive,
+		Customer:           &stripe.Customer{ID: "cus_1"},
+		CurrentPeriodStart: start.Unix(),
+		CurrentPeriodEnd:   end.Unix(),
+		CancelAtPeriodEnd:  true,
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{{Plan: &stripe.Plan{ID: "price_bronze"}}},
+		},
+	}
+
+	record := subscriptionRecord(subscription)
+	if record.GatewaySubscriptionID != "sub_1" || record.GatewayCustomerID != "cus_1" ||
+		record.PriceID != "price_bronze" || record.Status != "active" {
+		t.Errorf("got %+v", record)
+	}
+	if !record.CurrentPeriodStart.Equal(start) || !record.CancelAt.Equal(end) {
+		t.Errorf("period from %s, cancelled at %s", record.CurrentPeriodStart, record.CancelAt)
+	}
+
+	subscription.CancelAtPeriodEnd = false
+	if record := subscriptionRecord(subscription); !record.CancelAt.IsZero() {
+		t.Errorf("cancelled at %s", record.CancelAt)
+	}
+}
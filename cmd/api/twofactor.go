@@ -0,0 +1,448 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/totp"
+)
+
+const (
+	// totpIssuer names us in the user's authenticator app.
+	totpIssuer = "Widgets Co."
+	// How long a user has to give the second step of a login.
+	loginChallengeTTL = 5 * time.Minute
+)
+
+// startLoginChallenge answers a login that got the password right, for a
+// user who must also give a code. The challenge it hands back goes to
+// CompleteLogin with the code. If SetupRequired is set the user has no
+// authenticator yet, and must get a secret from LoginTwoFactorSetup first.
+func (app *application) startLoginChallenge(w http.ResponseWriter, r *http.Request, user models.User, label string) {
+	challenge, err := app.DB.NewLoginChallenge(user, label, r.UserAgent(), loginChallengeTTL)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error         bool   `json:"error"`
+		Message       string `json:"message"`
+		TOTPRequired  bool   `json:"totp_required"`
+		SetupRequired bool   `json:"totp_setup_required"`
+		Challenge     string `json:"challenge"`
+	}
+	out.TOTPRequired = true
+	out.SetupRequired = !user.TOTPEnabled
+	out.Challenge = challenge.PlainText
+	if out.SetupRequired {
+		out.Message = "two-factor login is required; set up an authenticator app to continue"
+	} else {
+		out.Message = "enter the code from your authenticator app, or a recovery code"
+	}
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// loginChallengeUser returns the user a login challenge is for. It
+// writes the error response itself if there isn't one.
+func (app *application) loginChallengeUser(w http.ResponseWriter, challenge string) (*models.Token, *models.User) {
+	token, err := app.DB.GetLoginChallenge(challenge)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, models.ErrTokenExpired) {
+			app.errorLog.Println(err)
+		}
+		_ = app.invalidCredentials(w)
+		return nil, nil
+	}
+	user, err := app.DB.GetUserByID(int(token.UserID))
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.invalidCredentials(w)
+		return nil, nil
+	}
+	return token, user
+}
+
+// LoginTwoFactorSetup gives a user part way through logging in a new
+// secret for their authenticator, when the policy says they need one.
+func (app *application) LoginTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Challenge string `json:"challenge"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	_, user := app.loginChallengeUser(w, input.Challenge)
+	if user == nil {
+		return
+	}
+	app.startTwoFactorSetup(w, r, user)
+}
+
+// CompleteLogin is the second step of a login: it trades a challenge and
+// a code for the user's tokens. A user setting up their authenticator
+// during login gets their recovery codes here as well.
+func (app *application) CompleteLogin(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	challenge, user := app.loginChallengeUser(w, input.Challenge)
+	if user == nil {
+		return
+	}
+	// Codes are short, so guesses count against the same throttle as
+	// passwords do.
+	keys := loginKeys(r, user.Email)
+	locked, ok := app.reserveAttempt(w, keys)
+	if !ok {
+		return
+	}
+
+	var codes []string
+	if user.TOTPEnabled {
+		err = app.DB.CheckSecondFactor(user.ID, input.Code)
+	} else {
+		codes, err = app.DB.EnableTwoFactor(user.ID, input.Code)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNoTwoFactorSetup) {
+			app.attemptSucceeded(keys)
+			_ = app.badRequest(w, r, err)
+			return
+		}
+		if !errors.Is(err, models.ErrBadCode) {
+			app.errorLog.Println(err)
+		}
+		app.attemptFailed(locked)
+		_ = app.invalidCredentials(w)
+		return
+	}
+	app.attemptSucceeded(keys)
+
+	err = app.DB.ClearThrottle(models.AccountKey(user.Email))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	err = app.DB.DeleteToken(challenge.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	access, refresh, err := app.DB.NewSession(*user, challenge.Label, challenge.UserAgent, AccessTokenTTL, RefreshTokenTTL)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	payload := tokenPayload{
+		Message:       fmt.Sprintf("token for %s created", user.Email),
+		Token:         access,
+		Refresh:       refresh,
+		UserID:        user.ID,
+		RoleID:        user.RoleID,
+		RecoveryCodes: codes,
+	}
+	err = app.writeJSON(w, http.StatusOK, payload)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// startTwoFactorSetup makes a new authenticator secret for user, and
+// answers with it and its otpauth URI.
+func (app *application) startTwoFactorSetup(w http.ResponseWriter, r *http.Request, user *models.User) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.SetTOTPSecret(user.ID, secret)
+	if err != nil {
+		if !errors.Is(err, models.ErrTwoFactorEnabled) {
+			app.errorLog.Println(err)
+		}
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		Secret  string `json:"secret"`
+		URI     string `json:"uri"`
+	}
+	out.Message = "add this to your authenticator app, then enter the code it shows"
+	out.Secret = secret
+	out.URI = totp.URI(totpIssuer, user.Email, secret)
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// TwoFactorStatus says whether the user has two-factor login, and
+// whether they must.
+func (app *application) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	tf, err := app.DB.GetTwoFactor(user.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error     bool              `json:"error"`
+		TwoFactor *models.TwoFactor `json:"two_factor"`
+	}
+	out.TwoFactor = tf
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// SetupTwoFactor starts setting up two-factor login for the user.
+func (app *application) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+	app.startTwoFactorSetup(w, r, user)
+}
+
+// EnableTwoFactor turns on two-factor login for the user, once they give
+// a code from their authenticator. The answer has their recovery codes.
+func (app *application) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	codes, err := app.DB.EnableTwoFactor(user.ID, input.Code)
+	if err != nil {
+		app.twoFactorError(w, r, err)
+		return
+	}
+	app.writeRecoveryCodes(w, "two-factor login is on", codes)
+}
+
+// DisableTwoFactor turns off two-factor login for the user, if the policy
+// allows it. It takes a code, so a stolen session can't do it.
+func (app *application) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	required, err := app.DB.Require2FA()
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	if required {
+		_ = app.badRequest(w, r, models.ErrTwoFactorRequired)
+		return
+	}
+
+	err = app.DB.CheckSecondFactor(user.ID, input.Code)
+	if err != nil {
+		app.twoFactorError(w, r, err)
+		return
+	}
+	err = app.DB.DisableTwoFactor(user.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	out.Message = "two-factor login is off"
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// NewRecoveryCodes replaces the user's recovery codes. It takes a code
+// too.
+func (app *application) NewRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	err = app.DB.CheckSecondFactor(user.ID, input.Code)
+	if err != nil {
+		app.twoFactorError(w, r, err)
+		return
+	}
+	codes, err := app.DB.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+	app.writeRecoveryCodes(w, "new recovery codes made; the old ones no longer work", codes)
+}
+
+// ResetUserTwoFactor turns off another user's two-factor login, say if
+// they have lost their phone, and logs them out everywhere.
+func (app *application) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("URI must specify ID"))
+		return
+	}
+
+	user, err := app.DB.GetUserByID(uid)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.notFound(w, r)
+		return
+	}
+
+	err = app.DB.DisableTwoFactor(user.ID)
+	if err == nil {
+		err = app.DB.RevokeAllSessions(user.ID)
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, errors.New("could not reset two-factor login"))
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	out.Message = fmt.Sprintf("two-factor login for user %d was reset", user.ID)
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// SetTwoFactorPolicy sets whether every admin must use two-factor login.
+// Only an admin who uses it may turn it on, so nobody locks themselves
+// out.
+func (app *application) SetTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Required bool `json:"required"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.getAuthenticatedUser(r)
+	if err != nil || user == nil {
+		_ = app.invalidCredentials(w)
+		return
+	}
+
+	if input.Required {
+		tf, err := app.DB.GetTwoFactor(user.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+			_ = app.badRequest(w, r, err)
+			return
+		}
+		if !tf.Enabled {
+			_ = app.badRequest(w, r, errors.New("turn on two-factor login for yourself first"))
+			return
+		}
+	}
+
+	err = app.DB.SetRequire2FA(input.Required)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	if input.Required {
+		out.Message = "two-factor login is now required"
+	} else {
+		out.Message = "two-factor login is now optional"
+	}
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// twoFactorError answers for an error from the two-factor models.
+func (app *application) twoFactorError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, models.ErrBadCode),
+		errors.Is(err, models.ErrTwoFactorEnabled),
+		errors.Is(err, models.ErrNoTwoFactorSetup):
+		_ = app.badRequest(w, r, err)
+	default:
+		app.errorLog.Println(err)
+		_ = app.badRequest(w, r, errors.New("two-factor login could not be changed"))
+	}
+}
+
+func (app *application) writeRecoveryCodes(w http.ResponseWriter, msg string, codes []string) {
+	var out struct {
+		Error         bool     `json:"error"`
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	out.Message = msg
+	out.RecoveryCodes = codes
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
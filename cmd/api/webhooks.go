@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+// Same limit as readJSON.
+const maxWebhookBytes = int64(1048576)
+
+type webhookHandler func(event stripe.Event) error
+
+// webhookHandlers maps the event types we care about to their handlers.
+// Anything else is acknowledged and ignored.
+func (app *application) webhookHandlers() map[string]webhookHandler {
+	return map[string]webhookHandler{
+		"payment_intent.succeeded":      app.paymentIntentSucceeded,
+		"payment_intent.payment_failed": app.paymentIntentFailed,
+		"payment_intent.canceled":       app.paymentIntentFailed,
+		"charge.refunded":               app.chargeRefunded,
+		"invoice.payment_failed":        app.invoicePaymentFailed,
+		"invoice.paid":                  app.invoicePaid,
+		"customer.subscription.updated": app.subscriptionUpdated,
+		"customer.subscription.deleted": app.subscriptionDeleted,
+		"charge.dispute.created":        app.disputeCreated,
+	}
+}
+
+// StripeWebhook receives event notifications from Stripe. We only act on
+// a payload once its Stripe-Signature header checks out against our
+// signing secret.
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	if app.config.stripe.webhookSecret == "" {
+		app.errorLog.Println("webhook received, but no signing secret is configured")
+		_ = app.writeJSON(w, http.StatusServiceUnavailable, jsonResponse{OK: false, Message: "webhooks are not configured"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxWebhookBytes)
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret)
+	if err != nil {
+		app.errorLog.Println("webhook signature verification failed:", err)
+		_ = app.badRequest(w, r, errors.New("invalid signature"))
+		return
+	}
+
+	handler, ok := app.webhookHandlers()[event.Type]
+	if !ok {
+		_ = app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "ignored"})
+		return
+	}
+
+	isNew, err := app.DB.RecordStripeEvent(event.ID, event.Type)
+	if err != nil {
+		app.errorLog.Println(err)
+		_ = app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not record event"})
+		return
+	}
+	if !isNew {
+		app.infoLog.Printf("webhook: already handled %s (%s)", event.ID, event.Type)
+		_ = app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "duplicate"})
+		return
+	}
+
+	err = handler(event)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		// Stripe has the last word on what happened, so a retry won't
+		// go any better. Keep the event, and leave the order as it is.
+		app.infoLog.Printf("webhook: %s (%s) skipped: %s", event.ID, event.Type, err)
+		_ = app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "skipped"})
+		return
+	}
+	if err != nil {
+		app.errorLog.Printf("webhook: %s (%s) failed: %s", event.ID, event.Type, err)
+		// Forget the event so that Stripe's retry gets processed.
+		if err := app.DB.ForgetStripeEvent(event.ID); err != nil {
+			app.errorLog.Println(err)
+		}
+		_ = app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not process event"})
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, jsonResponse{OK: true})
+}
+
+// orderForWebhook looks up the order for a payment intent. A missing
+// order is not an error: the payment may be from the virtual terminal, or
+// from outside this app entirely.
+func (app *application) orderForWebhook(id string) (*models.Order, error) {
+	order, err := app.DB.GetOrderByPaymentIntent(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.infoLog.Printf("webhook: no order found for %s", id)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+// orderForSubscription is orderForWebhook for a gateway subscription ID.
+func (app *application) orderForSubscription(subID string) (*models.Order, error) {
+	order, err := app.DB.GetOrderBySubscriptionID(subID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.infoLog.Printf("webhook: no order found for %s", subID)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+// paymentIntentSucceeded clears the transaction for a payment, and
+// charges its order if it was waiting on the payment, taking the stock
+// that was held for it.
+func (app *application) paymentIntentSucceeded(event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &pi)
+	if err != nil {
+		return err
+	}
+
+	order, err := app.orderForWebhook(pi.ID)
+	if err != nil || order == nil {
+		return err
+	}
+
+	return app.DB.ClearPendingPayment(order.TransactionID, order.ID, cards.ChargeID(&pi), models.OrderEvent{
+		GatewayReference: pi.ID,
+		Reason:           "payment succeeded",
+	})
+}
+
+// paymentIntentFailed lets go of the stock held for a payment that
+// didn't go through. If we had already taken an order for it while it
+// was processing, the order fails and its stock goes back.
+func (app *application) paymentIntentFailed(event stripe.Event) error {
+	var pi stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &pi)
+	if err != nil {
+		return err
+	}
+
+	order, err := app.orderForWebhook(pi.ID)
+	if err != nil {
+		return err
+	}
+	// A subscription's first payment can be tried again until Stripe
+	// gives up on it, which the subscription webhooks take care of.
+	if order != nil && !order.Widget.IsRecurring {
+		reason := "payment failed"
+		if pi.LastPaymentError != nil {
+			reason = pi.LastPaymentError.Msg
+		}
+		changed, err := app.DB.MarkOrderPaymentFailed(order.ID, models.OrderEvent{
+			GatewayReference: pi.ID,
+			Reason:           reason,
+		})
+		if err != nil {
+			return err
+		}
+		if changed {
+			app.infoLog.Printf("webhook: payment for order %d failed", order.ID)
+		}
+	}
+
+	reference := pi.Metadata["order_reference"]
+	if reference == "" {
+		return nil
+	}
+	return app.DB.ReleaseInventory(reference)
+}
+
+// chargeRefunded records refunds made outside of our admin pages, such as
+// in the Stripe dashboard. Refunds we made ourselves are already recorded,
+// and are skipped.
+func (app *application) chargeRefunded(event stripe.Event) error {
+	var charge stripe.Charge
+	err := json.Unmarshal(event.Data.Raw, &charge)
+	if err != nil {
+		return err
+	}
+	if charge.PaymentIntent == nil {
+		return nil
+	}
+
+	order, err := app.orderForWebhook(charge.PaymentIntent.ID)
+	if err != nil || order == nil {
+		return err
+	}
+
+	if charge.Refunds != nil {
+		for _, refund := range charge.Refunds.Data {
+			if refund.Status == stripe.RefundStatusFailed || refund.Status == stripe.RefundStatusCanceled {
+				continue
+			}
+			// A refund we made carries the ID of its pending record.
+			refundID, _ := strconv.Atoi(refund.Metadata["refund_id"])
+			_, err = app.DB.RecordRefund(models.Refund{
+				ID:              refundID,
+				OrderID:         order.ID,
+				Amount:          int(refund.Amount),
+				Currency:        string(refund.Currency),
+				Reason:          refund.Metadata["reason"],
+				GatewayRefundID: refund.ID,
+			})
+			if errors.Is(err, models.ErrRefundExceedsBalance) {
+				// The order's refunds already add up to this one, so it
+				// was recorded some other way. Failing would only have
+				// Stripe send the event again.
+				app.infoLog.Printf("webhook: refund %s on order %d is already accounted for", refund.ID, order.ID)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !charge.Refunded {
+		return app.DB.SetTransactionStatus(order.TransactionID, models.TxnPartiallyRefunded)
+	}
+
+	err = app.DB.SetTransactionStatus(order.TransactionID, models.TxnRefunded)
+	if err != nil {
+		return err
+	}
+	_, err = app.DB.MarkOrderRefunded(order.ID, models.OrderEvent{
+		GatewayReference: charge.ID,
+		Reason:           "refunded at Stripe",
+	})
+	return err
+}
+
+// subscriptionUpdated keeps the order status in step with the
+// subscription, as trials end and cancellations are scheduled or taken
+// back, including from the Stripe dashboard.
+func (app *application) subscriptionUpdated(event stripe.Event) error {
+	var subscription stripe.Subscription
+	err := json.Unmarshal(event.Data.Raw, &subscription)
+	if err != nil {
+		return err
+	}
+
+	order, err := app.orderForSubscription(subscription.ID)
+	if err != nil || order == nil {
+		return err
+	}
+	err = app.syncSubscription(&subscription)
+	if err != nil {
+		return err
+	}
+	if order.StatusID == models.OrderCancelled {
+		return nil
+	}
+
+	statusID := cards.SubscriptionOrderStatus(&subscription)
+	if statusID == order.StatusID {
+		return nil
+	}
+	kind := models.EventStatusChanged
+	if statusID == models.OrderCancelsAtPeriodEnd {
+		kind = models.EventCancellation
+	}
+	return app.DB.SetOrderStatus(order.ID, statusID, models.OrderEvent{
+		Kind:             kind,
+		GatewayReference: subscription.ID,
+		Reason:           "subscription updated at Stripe",
+	})
+}
+
+func (app *application) subscriptionDeleted(event stripe.Event) error {
+	var subscription stripe.Subscription
+	err := json.Unmarshal(event.Data.Raw, &subscription)
+	if err != nil {
+		return err
+	}
+
+	order, err := app.orderForSubscription(subscription.ID)
+	if err != nil || order == nil {
+		return err
+	}
+	err = app.syncSubscription(&subscription)
+	if err != nil {
+		return err
+	}
+
+	return app.DB.SetOrderStatus(order.ID, models.OrderCancelled, models.OrderEvent{
+		Kind:             models.EventCancellation,
+		GatewayReference: subscription.ID,
+		Reason:           "subscription ended at Stripe",
+	})
+}
+
+func (app *application) disputeCreated(event stripe.Event) error {
+	var dispute stripe.Dispute
+	err := json.Unmarshal(event.Data.Raw, &dispute)
+	if err != nil {
+		return err
+	}
+
+	var pi string
+	if dispute.PaymentIntent != nil {
+		pi = dispute.PaymentIntent.ID
+	} else if dispute.Charge != nil && dispute.Charge.PaymentIntent != nil {
+		pi = dispute.Charge.PaymentIntent.ID
+	}
+	if pi == "" {
+		return nil
+	}
+
+	order, err := app.orderForWebhook(pi)
+	if err != nil || order == nil {
+		return err
+	}
+
+	return app.DB.SetOrderStatus(order.ID, models.OrderDisputed, models.OrderEvent{
+		GatewayReference: dispute.ID,
+		Reason:           string(dispute.Reason),
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// sendWebhook posts an event to the webhook endpoint, signed with secret.
+func sendWebhook(app *application, payload, secret string) *httptest.ResponseRecorder {
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, []byte(payload), secret))
+	r := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", strings.NewReader(payload))
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+	w := httptest.NewRecorder()
+	app.StripeWebhook(w, r)
+	return w
+}
+
+// An event is only acted on if it is signed with our secret, and only
+// once however often Stripe delivers it.
+func TestStripeWebhook(t *testing.T) {
+	db, fake := fakedb.New(t)
+	app := &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		DB:       &models.DBModel{DB: db},
+	}
+	app.config.stripe.webhookSecret = testWebhookSecret
+
+	seen := map[string]bool{}
+	fake.Handle("insert ignore into stripe_events").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if seen[args[0].(string)] {
+			return fakedb.Result{}, nil
+		}
+		seen[args[0].(string)] = true
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+	lookups := fake.Handle("from orders o")
+
+	payload := fmt.Sprintf(`{
+		"id": "evt_1",
+		"object": "event",
+		"api_version": %q,
+		"type": "payment_intent.succeeded",
+		"data": {"object": {"id": "pi_1", "object": "payment_intent"}}
+	}`, stripe.APIVersion)
+
+	w := sendWebhook(app, payload, "whsec_someone_else")
+	if w.Code != http.StatusBadRequest || len(fake.Log) != 0 {
+		t.Fatalf("forged event: %d %s, statements %q", w.Code, w.Body, fake.Log)
+	}
+
+	w = sendWebhook(app, payload, testWebhookSecret)
+	if w.Code != http.StatusOK || lookups.Calls != 1 {
+		t.Fatalf("event: %d %s, order looked up %d times", w.Code, w.Body, lookups.Calls)
+	}
+
+	w = sendWebhook(app, payload, testWebhookSecret)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("duplicate")) || lookups.Calls != 1 {
+		t.Errorf("redelivery: %d %s, order looked up %d times", w.Code, w.Body, lookups.Calls)
+	}
+}
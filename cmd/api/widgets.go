@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+// Stripe won't run a trial longer than this.
+const maxTrialDays = 730
+
+var (
+	currencyRX = regexp.MustCompile(`^[a-z]{3}$`)
+	slugRX     = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+)
+
+// widgetPayload is what the admin pages send to create or update a widget.
+// Pointers let an update leave out fields it doesn't want to change.
+type widgetPayload struct {
+	Name           *string `json:"name"`
+	Description    *string `json:"description"`
+	InventoryLevel *int    `json:"inventory_level"`
+	Price          *int    `json:"price"`
+	Image          *string `json:"image"`
+	IsRecurring    *bool   `json:"is_recurring"`
+	PlanID         *string `json:"plan_id"`
+	Currency       *string `json:"currency"`
+	IsArchived     *bool   `json:"is_archived"`
+	Slug           *string `json:"slug"`
+	TrialDays      *int    `json:"trial_days"`
+}
+
+// apply folds the payload into a widget.
+func (p widgetPayload) apply(widget *models.Widget) {
+	if p.Name != nil {
+		widget.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.Description != nil {
+		widget.Description = *p.Description
+	}
+	if p.InventoryLevel != nil {
+		widget.InventoryLevel = *p.InventoryLevel
+	}
+	if p.Price != nil {
+		widget.Price = *p.Price
+	}
+	if p.Image != nil {
+		widget.Image = *p.Image
+	}
+	if p.IsRecurring != nil {
+		widget.IsRecurring = *p.IsRecurring
+	}
+	if p.PlanID != nil {
+		widget.PlanID = strings.TrimSpace(*p.PlanID)
+	}
+	if p.Currency != nil {
+		widget.Currency = strings.ToLower(strings.TrimSpace(*p.Currency))
+	}
+	if p.IsArchived != nil {
+		widget.IsArchived = *p.IsArchived
+	}
+	if p.Slug != nil {
+		widget.Slug = strings.TrimSpace(*p.Slug)
+	}
+	if p.TrialDays != nil {
+		widget.TrialDays = *p.TrialDays
+	}
+}
+
+// validateWidget checks a widget before we save it, making a slug from
+// the name if it doesn't have one. A recurring widget
+// has to name an active recurring price on the gateway, in the same
+// currency and for the same amount, or nobody could subscribe to it.
+func (app *application) validateWidget(widget *models.Widget) error {
+	if widget.Name == "" {
+		return errors.New("name is required")
+	}
+	if widget.Price <= 0 {
+		return errors.New("price must be positive")
+	}
+	if widget.InventoryLevel < 0 {
+		return errors.New("inventory level cannot be negative")
+	}
+	if !currencyRX.MatchString(widget.Currency) {
+		return errors.New("currency must be a three letter code")
+	}
+	if strings.ContainsAny(widget.Image, `/\`) {
+		return errors.New("image must be a file name")
+	}
+
+	if widget.Slug == "" {
+		widget.Slug = models.Slugify(widget.Name)
+	}
+	if !slugRX.MatchString(widget.Slug) {
+		return errors.New("slug may only have lower case letters, digits and dashes")
+	}
+	other, err := app.DB.GetWidgetBySlug(widget.Slug)
+	if err == nil && other.ID != widget.ID {
+		return fmt.Errorf("slug %s is already used by %s", widget.Slug, other.Name)
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if !widget.IsRecurring {
+		widget.PlanID = ""
+		widget.TrialDays = 0
+		return nil
+	}
+
+	if widget.TrialDays < 0 || widget.TrialDays > maxTrialDays {
+		return fmt.Errorf("trial must be between 0 and %d days", maxTrialDays)
+	}
+
+	if widget.PlanID == "" {
+		return errors.New("recurring widgets need a plan ID")
+	}
+	price, err := app.gateway.GetPrice(widget.PlanID)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+			return fmt.Errorf("plan %s does not exist", widget.PlanID)
+		}
+		return err
+	}
+	if !price.Active || price.Recurring == nil {
+		return fmt.Errorf("plan %s is not an active recurring price", widget.PlanID)
+	}
+	if string(price.Currency) != widget.Currency || int(price.UnitAmount) != widget.Price {
+		return fmt.Errorf("plan %s charges %d %s, not %d %s",
+			widget.PlanID, price.UnitAmount, price.Currency, widget.Price, widget.Currency)
+	}
+	return nil
+}
+
+// widgetFromURL loads the widget named in the route.
+func (app *application) widgetFromURL(w http.ResponseWriter, r *http.Request) (*models.Widget, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = app.badRequest(w, r, errors.New("URI must specify ID"))
+		return nil, false
+	}
+	widget, err := app.DB.GetWidget(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.notFound(w, r)
+			return nil, false
+		}
+		_ = app.badRequest(w, r, err)
+		return nil, false
+	}
+	return &widget, true
+}
+
+// ListWidgets is the public catalog.
+func (app *application) ListWidgets(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetAllWidgets(false)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool             `json:"error"`
+		Widgets []*models.Widget `json:"widgets"`
+	}
+	out.Widgets = widgets
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+// ListAllWidgets is the catalog for admins, archived widgets included.
+func (app *application) ListAllWidgets(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetAllWidgets(true)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	var out struct {
+		Error   bool             `json:"error"`
+		Widgets []*models.Widget `json:"widgets"`
+	}
+	out.Widgets = widgets
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+func (app *application) SingleWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var out struct {
+		Error  bool           `json:"error"`
+		Widget *models.Widget `json:"widget"`
+	}
+	out.Widget = widget
+	_ = app.writeJSON(w, http.StatusOK, out)
+}
+
+func (app *application) CreateWidget(w http.ResponseWriter, r *http.Request) {
+	var payload widgetPayload
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	widget := models.Widget{Currency: "cad"}
+	payload.apply(&widget)
+	err = app.validateWidget(&widget)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	id, err := app.DB.InsertWidget(widget)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, jsonResponse{
+		OK:      true,
+		Message: fmt.Sprintf("widget created at id=%d", id),
+		ID:      id,
+	})
+}
+
+func (app *application) UpdateWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var payload widgetPayload
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	payload.apply(widget)
+	err = app.validateWidget(widget)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.UpdateWidget(*widget)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "widget updated", ID: widget.ID})
+}
+
+func (app *application) ArchiveWidget(w http.ResponseWriter, r *http.Request) {
+	widget, ok := app.widgetFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.DB.ArchiveWidget(widget.ID)
+	if err != nil {
+		_ = app.badRequest(w, r, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "widget archived", ID: widget.ID})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// A recurring widget must match a recurring price on the gateway, or
+// nobody could subscribe to it.
+func TestValidateWidget(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	fake.Handle("where slug = ?").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		if args[0] != "taken" {
+			return fakedb.RowsFrom(q)
+		}
+		widget := widgetRecord(9)
+		widget["slug"] = "taken"
+		return fakedb.RowsFrom(q, widget)
+	}
+	gateway.AddPrice("price_monthly", 1000, "cad", true)
+	gateway.AddPrice("price_once", 1000, "cad", false)
+
+	tests := []struct {
+		name   string
+		widget models.Widget
+		err    string
+	}{
+		{"plain", models.Widget{Name: "Widget", Price: 1000, Currency: "cad", PlanID: "stale"}, ""},
+		{"no name", models.Widget{Price: 1000, Currency: "cad"}, "name is required"},
+		{"free", models.Widget{Name: "Widget", Currency: "cad"}, "price must be positive"},
+		{"bad currency", models.Widget{Name: "Widget", Price: 1000, Currency: "dollars"}, "three letter code"},
+		{"slug taken", models.Widget{Name: "Widget", Price: 1000, Currency: "cad", Slug: "taken"}, "already used by Widget"},
+		{"own slug", models.Widget{ID: 9, Name: "Widget", Price: 1000, Currency: "cad", Slug: "taken"}, ""},
+		{"bad slug", models.Widget{Name: "Widget", Price: 1000, Currency: "cad", Slug: "Big Widget"}, "lower case"},
+		{"image path", models.Widget{Name: "Widget", Price: 1000, Currency: "cad", Image: "../x.png"}, "file name"},
+		{"plan", models.Widget{Name: "Plan", Price: 1000, Currency: "cad", IsRecurring: true, PlanID: "price_monthly"}, ""},
+		{"no plan", models.Widget{Name: "Plan", Price: 1000, Currency: "cad", IsRecurring: true}, "need a plan ID"},
+		{"missing plan", models.Widget{Name: "Plan", Price: 1000, Currency: "cad", IsRecurring: true, PlanID: "price_gone"}, "does not exist"},
+		{"one-off price", models.Widget{Name: "Plan", Price: 1000, Currency: "cad", IsRecurring: true, PlanID: "price_once"}, "not an active recurring price"},
+		{"wrong amount", models.Widget{Name: "Plan", Price: 1500, Currency: "cad", IsRecurring: true, PlanID: "price_monthly"}, "charges 1000 cad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := app.validateWidget(&tt.widget)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !tt.widget.IsRecurring && tt.widget.PlanID != "" {
+					t.Errorf("kept plan %q on a one-off widget", tt.widget.PlanID)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Creating a widget saves what was validated, not what was sent, with a
+// slug made from its name.
+func TestCreateWidget(t *testing.T) {
+	app, fake, _ := testApp(t)
+	fake.Handle("where slug = ?")
+	var saved []driver.Value
+	fake.Handle("insert into widgets").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		saved = args
+		return fakedb.Result{ID: 5, Affected: 1}, nil
+	}
+
+	w := post(t, app.CreateWidget, map[string]interface{}{
+		"name":     "  Gadget ",
+		"price":    1500,
+		"currency": "CAD",
+	}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if saved[0] != "Gadget" || saved[7] != "cad" || saved[9] != "gadget" {
+		t.Errorf("saved %v", saved)
+	}
+
+	w = post(t, app.CreateWidget, map[string]interface{}{"name": "Gadget", "price": -1}, nil)
+	if w.Code != http.StatusBadRequest || fake.Ran("insert into widgets") != 1 {
+		t.Errorf("negative price: got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,81 @@
+// Command merge-customers folds duplicate customer rows, made before
+// customers were looked up by email, into one customer per address. Each
+// address keeps its oldest row, and orders, subscriptions and saved cards
+// are moved across to it.
+//
+// Only the database changes. Stripe can't merge customers, so the ones
+// we stop using are left there; the customer we keep points at the most
+// recent of them.
+//
+// Run it with -dry-run first to see what it would do.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"github.com/torenware/go-stripe/internal/driver"
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+func main() {
+	var dryRun bool
+	var email string
+	flag.BoolVar(&dryRun, "dry-run", false, "report what would be merged, without changing anything")
+	flag.StringVar(&email, "email", "", "only merge this email address")
+	flag.Parse()
+
+	_ = godotenv.Load(".env.local")
+
+	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
+	dsn, err := driver.ConstructDSN()
+	if err != nil {
+		errorLog.Fatalln(err)
+	}
+	conn, err := driver.OpenDB(dsn)
+	if err != nil {
+		errorLog.Fatalln(err)
+	}
+	defer conn.Close()
+
+	db := &models.DBModel{DB: conn}
+
+	emails := []string{email}
+	if email == "" {
+		emails, err = db.DuplicateCustomerEmails()
+		if err != nil {
+			errorLog.Fatalln(err)
+		}
+	}
+
+	verb := "merged"
+	if dryRun {
+		verb = "would merge"
+	}
+
+	failed := false
+	for _, e := range emails {
+		merge, err := db.MergeCustomers(e, dryRun)
+		if err != nil {
+			errorLog.Printf("%s: %v", e, err)
+			failed = true
+			continue
+		}
+		if len(merge.Merged) == 0 {
+			infoLog.Printf("%s: no duplicates", merge.Email)
+			continue
+		}
+		infoLog.Printf("%s: %s customers %v into %d (%d orders, %d subscriptions, gateway customer %q)",
+			merge.Email, verb, merge.Merged, merge.KeptID, merge.Orders, merge.Subs, merge.Gateway)
+	}
+	infoLog.Printf("%d addresses checked", len(emails))
+
+	if failed {
+		os.Exit(1)
+	}
+}
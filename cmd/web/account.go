@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/urlsigner"
+)
+
+// How long the login link we email a customer works.
+const accountLinkMinutes = 15
+
+// How long a checkout page may use the customer's saved cards.
+const savedCardsTTL = time.Hour
+
+// customerEmail is the email address of the customer logged in to their
+// account, if any.
+func (app *application) customerEmail(r *http.Request) string {
+	return session.GetString(r.Context(), "customerEmail")
+}
+
+// checkoutCustomer is the customer logged in to their account, if any.
+func (app *application) checkoutCustomer(r *http.Request) *models.Customer {
+	email := app.customerEmail(r)
+	if email == "" {
+		return nil
+	}
+	customer, err := app.DB.GetCustomerByEmail(email)
+	if err != nil {
+		app.errorLog.Println(err)
+		return nil
+	}
+	return customer
+}
+
+// ownsEmail says whether the customer logged in to their account is the
+// one with email.
+func (app *application) ownsEmail(r *http.Request, email string) bool {
+	loggedIn := app.customerEmail(r)
+	return loggedIn != "" && models.NormalizeEmail(email) == loggedIn
+}
+
+// savedCardsClaim must match the one in cmd/api.
+func savedCardsClaim(customerID int, expires int64) string {
+	return fmt.Sprintf("saved-cards:%d:%d", customerID, expires)
+}
+
+// addSavedCards puts a logged in customer's saved cards on a checkout
+// page, along with the claim the API wants before it will charge them.
+func (app *application) addSavedCards(r *http.Request, data map[string]interface{}) {
+	customer := app.checkoutCustomer(r)
+	if customer == nil {
+		return
+	}
+	methods, err := app.DB.GetPaymentMethods(customer.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	expires := time.Now().Add(savedCardsTTL).Unix()
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+	hash := signer.MAC(savedCardsClaim(customer.ID, expires))
+
+	data["saved_cards"] = methods
+	data["card_claim"] = map[string]interface{}{
+		"customer_id": customer.ID,
+		"expires":     expires,
+		"hash":        hash,
+	}
+}
+
+func (app *application) AccountLogin(w http.ResponseWriter, r *http.Request) {
+	if app.customerEmail(r) != "" {
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+	if err := app.renderTemplate(w, r, "account-login", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// VerifyAccountLogin is where the emailed login link goes.
+func (app *application) VerifyAccountLogin(w http.ResponseWriter, r *http.Request) {
+	testURL := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+	if !signer.VerifyToken(testURL) {
+		app.errorLog.Println("Invalid url - tampering detected")
+		app.setFlashAndGoHome(w, r, "Sorry! There was a problem processing your link.", http.StatusSeeOther)
+		return
+	}
+	if signer.Expired(testURL, accountLinkMinutes) {
+		app.setFlashAndGoHome(w, r, "Sorry! Your login link has expired.", http.StatusSeeOther)
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email")))
+	if email == "" {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	_ = session.RenewToken(r.Context())
+	session.Put(r.Context(), "customerEmail", email)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func (app *application) AccountLogout(w http.ResponseWriter, r *http.Request) {
+	session.Remove(r.Context(), "customerEmail")
+	_ = session.RenewToken(r.Context())
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// AccountHome lists what the customer has bought.
+func (app *application) AccountHome(w http.ResponseWriter, r *http.Request) {
+	orders, err := app.DB.GetCustomerOrders(app.customerEmail(r))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusInternalServerError)
+		return
+	}
+
+	var purchases, subscriptions []*models.Order
+	for _, order := range orders {
+		if order.Widget.IsRecurring {
+			subscriptions = append(subscriptions, order)
+		} else {
+			purchases = append(purchases, order)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["orders"] = purchases
+	data["subscriptions"] = subscriptions
+	if err := app.renderTemplate(w, r, "account", &templateData{
+		Data: data,
+	}, "order-status"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// customerOrder loads the order in the route, as long as it belongs to
+// the customer who is logged in. Anyone else's order is not found.
+func (app *application) customerOrder(w http.ResponseWriter, r *http.Request) (*models.Order, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound)
+		return nil, false
+	}
+	order, err := app.DB.GetOrder(id, true, 0)
+	if err != nil || !strings.EqualFold(order.Customer.Email, app.customerEmail(r)) {
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.clientError(w, http.StatusNotFound)
+		return nil, false
+	}
+	return order, true
+}
+
+// AccountOrder is the receipt for one of the customer's orders, or the
+// details of a subscription.
+func (app *application) AccountOrder(w http.ResponseWriter, r *http.Request) {
+	order, ok := app.customerOrder(w, r)
+	if !ok {
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["order"] = order
+	if err := app.renderTemplate(w, r, "account-order", &templateData{
+		Data: data,
+	}, "order-status"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// customerSubscription is customerOrder for a subscription the customer
+// can still change, and returns its gateway ID as well.
+func (app *application) customerSubscription(w http.ResponseWriter, r *http.Request) (*models.Order, string, bool) {
+	order, ok := app.customerOrder(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	if order.Subscription == nil || order.StatusID == models.OrderCancelled {
+		app.clientError(w, http.StatusBadRequest)
+		return nil, "", false
+	}
+	return order, order.Subscription.GatewaySubscriptionID, true
+}
+
+// setCancelAtPeriodEnd is behind the cancel and resume buttons. Customers
+// always keep what they've paid for, so a cancellation waits for the end
+// of the period.
+func (app *application) setCancelAtPeriodEnd(w http.ResponseWriter, r *http.Request, cancel bool) {
+	order, subID, ok := app.customerSubscription(w, r)
+	if !ok {
+		return
+	}
+	if !cancel && order.StatusID != models.OrderCancelsAtPeriodEnd {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	msg := "Your subscription will end with the current billing period."
+	event := models.OrderEvent{
+		Kind:             models.EventCancellation,
+		GatewayReference: subID,
+		Reason:           "cancelled by the customer",
+	}
+	if !cancel {
+		msg = "Your subscription will carry on."
+		event.Kind = models.EventStatusChanged
+		event.Reason = "resumed by the customer"
+	}
+	subscription, err := app.gateway.SetCancelAtPeriodEnd(subID, cancel)
+	if err == nil {
+		// The subscription record catches up when Stripe's webhook arrives.
+		err = app.DB.SetOrderStatus(order.ID, cards.SubscriptionOrderStatus(subscription), event)
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		msg = "Sorry! We could not change your subscription."
+	}
+
+	SetFlash(w, "flash", []byte(msg))
+	http.Redirect(w, r, fmt.Sprintf("/account/order/%d", order.ID), http.StatusSeeOther)
+}
+
+func (app *application) AccountCancelSubscription(w http.ResponseWriter, r *http.Request) {
+	app.setCancelAtPeriodEnd(w, r, true)
+}
+
+func (app *application) AccountResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	app.setCancelAtPeriodEnd(w, r, false)
+}
+
+// AccountUpdateCard sends the customer to the same page as the link in a
+// dunning email, signing the link for them.
+func (app *application) AccountUpdateCard(w http.ResponseWriter, r *http.Request) {
+	order, _, ok := app.customerSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	link := fmt.Sprintf("%s/update-card?order=%d", app.config.frontend, order.ID)
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+	http.Redirect(w, r, signer.GenerateTokenFromString(link), http.StatusSeeOther)
+}
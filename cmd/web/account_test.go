@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+	"github.com/torenware/go-stripe/internal/urlsigner"
+)
+
+// accountRoutes are the customer account routes, as the app mounts them.
+func accountRoutes(app *application) http.Handler {
+	mux := chi.NewRouter()
+	mux.Get("/account/verify", app.VerifyAccountLogin)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.CustomerAuth)
+		mux.Get("/account/order/{id:[0-9]+}", app.AccountOrder)
+	})
+	return mux
+}
+
+// loginLink signs an account login link for email, as the API emails it.
+func loginLink(app *application, email string) string {
+	signer := urlsigner.Signer{Secret: []byte(app.config.secretkey)}
+	signed := signer.GenerateTokenFromString(app.config.frontend + "/account/verify?email=" + email)
+	return signed[len(app.config.frontend):]
+}
+
+// A signed link logs the customer in; a tampered one doesn't.
+func TestVerifyAccountLogin(t *testing.T) {
+	app, _, _ := testApp(t)
+	app.config.frontend = "http://localhost:4000"
+	app.config.secretkey = "0123456789abcdef0123456789abcdef"
+	routes := accountRoutes(app)
+
+	b := &browser{app: app}
+	w := b.get(routes, loginLink(app, "Bob@example.com")+"x")
+	if loc := w.Header().Get("Location"); loc != "/" {
+		t.Fatalf("tampered link sent to %q (%d)", loc, w.Code)
+	}
+	w = b.get(routes, "/account/order/7")
+	if loc := w.Header().Get("Location"); loc != "/account/login" {
+		t.Errorf("logged out customer sent to %q (%d)", loc, w.Code)
+	}
+
+	w = b.get(routes, loginLink(app, "Bob@example.com"))
+	if loc := w.Header().Get("Location"); loc != "/account" {
+		t.Fatalf("signed link sent to %q (%d)", loc, w.Code)
+	}
+}
+
+// A customer can't see someone else's order.
+func TestAccountOrderNotTheirs(t *testing.T) {
+	app, fake, _ := testApp(t)
+	app.config.frontend = "http://localhost:4000"
+	app.config.secretkey = "0123456789abcdef0123456789abcdef"
+	fake.Handle("from orders o").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"amount":           int64(1000),
+			"quantity":         int64(1),
+			"price":            int64(1000),
+			"currency":         "cad",
+			"order_id":         int64(7),
+			"widget_id":        int64(1),
+			"transaction_id":   int64(3),
+			"customer_id":      int64(4),
+			"created_at":       time.Now(),
+			"status_id":        int64(1),
+			"reference":        "ORD-TEST",
+			"item":             "Widget",
+			"description":      "A very nice widget.",
+			"is_recurring":     false,
+			"last_four":        "4242",
+			"expiry_month":     int64(12),
+			"expiry_year":      int64(2030),
+			"payment_intent":   "pi_first",
+			"bank_return_code": "",
+			"first_name":       "Jane",
+			"last_name":        "Doe",
+			"email":            "jane@example.com",
+		})
+	}
+	for _, table := range []string{"order_items", "refunds", "plan_changes", "dunning_attempts", "subscriptions"} {
+		fake.Handle("from " + table)
+	}
+	routes := accountRoutes(app)
+
+	b := &browser{app: app}
+	b.get(routes, loginLink(app, "bob@example.com"))
+	w := b.get(routes, "/account/order/7")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for Jane's order", w.Code)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+// The most of any one widget we'll put in a cart.
+const maxCartQuantity = 99
+
+// How long stock is held for a payment that hasn't gone through.
+const reservationTTL = 30 * time.Minute
+
+// CartItem is a widget in the cart. We only keep IDs in the session;
+// prices are always looked up fresh.
+type CartItem struct {
+	WidgetID int
+	Quantity int
+}
+
+// Cart is the shopping cart, which lives in the session.
+type Cart struct {
+	Items []CartItem
+}
+
+// Set changes the quantity of a widget in the cart. A quantity of zero or
+// less takes it out.
+func (c *Cart) Set(widgetID, quantity int) {
+	if quantity > maxCartQuantity {
+		quantity = maxCartQuantity
+	}
+	for i, item := range c.Items {
+		if item.WidgetID == widgetID {
+			if quantity <= 0 {
+				c.Items = append(c.Items[:i], c.Items[i+1:]...)
+			} else {
+				c.Items[i].Quantity = quantity
+			}
+			return
+		}
+	}
+	if quantity > 0 {
+		c.Items = append(c.Items, CartItem{WidgetID: widgetID, Quantity: quantity})
+	}
+}
+
+// Add puts more of a widget into the cart.
+func (c *Cart) Add(widgetID, quantity int) {
+	for _, item := range c.Items {
+		if item.WidgetID == widgetID {
+			c.Set(widgetID, item.Quantity+quantity)
+			return
+		}
+	}
+	c.Set(widgetID, quantity)
+}
+
+// Count is the number of widgets in the cart.
+func (c Cart) Count() int {
+	count := 0
+	for _, item := range c.Items {
+		count += item.Quantity
+	}
+	return count
+}
+
+func (app *application) getCart(r *http.Request) Cart {
+	cart, _ := app.Session.Get(r.Context(), "cart").(Cart)
+	return cart
+}
+
+func (app *application) putCart(r *http.Request, cart Cart) {
+	if len(cart.Items) == 0 {
+		app.Session.Remove(r.Context(), "cart")
+		return
+	}
+	app.Session.Put(r.Context(), "cart", cart)
+}
+
+// CartLine is a cart item priced for display or payment.
+type CartLine struct {
+	Widget   models.Widget
+	Quantity int
+	Amount   int
+}
+
+// PricedCart is the cart with current prices filled in.
+type PricedCart struct {
+	Lines    []CartLine
+	Total    int
+	Currency string
+}
+
+// priceCart looks up the current price of everything in the cart. A
+// payment has a single currency, so the widgets in a cart must share one.
+func (app *application) priceCart(cart Cart) (*PricedCart, error) {
+	var priced PricedCart
+	for _, item := range cart.Items {
+		widget, err := app.DB.GetWidget(item.WidgetID)
+		if err != nil {
+			return nil, err
+		}
+		if widget.IsArchived {
+			return nil, fmt.Errorf("%s is no longer sold", widget.Name)
+		}
+		if priced.Currency == "" {
+			priced.Currency = widget.Currency
+		} else if widget.Currency != priced.Currency {
+			return nil, fmt.Errorf("cart mixes %s and %s", priced.Currency, widget.Currency)
+		}
+		line := CartLine{
+			Widget:   widget,
+			Quantity: item.Quantity,
+			Amount:   widget.Price * item.Quantity,
+		}
+		priced.Lines = append(priced.Lines, line)
+		priced.Total += line.Amount
+	}
+	return &priced, nil
+}
+
+// The most a payment intent's metadata value can hold.
+const maxMetadataLength = 500
+
+// cartItemsMetadata locks the lines of a priced cart into a payment
+// intent, as widget:quantity:unit price for each line. The order is
+// recorded from these, since the cart in the session can change while the
+// customer pays.
+func cartItemsMetadata(priced *PricedCart) (string, error) {
+	var lines []string
+	for _, line := range priced.Lines {
+		lines = append(lines, fmt.Sprintf("%d:%d:%d", line.Widget.ID, line.Quantity, line.Widget.Price))
+	}
+	s := strings.Join(lines, ",")
+	if len(s) > maxMetadataLength {
+		return "", errors.New("cart has too many different widgets")
+	}
+	return s, nil
+}
+
+// parseCartItems reads back the lines locked in by cartItemsMetadata.
+func parseCartItems(s string) ([]models.OrderItem, error) {
+	if s == "" {
+		return nil, errors.New("no cart items")
+	}
+	var items []models.OrderItem
+	for _, line := range strings.Split(s, ",") {
+		var item models.OrderItem
+		_, err := fmt.Sscanf(line, "%d:%d:%d", &item.WidgetID, &item.Quantity, &item.UnitPrice)
+		if err != nil {
+			return nil, fmt.Errorf("bad cart item %q: %w", line, err)
+		}
+		item.Amount = item.Quantity * item.UnitPrice
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// cartForm reads the widget and quantity fields posted by the cart forms.
+func cartForm(r *http.Request) (int, int, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+	widgetID, err := strconv.Atoi(r.Form.Get("widget_id"))
+	if err != nil {
+		return 0, 0, errors.New("widget_id is not an int")
+	}
+	quantity := 0
+	if q := r.Form.Get("quantity"); q != "" {
+		quantity, err = strconv.Atoi(q)
+		if err != nil {
+			return 0, 0, errors.New("quantity is not an int")
+		}
+	}
+	return widgetID, quantity, nil
+}
+
+// pruneCart drops widgets that have been archived since they were added.
+func (app *application) pruneCart(r *http.Request) Cart {
+	var cart Cart
+	for _, item := range app.getCart(r).Items {
+		widget, err := app.DB.GetWidget(item.WidgetID)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && widget.IsArchived) {
+			continue
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	app.putCart(r, cart)
+	return cart
+}
+
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	priced, err := app.priceCart(app.pruneCart(r))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusInternalServerError)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["cart"] = priced.Lines
+	app.addSavedCards(r, data)
+	intMap := make(map[string]int)
+	intMap["total"] = priced.Total
+	if err := app.renderTemplate(w, r, "cart", &templateData{
+		Data:   data,
+		IntMap: intMap,
+	}, "stripejs", "stripe-form"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := cartForm(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if quantity == 0 {
+		quantity = 1
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+	if widget.IsRecurring || widget.IsArchived {
+		// Subscriptions have their own checkout.
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	cart := app.getCart(r)
+	cart.Add(widgetID, quantity)
+	if _, err := app.priceCart(cart); err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	app.putCart(r, cart)
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := cartForm(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Taking a widget out is always fine; anything else must be for sale.
+	if quantity > 0 {
+		widget, err := app.DB.GetWidget(widgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		if widget.IsRecurring || widget.IsArchived {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	cart := app.getCart(r)
+	cart.Set(widgetID, quantity)
+	if _, err := app.priceCart(cart); err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	app.putCart(r, cart)
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func (app *application) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, _, err := cartForm(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	cart := app.getCart(r)
+	cart.Set(widgetID, 0)
+	app.putCart(r, cart)
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// CartPaymentIntent creates a payment intent for whatever is in the cart.
+// The amount comes from our prices, never from the browser.
+func (app *application) CartPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		OK           bool   `json:"ok"`
+		Message      string `json:"message,omitempty"`
+		ClientSecret string `json:"client_secret,omitempty"`
+		Amount       int    `json:"amount"`
+	}
+
+	var payload cartCheckout
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	priced, err := app.priceCart(app.getCart(r))
+	if err != nil {
+		app.errorLog.Println(err)
+		status = http.StatusInternalServerError
+		resp.Message = "We could not price your cart"
+	} else if priced.Total == 0 {
+		status = http.StatusBadRequest
+		resp.Message = "Your cart is empty"
+	} else {
+		pi, msg, err := app.createCartPaymentIntent(r, priced, payload)
+		if err != nil {
+			app.errorLog.Println(err)
+			status = http.StatusBadRequest
+			resp.Message = msg
+		} else {
+			resp.OK = true
+			resp.ClientSecret = pi.ClientSecret
+			resp.Amount = priced.Total
+		}
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// cartCheckout is what the checkout form tells us before the cart is paid
+// for. A customer logged in to their account, buying as their own email
+// address, is charged as their existing gateway customer, and can pay with
+// a saved card or save the one they use.
+type cartCheckout struct {
+	Email     string `json:"email"`
+	SavedCard int    `json:"saved_card"`
+	SaveCard  bool   `json:"save_card"`
+}
+
+// checkoutCard returns the gateway customer a cart is billed to, and the
+// saved card it is paid with, if any.
+func (app *application) checkoutCard(r *http.Request, checkout cartCheckout) (string, string, error) {
+	if checkout.SavedCard == 0 && !checkout.SaveCard {
+		// An anonymous checkout is charged without a gateway customer.
+		if !app.ownsEmail(r, checkout.Email) {
+			return "", "", nil
+		}
+		customer := app.checkoutCustomer(r)
+		if customer == nil {
+			return "", "", nil
+		}
+		return customer.GatewayCustomerID, "", nil
+	}
+
+	customer := app.checkoutCustomer(r)
+	if customer == nil {
+		return "", "", errors.New("please log in to your account to use saved cards")
+	}
+
+	if checkout.SavedCard != 0 {
+		saved, err := app.DB.GetPaymentMethod(checkout.SavedCard)
+		if err != nil || saved.CustomerID != customer.ID || customer.GatewayCustomerID == "" {
+			return "", "", errors.New("no such card")
+		}
+		return customer.GatewayCustomerID, saved.GatewayPaymentMethodID, nil
+	}
+
+	// A card can only be saved to a gateway customer.
+	if customer.GatewayCustomerID == "" {
+		gc, _, err := app.gateway.CreateCustomer("", customer.Email, "")
+		if err != nil {
+			return "", "", err
+		}
+		err = app.DB.SetGatewayCustomerID(customer.ID, gc.ID)
+		if err != nil {
+			return "", "", err
+		}
+		customer.GatewayCustomerID = gc.ID
+	}
+	return customer.GatewayCustomerID, "", nil
+}
+
+func (app *application) createCartPaymentIntent(r *http.Request, priced *PricedCart, checkout cartCheckout) (*stripe.PaymentIntent, string, error) {
+	gatewayCustomer, savedCard, err := app.checkoutCard(r, checkout)
+	if err != nil {
+		return nil, err.Error(), err
+	}
+
+	lockedItems, err := cartItemsMetadata(priced)
+	if err != nil {
+		return nil, "Sorry, your cart has too many different widgets", err
+	}
+
+	// Each try at paying for the cart shares one order reference, so that
+	// a new intent replaces the stock held for the last one rather than
+	// holding it twice.
+	reference := app.Session.GetString(r.Context(), "cartReference")
+	if reference == "" {
+		reference, err = models.NewOrderReference()
+		if err != nil {
+			return nil, "We could not process your request", err
+		}
+		app.Session.Put(r.Context(), "cartReference", reference)
+	}
+
+	// Hold the stock while the customer pays.
+	var items []models.OrderItem
+	for _, line := range priced.Lines {
+		items = append(items, models.OrderItem{WidgetID: line.Widget.ID, Quantity: line.Quantity})
+	}
+	err = app.DB.ReserveInventory(reference, reservationTTL, items)
+	if err != nil {
+		var outOfStock *models.OutOfStockError
+		if errors.As(err, &outOfStock) {
+			return nil, "Sorry, " + outOfStock.Error(), err
+		}
+		return nil, "We could not process your request", err
+	}
+
+	req := cards.PaymentIntentRequest{
+		Currency: priced.Currency,
+		Amount:   priced.Total,
+		Metadata: map[string]string{
+			"order_reference": reference,
+			"items":           lockedItems,
+			"amount":          strconv.Itoa(priced.Total),
+		},
+		Customer:       gatewayCustomer,
+		PaymentMethod:  savedCard,
+		SaveCard:       checkout.SaveCard && savedCard == "",
+		IdempotencyKey: idempotencyKey(r, "cart-payment-intent", ""),
+	}
+
+	pi, msg, err := app.gateway.CreatePaymentIntent(req)
+	var stripeErr *stripe.Error
+	if req.Customer != "" && errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+		// The gateway has lost the customer, so charge without them.
+		app.errorLog.Printf("gateway customer %s is gone: %v", req.Customer, err)
+		req.Customer = ""
+		if req.IdempotencyKey != "" {
+			req.IdempotencyKey += ":anonymous"
+		}
+		pi, msg, err = app.gateway.CreatePaymentIntent(req)
+	}
+	if err != nil {
+		if err := app.DB.ReleaseInventory(reference); err != nil {
+			app.errorLog.Println(err)
+		}
+		return nil, msg, err
+	}
+	return pi, "", nil
+}
+
+func (app *application) CartCheckout(w http.ResponseWriter, r *http.Request) {
+	app.paymentSucceeded(w, r, "cart-checkout", app.saveCartPayment)
+}
+
+// saveCartPayment records the order for a paid cart, then empties it. The
+// order is the cart as it was priced for the payment intent, whatever the
+// cart holds now. The money has been taken by the time we get here, so a
+// payment that doesn't match what was priced, or that can't be recorded,
+// is refunded.
+func (app *application) saveCartPayment(r *http.Request) (*TransactionData, int, error) {
+	txnPtr, err := app.GetTxnData(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(txnPtr.Items) == 0 {
+		return nil, 0, app.refundPayment(txnPtr, fmt.Errorf("payment intent %s has no cart", txnPtr.PaymentIntentID))
+	}
+	total, count := 0, 0
+	for _, item := range txnPtr.Items {
+		total += item.Amount
+		count += item.Quantity
+	}
+	if txnPtr.PaymentAmount != txnPtr.PricedAmount || total != txnPtr.PricedAmount {
+		return nil, 0, app.refundPayment(txnPtr, fmt.Errorf("payment intent %s paid %d, but the cart was priced at %d",
+			txnPtr.PaymentIntentID, txnPtr.PaymentAmount, total))
+	}
+
+	purchase := app.purchaseFromTxn(r, txnPtr)
+	purchase.Order = &models.Order{
+		// The order's own widget is just the first line; see Items.
+		WidgetID:  txnPtr.Items[0].WidgetID,
+		StatusID:  txnPtr.orderStatusID(),
+		Quantity:  count,
+		Amount:    txnPtr.PaymentAmount,
+		Reference: txnPtr.Reference,
+	}
+	purchase.Items = txnPtr.Items
+
+	_, txnID, orderID, err := app.DB.RecordPurchase(purchase)
+	if err != nil {
+		return nil, 0, app.refundPayment(txnPtr, err)
+	}
+	txnPtr.ID = txnID
+
+	app.putCart(r, Cart{})
+	app.Session.Remove(r.Context(), "cartReference")
+	return txnPtr, orderID, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+func TestCartSet(t *testing.T) {
+	var cart Cart
+	cart.Add(1, 2)
+	cart.Add(2, 1)
+	cart.Add(1, 1)
+	if cart.Count() != 4 || len(cart.Items) != 2 || cart.Items[0].Quantity != 3 {
+		t.Fatalf("after adding: %+v", cart)
+	}
+
+	cart.Set(2, 500)
+	if cart.Items[1].Quantity != maxCartQuantity {
+		t.Errorf("quantity not capped: %+v", cart)
+	}
+	cart.Set(1, 0)
+	if len(cart.Items) != 1 || cart.Items[0].WidgetID != 2 {
+		t.Errorf("after taking widget 1 out: %+v", cart)
+	}
+}
+
+// widgetRecord is a widget row priced at 1000.
+func widgetRecord(id int64) map[string]driver.Value {
+	return map[string]driver.Value{
+		"id":                  id,
+		"name":                "Widget",
+		"description":         "A very nice widget.",
+		"inventory_level":     int64(10),
+		"price":               int64(1000),
+		"coalesce(image, '')": "",
+		"is_recurring":        false,
+		"plan_id":             "",
+		"is_archived":         false,
+		"slug":                "widget",
+		"trial_days":          int64(0),
+		"currency":            "cad",
+		"created_at":          time.Now(),
+		"updated_at":          time.Now(),
+	}
+}
+
+// The order for a cart is recorded from the lines locked into its payment
+// intent, so they must come back as they went in.
+func TestCartItemsMetadata(t *testing.T) {
+	priced := &PricedCart{
+		Lines: []CartLine{
+			{Widget: models.Widget{ID: 1, Price: 1000}, Quantity: 2, Amount: 2000},
+			{Widget: models.Widget{ID: 12, Price: 250}, Quantity: 1, Amount: 250},
+		},
+		Total: 2250,
+	}
+
+	s, err := cartItemsMetadata(priced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := parseCartItems(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(priced.Lines) {
+		t.Fatalf("got %d items from %q", len(items), s)
+	}
+	for i, line := range priced.Lines {
+		item := items[i]
+		if item.WidgetID != line.Widget.ID || item.Quantity != line.Quantity ||
+			item.UnitPrice != line.Widget.Price || item.Amount != line.Amount {
+			t.Errorf("line %d came back as %+v", i, item)
+		}
+	}
+
+	for _, bad := range []string{"", "3", "1:2:x", "1:2:3,"} {
+		if _, err := parseCartItems(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+// paidCart makes a payment intent for a cart's locked lines, paid with a
+// new card, and returns the checkout form for it.
+func paidCart(t *testing.T, gateway *cards.FakeGateway, items string, priced, paid int) url.Values {
+	t.Helper()
+	card := gateway.AddCard("visa", "4242", 12, 2030)
+	pi, _, err := gateway.CreatePaymentIntent(cards.PaymentIntentRequest{
+		Currency: "cad",
+		Amount:   paid,
+		Metadata: map[string]string{"items": items, "amount": strconv.Itoa(priced)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateway.ConfirmPaymentIntent(pi.ID, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	return url.Values{
+		"payment_intent":  {pi.ID},
+		"payment_method":  {card.ID},
+		"email":           {"jane@example.com"},
+		"first_name":      {"Jane"},
+		"last_name":       {"Doe"},
+		"cardholder_name": {"Jane Doe"},
+	}
+}
+
+// A cart that changes while the customer pays is recorded as it was when
+// the payment intent was made.
+func TestCartCheckoutLocked(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	fakeTerminalTables(fake)
+	fake.Handle("insert into orders").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		return fakedb.Result{ID: 7, Affected: 1}, nil
+	}
+	fake.Handle("insert into order_events")
+	var items []int64
+	fake.Handle("insert into order_items").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		items = append(items, args[2].(int64))
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+	fake.Handle("from widgets").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, widgetRecord(args[0].(int64)))
+	}
+	fake.Handle("from inventory_reservations").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"coalesce(sum(quantity), 0)": int64(0)})
+	}
+	taken := fake.Handle("update widgets set inventory_level")
+	fake.Handle("delete from inventory_reservations")
+
+	b := &browser{app: app}
+	b.post(app.AddToCart, url.Values{"widget_id": {"1"}})
+	form := paidCart(t, gateway, "1:1:1000", 1000, 1000)
+	b.post(app.UpdateCart, url.Values{"widget_id": {"1"}, "quantity": {"2"}})
+
+	w := b.post(app.CartCheckout, form)
+	if loc := w.Header().Get("Location"); loc != "/receipt" {
+		t.Fatalf("sent to %q (%d)", loc, w.Code)
+	}
+	if len(items) != 1 || items[0] != 1 {
+		t.Errorf("order items have quantities %v", items)
+	}
+	if taken.Calls != 1 {
+		t.Errorf("stock taken %d times", taken.Calls)
+	}
+	if len(gateway.Refunds()) != 0 {
+		t.Errorf("refunded: %+v", gateway.Refunds())
+	}
+}
+
+// A payment that doesn't match the cart it was priced for is refunded
+// rather than recorded.
+func TestCartCheckoutMismatch(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	fakeTerminalTables(fake)
+
+	b := &browser{app: app}
+	w := b.post(app.CartCheckout, paidCart(t, gateway, "1:2:1000", 2000, 1000))
+	if loc := w.Header().Get("Location"); loc != "/" {
+		t.Fatalf("sent to %q (%d)", loc, w.Code)
+	}
+	refunds := gateway.Refunds()
+	if len(refunds) != 1 || refunds[0].Amount != 1000 {
+		t.Errorf("refunds: %+v", refunds)
+	}
+	if fake.Ran("insert into orders") != 0 {
+		t.Error("an order was recorded for the payment")
+	}
+}
+
+// Only a customer logged in as the buyer's email address is charged as
+// their gateway customer; anyone can type the address in.
+func TestCartPaymentIntentCustomer(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	card := gateway.AddCard("visa", "4242", 12, 2030)
+	cust, _, err := gateway.CreateCustomer(card.ID, "jane@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Handle("from widgets").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, widgetRecord(args[0].(int64)))
+	}
+	fake.Handle("from inventory_reservations").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"coalesce(sum(quantity), 0)": int64(0)})
+	}
+	fake.Handle("delete from inventory_reservations")
+	fake.Handle("insert into inventory_reservations")
+	fake.Handle("from customers where email").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":                  int64(4),
+			"first_name":          "Jane",
+			"last_name":           "Doe",
+			"email":               "jane@example.com",
+			"gateway_customer_id": cust.ID,
+			"created_at":          time.Now(),
+			"updated_at":          time.Now(),
+		})
+	}
+
+	for _, loggedIn := range []bool{false, true} {
+		b := &browser{app: app}
+		if loggedIn {
+			b.get(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				session.Put(r.Context(), "customerEmail", "jane@example.com")
+			}), "/")
+		}
+		b.post(app.AddToCart, url.Values{"widget_id": {"1"}})
+
+		r := httptest.NewRequest(http.MethodPost, "/cart/payment-intent", strings.NewReader(`{"email": "Jane@example.com"}`))
+		w := b.do(http.HandlerFunc(app.CartPaymentIntent), r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("logged in %t: got %d %s", loggedIn, w.Code, w.Body)
+		}
+		var resp struct {
+			ClientSecret string `json:"client_secret"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		pi, err := gateway.RetrievePaymentIntent(strings.TrimSuffix(resp.ClientSecret, "_secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if charged := pi.Customer != nil; charged != loggedIn {
+			t.Errorf("logged in %t: charged as the gateway customer %t", loggedIn, charged)
+		}
+	}
+}
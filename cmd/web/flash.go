@@ -8,7 +8,7 @@ import (
 )
 
 func SetFlash(w http.ResponseWriter, name string, value []byte) {
-    c := &http.Cookie{Name: name, Value: encode(value)}
+    c := &http.Cookie{Name: name, Value: encode(value), Path: "/"}
     http.SetCookie(w, c)
 }
 
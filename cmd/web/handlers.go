@@ -1,9 +1,18 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -19,6 +28,47 @@ func (app *application) clientError(w http.ResponseWriter, status int) {
 	http.Error(w, http.StatusText(status), status)
 }
 
+// clientIP returns the address the request came from. cmd/api has the
+// same, so both count failed logins against the same IPs.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// idempotencyKey returns the key for a request that creates an order: the
+// Idempotency-Key header if the client sent one, or else a natural key
+// such as a payment intent ID. The scope keeps different kinds of request
+// from colliding.
+func idempotencyKey(r *http.Request, scope, natural string) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = natural
+	}
+	if key == "" {
+		return ""
+	}
+	return scope + ":" + key
+}
+
+// requestHash ties a posted payment form to the session that posted it, so
+// that a payment intent ID posted from another browser is refused rather
+// than shown the first buyer's receipt.
+func (app *application) requestHash(r *http.Request) string {
+	owner := app.Session.GetString(r.Context(), "paymentOwner")
+	if owner == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			app.errorLog.Println(err)
+		}
+		owner = hex.EncodeToString(b)
+		app.Session.Put(r.Context(), "paymentOwner", owner)
+	}
+	return models.RequestHash(owner, r.PostForm)
+}
+
 //
 func (app *application) setFlashAndGoHome(w http.ResponseWriter, r *http.Request, msg string, retCode int) {
 	SetFlash(w, "flash", []byte(msg))
@@ -26,8 +76,27 @@ func (app *application) setFlashAndGoHome(w http.ResponseWriter, r *http.Request
 }
 
 func (app *application) HomePage(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetAllWidgets(false)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusInternalServerError)
+		return
+	}
+
+	var products, plans []*models.Widget
+	for _, widget := range widgets {
+		if widget.IsRecurring {
+			plans = append(plans, widget)
+		} else {
+			products = append(products, widget)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["products"] = products
+	data["plans"] = plans
 	// This page has Vue support
-	td := &templateData{}
+	td := &templateData{Data: data}
 	if app.vueglue != nil {
 		td.VueGlue = app.vueglue
 	}
@@ -47,37 +116,6 @@ func (app *application) VirtualTerminal(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// Helper routines for DB writes
-
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
-func (app *application) SaveTxn(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
 type TransactionData struct {
 	ID              int
 	FirstName       string
@@ -92,8 +130,32 @@ type TransactionData struct {
 	ExpiryMonth     int
 	ExpiryYear      int
 	BankReturnCode  string
+	// These come from the payment intent's metadata. PricedAmount is what
+	// we asked for when the intent was made, and Items are the lines of a
+	// cart as they were priced then.
+	Reference    string
+	WidgetID     int
+	Quantity     int
+	PricedAmount int
+	Items        []models.OrderItem
+	// SavedCard is set when the customer asked us to keep their card, and
+	// GatewayCustomerID is who it was saved to.
+	SavedCard         *models.PaymentMethod
+	GatewayCustomerID string
+	// Pending is set when the bank has yet to tell us if the payment went
+	// through.
+	Pending bool
+	// NeedsAuthentication is set when the bank wants the customer to
+	// confirm the payment first (3-D Secure). The payment is pending
+	// meanwhile.
+	NeedsAuthentication bool
 }
 
+// GetTxnData collects the details of a payment from the posted form and
+// from Stripe. The amount and currency are taken from the payment intent,
+// not the form, since that is what the customer actually paid. A payment
+// still being processed, or one the customer has yet to authenticate, is
+// returned as pending.
 func (app *application) GetTxnData(r *http.Request) (*TransactionData, error) {
 	cardHolder := r.Form.Get("cardholder_name")
 	email := r.Form.Get("email")
@@ -101,25 +163,22 @@ func (app *application) GetTxnData(r *http.Request) (*TransactionData, error) {
 	lastName := r.Form.Get("last_name")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentCurrency := r.Form.Get("payment_currency")
-	paymentAmount, err := strconv.Atoi(r.Form.Get("payment_amount"))
-	if err != nil {
-		app.errorLog.Println("payment amount is not an int")
-		return nil, err
-	}
-
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
 
-	pi, err := card.RetrievePaymentIntent(paymentIntent)
+	pi, err := app.gateway.RetrievePaymentIntent(paymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		return nil, err
 	}
+	outcome := cards.PaymentIntentOutcome(pi)
+	if outcome == cards.PaymentFailed {
+		return nil, fmt.Errorf("payment intent %s has status %s", pi.ID, pi.Status)
+	}
 
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	// A saved card is on the intent, not the form.
+	if pi.PaymentMethod != nil {
+		paymentMethod = pi.PaymentMethod.ID
+	}
+	pm, err := app.gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.errorLog.Println(err)
 		return nil, err
@@ -128,7 +187,7 @@ func (app *application) GetTxnData(r *http.Request) (*TransactionData, error) {
 	lastFour := pm.Card.Last4
 	expiryMonth := pm.Card.ExpMonth
 	expiryYear := pm.Card.ExpYear
-	bankReturnCode := pi.Charges.Data[0].ID
+	bankReturnCode := cards.ChargeID(pi)
 
 	// worth doing validation here...
 
@@ -139,138 +198,405 @@ func (app *application) GetTxnData(r *http.Request) (*TransactionData, error) {
 		Email:           email,
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
-		PaymentAmount:   paymentAmount,
-		PaymentCurrency: paymentCurrency,
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: pi.Currency,
 		LastFour:        lastFour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
 		BankReturnCode:  bankReturnCode,
+		Reference:       pi.Metadata["order_reference"],
+		Pending:         outcome == cards.PaymentPending || outcome == cards.PaymentNeedsAction,
+	}
+	txn.NeedsAuthentication = outcome == cards.PaymentNeedsAction
+	txn.WidgetID, _ = strconv.Atoi(pi.Metadata["widget_id"])
+	txn.Quantity, _ = strconv.Atoi(pi.Metadata["quantity"])
+	txn.PricedAmount, _ = strconv.Atoi(pi.Metadata["amount"])
+	txn.Items, _ = parseCartItems(pi.Metadata["items"])
+	if pi.Customer != nil {
+		txn.GatewayCustomerID = pi.Customer.ID
+		// Cards are only saved for customers logged in to their account.
+		if pi.SetupFutureUsage != "" && app.ownsEmail(r, email) {
+			txn.SavedCard = &models.PaymentMethod{
+				GatewayPaymentMethodID: pm.ID,
+				Fingerprint:            pm.Card.Fingerprint,
+				Brand:                  string(pm.Card.Brand),
+				LastFour:               pm.Card.Last4,
+				ExpiryMonth:            int(pm.Card.ExpMonth),
+				ExpiryYear:             int(pm.Card.ExpYear),
+			}
+		}
 	}
 
 	return &txn, nil
 }
 
 func (app *application) VTPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
+	app.paymentSucceeded(w, r, "vterm-payment-succeeded", app.saveTerminalPayment)
+}
+
+func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request) {
+	app.paymentSucceeded(w, r, "payment-succeeded", app.saveWidgetPayment)
+}
+
+// paymentSaver records a confirmed payment, returning the receipt data and
+// the ID of the order, if there is one.
+type paymentSaver func(r *http.Request) (*TransactionData, int, error)
+
+// paymentSucceeded saves a payment that the browser has confirmed, and
+// shows the receipt. A form that gets submitted twice carries the same
+// payment intent, which we use as the idempotency key so that the second
+// submission just shows the original receipt.
+func (app *application) paymentSucceeded(w http.ResponseWriter, r *http.Request, scope string, save paymentSaver) {
 	err := r.ParseForm()
 	if err != nil {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	txnPtr, err := app.GetTxnData(r)
-	if err != nil {
-		app.errorLog.Println(err)
+	idemKey := idempotencyKey(r, scope, r.Form.Get("payment_intent"))
+	if idemKey == "" {
+		app.errorLog.Println("payment_intent is missing")
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	// We save the customer but will not display this in the receipt.
-	_, err = app.SaveCustomer(txnPtr.FirstName, txnPtr.LastName, txnPtr.Email)
+	prior, isNew, err := app.DB.ClaimIdempotencyKey(idemKey, app.requestHash(r))
+	if errors.Is(err, models.ErrIdempotencyKeyReused) {
+		app.errorLog.Printf("%s was posted from another session", idemKey)
+		app.setFlashAndGoHome(w, r, "Sorry! This payment has already been processed.", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		app.errorLog.Println(err)
-		app.clientError(w, http.StatusBadRequest)
+		app.clientError(w, http.StatusInternalServerError)
 		return
 	}
-
-	txn := models.Transaction{
-		Amount:              txnPtr.PaymentAmount,
-		Currency:            txnPtr.PaymentCurrency,
-		LastFour:            txnPtr.LastFour,
-		ExpiryMonth:         txnPtr.ExpiryMonth,
-		ExpiryYear:          txnPtr.ExpiryYear,
-		BankReturnCode:      txnPtr.BankReturnCode,
-		PaymentIntent:       txnPtr.PaymentIntentID,
-		PaymentMethod:       txnPtr.PaymentMethodID,
-		TransactionStatusID: 2, //cleared
+	if !isNew {
+		pending, ok := app.Session.Get(r.Context(), "pendingPayment").(pendingPayment)
+		if ok && pending.Form.Get("payment_intent") == r.Form.Get("payment_intent") {
+			app.settlePayment(w, r, prior)
+			return
+		}
+		app.replayReceipt(w, r, prior)
+		return
 	}
 
-	txnID, err := app.SaveTxn(txn)
+	txnData, orderID, err := save(r)
+	var refundErr *refundError
+	if errors.As(err, &refundErr) {
+		// The key is kept, so that posting the form again can't record
+		// the payment a second time.
+		app.errorLog.Println(err)
+		reason := "we could not take your order"
+		if errors.Is(err, models.ErrOutOfStock) {
+			reason = refundErr.Err.Error()
+		}
+		if !refundErr.Refunded {
+			app.setFlashAndGoHome(w, r, fmt.Sprintf("Sorry, %s. Please contact us about a refund.", reason), http.StatusSeeOther)
+			return
+		}
+		app.setFlashAndGoHome(w, r, fmt.Sprintf("Sorry, %s. Your payment has been refunded.", reason), http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		app.errorLog.Println(err)
+		if err := app.DB.ReleaseIdempotencyKey(idemKey); err != nil {
+			app.errorLog.Println(err)
+		}
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-	txnPtr.ID = txnID
 
-	// We are done with the DB, since there is no Order in this case.
+	receipt, err := json.Marshal(txnData)
+	if err != nil {
+		app.errorLog.Println(err)
+	} else if err := app.DB.CompleteIdempotencyKey(idemKey, orderID, string(receipt)); err != nil {
+		app.errorLog.Println(err)
+	}
 
-	// Dereference the pointer to struct.
-	txnData := *txnPtr
+	if txnData.NeedsAuthentication {
+		// The order is saved as pending. Once the customer has confirmed
+		// the payment, the form comes back here and settlePayment moves
+		// it on.
+		app.Session.Put(r.Context(), "pendingPayment", pendingPayment{
+			Action: r.URL.Path,
+			Form:   r.PostForm,
+		})
+		http.Redirect(w, r, "/payment/authenticate", http.StatusSeeOther)
+		return
+	}
+	app.Session.Remove(r.Context(), "pendingPayment")
 
-	app.Session.Put(r.Context(), "receipt", txnData)
+	app.Session.Put(r.Context(), "receipt", *txnData)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
-
 }
 
-func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+// settlePayment moves the order saved for a payment on to wherever the
+// payment ended up, once the customer has been through their bank's
+// check, and shows the receipt. prior holds what was saved for it.
+func (app *application) settlePayment(w http.ResponseWriter, r *http.Request, prior *models.IdempotencyKey) {
+	var txnData TransactionData
+	err := json.Unmarshal([]byte(prior.Response), &txnData)
 	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusInternalServerError)
 		return
 	}
 
-	txnPtr, err := app.GetTxnData(r)
+	pi, err := app.gateway.RetrievePaymentIntent(txnData.PaymentIntentID)
 	if err != nil {
 		app.errorLog.Println(err)
-		app.clientError(w, http.StatusBadRequest)
+		app.setFlashAndGoHome(w, r, "Sorry! We could not find your payment.", http.StatusSeeOther)
 		return
 	}
-	productID, err := strconv.Atoi(r.Form.Get("product_id"))
+
+	event := models.OrderEvent{GatewayReference: pi.ID}
+	switch cards.PaymentIntentOutcome(pi) {
+	case cards.PaymentNeedsAction:
+		http.Redirect(w, r, "/payment/authenticate", http.StatusSeeOther)
+		return
+	case cards.PaymentFailed:
+		app.Session.Remove(r.Context(), "pendingPayment")
+		event.Reason = "payment not authenticated"
+		if prior.OrderID != 0 {
+			_, err = app.DB.MarkOrderPaymentFailed(prior.OrderID, event)
+		} else {
+			err = app.DB.SetTransactionStatus(txnData.ID, models.TxnDeclined)
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.setFlashAndGoHome(w, r, "Sorry! Your payment did not go through, and you have not been charged.", http.StatusSeeOther)
+		return
+	case cards.PaymentSucceeded:
+		// If this fails, Stripe's webhook for the payment catches up.
+		event.Reason = "payment authenticated"
+		txnData.BankReturnCode = cards.ChargeID(pi)
+		err = app.DB.ClearPendingPayment(txnData.ID, prior.OrderID, txnData.BankReturnCode, event)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		txnData.Pending = false
+	}
+	// A payment still processing stays pending until the webhook says.
+	txnData.NeedsAuthentication = false
+	app.Session.Remove(r.Context(), "pendingPayment")
+
+	receipt, err := json.Marshal(txnData)
 	if err != nil {
-		app.errorLog.Println("widget_id is not an int")
-		app.clientError(w, http.StatusBadRequest)
+		app.errorLog.Println(err)
+	} else if err := app.DB.CompleteIdempotencyKey(prior.Key, prior.OrderID, string(receipt)); err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "receipt", txnData)
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+}
+
+// pendingPayment is a checkout form put aside while the customer
+// authenticates the payment with their bank. Action is where the form was
+// posted, and where it goes again once they have.
+type pendingPayment struct {
+	Action string
+	Form   url.Values
+}
+
+// AuthenticatePayment is where a customer whose bank wants a payment
+// authenticated (3-D Secure) comes back to. Their order is already saved
+// as pending. The page runs the bank's check, and then posts the checkout
+// form again, so that settlePayment can move the order on. A payment with
+// nothing left to check is posted straight back.
+func (app *application) AuthenticatePayment(w http.ResponseWriter, r *http.Request) {
+	pending, ok := app.Session.Get(r.Context(), "pendingPayment").(pendingPayment)
+	if !ok {
+		app.setFlashAndGoHome(w, r, "Sorry! We could not find your payment.", http.StatusSeeOther)
 		return
 	}
 
-	customerID, err := app.SaveCustomer(txnPtr.FirstName, txnPtr.LastName, txnPtr.Email)
+	pi, err := app.gateway.RetrievePaymentIntent(pending.Form.Get("payment_intent"))
 	if err != nil {
 		app.errorLog.Println(err)
-		app.clientError(w, http.StatusBadRequest)
+		app.Session.Remove(r.Context(), "pendingPayment")
+		app.setFlashAndGoHome(w, r, "Sorry! We could not find your payment.", http.StatusSeeOther)
 		return
 	}
 
-	txn := models.Transaction{
-		Amount:              txnPtr.PaymentAmount,
-		Currency:            txnPtr.PaymentCurrency,
-		LastFour:            txnPtr.LastFour,
-		ExpiryMonth:         txnPtr.ExpiryMonth,
-		ExpiryYear:          txnPtr.ExpiryYear,
-		BankReturnCode:      txnPtr.BankReturnCode,
-		PaymentIntent:       txnPtr.PaymentIntentID,
-		PaymentMethod:       txnPtr.PaymentMethodID,
-		TransactionStatusID: 2, //cleared
+	data := make(map[string]interface{})
+	data["action"] = pending.Action
+	data["fields"] = pending.Form
+	data["client_secret"] = pi.ClientSecret
+	data["needs_action"] = cards.PaymentIntentOutcome(pi) == cards.PaymentNeedsAction
+	if err := app.renderTemplate(w, r, "authenticate-payment", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// refundError is returned by a paymentSaver that couldn't take the order
+// a payment was for, and so gave the money back. Err is why.
+type refundError struct {
+	Err error
+	// Refunded is false if the refund failed as well.
+	Refunded bool
+}
+
+func (e *refundError) Error() string {
+	if !e.Refunded {
+		return fmt.Sprintf("payment not refunded: %v", e.Err)
 	}
+	return fmt.Sprintf("payment refunded: %v", e.Err)
+}
 
-	txnID, err := app.SaveTxn(txn)
+func (e *refundError) Unwrap() error {
+	return e.Err
+}
+
+// refundPayment gives back all of a payment we couldn't take an order
+// for, and returns a refundError for why.
+func (app *application) refundPayment(txnPtr *TransactionData, why error) error {
+	// There's no order to record this against, since it wasn't taken.
+	_, err := app.gateway.Refund(cards.RefundRequest{
+		PaymentIntent:  txnPtr.PaymentIntentID,
+		Amount:         txnPtr.PaymentAmount,
+		Reason:         "order not taken",
+		IdempotencyKey: "not-taken:" + txnPtr.PaymentIntentID,
+	})
 	if err != nil {
-		app.errorLog.Println(err)
-		app.clientError(w, http.StatusBadRequest)
-		return
+		app.errorLog.Println("could not refund", txnPtr.PaymentIntentID, err)
+		return &refundError{Err: why}
+	}
+	return &refundError{Err: why, Refunded: true}
+}
+
+// orderStatusID is the status of the order a payment is for. It stays
+// pending until Stripe's webhook says the payment went through.
+func (txnPtr *TransactionData) orderStatusID() models.OrderStatus {
+	if txnPtr.Pending {
+		return models.OrderPending
+	}
+	return models.OrderCharged
+}
+
+// purchaseFromTxn sets up the customer and transaction for a purchase.
+func (app *application) purchaseFromTxn(r *http.Request, txnPtr *TransactionData) models.Purchase {
+	txnStatusID := models.TxnCleared
+	if txnPtr.Pending {
+		txnStatusID = models.TxnPending
+	}
+
+	return models.Purchase{
+		Customer: models.Customer{
+			FirstName:         txnPtr.FirstName,
+			LastName:          txnPtr.LastName,
+			Email:             txnPtr.Email,
+			GatewayCustomerID: txnPtr.GatewayCustomerID,
+		},
+		CustomerVerified: app.ownsEmail(r, txnPtr.Email),
+		Transaction: models.Transaction{
+			Amount:              txnPtr.PaymentAmount,
+			Currency:            txnPtr.PaymentCurrency,
+			LastFour:            txnPtr.LastFour,
+			ExpiryMonth:         txnPtr.ExpiryMonth,
+			ExpiryYear:          txnPtr.ExpiryYear,
+			BankReturnCode:      txnPtr.BankReturnCode,
+			PaymentIntent:       txnPtr.PaymentIntentID,
+			PaymentMethod:       txnPtr.PaymentMethodID,
+			TransactionStatusID: txnStatusID,
+		},
+		PaymentMethod: txnPtr.SavedCard,
+	}
+}
+
+// saveTerminalPayment records a virtual terminal payment. There is no
+// Order in this case, and while we save the customer, we will not display
+// them in the receipt.
+func (app *application) saveTerminalPayment(r *http.Request) (*TransactionData, int, error) {
+	txnPtr, err := app.GetTxnData(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	_, txnID, _, err := app.DB.RecordPurchase(app.purchaseFromTxn(r, txnPtr))
+	if err != nil {
+		return nil, 0, err
+	}
+	txnPtr.ID = txnID
+
+	return txnPtr, 0, nil
+}
+
+// saveWidgetPayment records the purchase of a single widget. The widget,
+// quantity and price are the ones the payment intent was made for; the
+// widget's price may have changed since. The money has been taken by the
+// time we get here, so a payment that doesn't match what was priced, or
+// that can't be recorded, is refunded.
+func (app *application) saveWidgetPayment(r *http.Request) (*TransactionData, int, error) {
+	txnPtr, err := app.GetTxnData(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	productID, _ := strconv.Atoi(r.Form.Get("product_id"))
+	switch {
+	case txnPtr.WidgetID == 0 || txnPtr.Quantity < 1:
+		return nil, 0, app.refundPayment(txnPtr, fmt.Errorf("payment intent %s is not for a widget", txnPtr.PaymentIntentID))
+	case txnPtr.WidgetID != productID:
+		return nil, 0, app.refundPayment(txnPtr, fmt.Errorf("payment intent %s is not for widget %d", txnPtr.PaymentIntentID, productID))
+	case txnPtr.PaymentAmount != txnPtr.PricedAmount:
+		return nil, 0, app.refundPayment(txnPtr, fmt.Errorf("payment intent %s paid %d, but was priced at %d",
+			txnPtr.PaymentIntentID, txnPtr.PaymentAmount, txnPtr.PricedAmount))
+	}
+
+	purchase := app.purchaseFromTxn(r, txnPtr)
+	purchase.Order = &models.Order{
+		WidgetID:  txnPtr.WidgetID,
+		StatusID:  txnPtr.orderStatusID(),
+		Quantity:  txnPtr.Quantity,
+		Amount:    txnPtr.PaymentAmount,
+		Reference: txnPtr.Reference,
+	}
+
+	_, txnID, orderID, err := app.DB.RecordPurchase(purchase)
+	if err != nil {
+		return nil, 0, app.refundPayment(txnPtr, err)
 	}
 	txnPtr.ID = txnID
 
-	order := models.Order{
-		WidgetID:      productID,
-		TransactionID: txnID,
-		StatusID:      1, // need to check this
-		CustomerID:    customerID,
-		Quantity:      1, // fixed for the app for now
-		Amount:        txnPtr.PaymentAmount,
+	return txnPtr, orderID, nil
+}
+
+// replayReceipt shows the receipt saved by an earlier submission of the
+// same payment. A double click can get here while the first submission is
+// still being saved, so we give it a moment to finish.
+func (app *application) replayReceipt(w http.ResponseWriter, r *http.Request, prior *models.IdempotencyKey) {
+	var err error
+	for i := 0; prior.Response == "" && i < 10; i++ {
+		time.Sleep(300 * time.Millisecond)
+		prior, err = app.DB.GetIdempotencyKey(prior.Key)
+		if err != nil {
+			// The first submission failed and gave up the key.
+			app.errorLog.Println(err)
+			app.clientError(w, http.StatusConflict)
+			return
+		}
+	}
+	if prior.Response == "" {
+		app.clientError(w, http.StatusConflict)
+		return
 	}
-	// For now, we don't need to use the orderID here:
-	_, err = app.SaveOrder(order)
+
+	var txnData TransactionData
+	err = json.Unmarshal([]byte(prior.Response), &txnData)
 	if err != nil {
 		app.errorLog.Println(err)
-		app.clientError(w, http.StatusBadRequest)
+		app.clientError(w, http.StatusInternalServerError)
 		return
 	}
 
-	// Dereference the pointer to struct.
-	txnData := *txnPtr
-
+	app.infoLog.Printf("showing saved receipt for %s", prior.Key)
 	app.Session.Put(r.Context(), "receipt", txnData)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
-
 }
 
 func (app *application) DisplayReceipt(w http.ResponseWriter, r *http.Request) {
@@ -292,23 +618,31 @@ func (app *application) DisplayReceipt(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (app *application) TestGetWidget(w http.ResponseWriter, r *http.Request) {
-	widgetID := 1
-	widget, err := app.DB.GetWidget(widgetID)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+// widgetFromURL finds the widget a product page is for. Pages are
+// addressed by slug, but the old numeric URLs still work.
+func (app *application) widgetFromURL(r *http.Request, param string) (models.Widget, error) {
+	key := chi.URLParam(r, param)
+	if id, err := strconv.Atoi(key); err == nil {
+		return app.DB.GetWidget(id)
 	}
-	app.infoLog.Println("widget", widget)
+	return app.DB.GetWidgetBySlug(key)
 }
 
 func (app *application) BuyOneItem(w http.ResponseWriter, r *http.Request) {
+	widget, err := app.widgetFromURL(r, "id")
+	if err != nil || widget.IsArchived {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println(err)
+		}
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+	if widget.IsRecurring {
+		http.Redirect(w, r, "/plans/"+widget.Slug, http.StatusSeeOther)
+		return
+	}
 
-	id := chi.URLParam(r, "id")
-	widgetID, _ := strconv.Atoi(id)
-	app.infoLog.Println("WID:", widgetID)
-
-	widget, err := app.DB.GetWidget(widgetID)
+	available, err := app.DB.AvailableInventory(widget.ID)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
@@ -316,8 +650,12 @@ func (app *application) BuyOneItem(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]interface{})
 	data["widget"] = widget
+	app.addSavedCards(r, data)
+	intMap := make(map[string]int)
+	intMap["available"] = available
 	tdata := templateData{
-		Data: data,
+		Data:   data,
+		IntMap: intMap,
 	}
 
 	if err := app.renderTemplate(w, r, "buy-once", &tdata, "stripejs", "stripe-form"); err != nil {
@@ -325,26 +663,41 @@ func (app *application) BuyOneItem(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-	widget, err := app.DB.GetWidget(2) // bronze plan
-	if err != nil {
-		app.errorLog.Println(err)
+// PlanPage is the subscription page for any recurring widget.
+func (app *application) PlanPage(w http.ResponseWriter, r *http.Request) {
+	widget, err := app.widgetFromURL(r, "slug")
+	if err != nil || widget.IsArchived {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println(err)
+		}
+		app.clientError(w, http.StatusNotFound)
 		return
 	}
+	if !widget.IsRecurring {
+		http.Redirect(w, r, "/widget/"+widget.Slug, http.StatusSeeOther)
+		return
+	}
+
 	data := make(map[string]interface{})
 	data["widget"] = widget
+	if app.vueglue == nil {
+		// Only the Go form offers saved cards.
+		app.addSavedCards(r, data)
+	}
 	tdata := templateData{
 		Data:    data,
 		VueGlue: app.vueglue,
 	}
 
-	if err := app.renderTemplate(w, r, "bronze", &tdata, "stripe-form", "stripejs"); err != nil {
+	if err := app.renderTemplate(w, r, "plan", &tdata, "stripe-form", "stripejs"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-func (app *application) ReceiptBronze(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "receipt-bronze", nil); err != nil {
+// SubscriptionReceipt shows the receipt for a new subscription. The
+// details are left in session storage by the subscription form.
+func (app *application) SubscriptionReceipt(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "receipt-subscription", nil); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -374,11 +727,44 @@ func (app *application) ProcessLogin(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
+	// The attempt is counted before it is checked, so that guesses made
+	// at the same time can't get round the limit, and given back if good.
+	keys := []models.ThrottleKey{models.AccountKey(email), models.IPKey(clientIP(r))}
+	wait, locked, err := app.DB.ReserveAttempt(keys...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		app.clientError(w, http.StatusTooManyRequests)
+		return
+	}
+
+	// The login page logs in to the API first, which checks the password
+	// and any second step, and sends the token it got back. That token is
+	// the proof the login passed there, so this can't be used to get round
+	// the API's throttling. Every failure answers the same.
 	uid, err := app.DB.Authenticate(email, password)
+	if err == nil {
+		var tokenUser *models.User
+		tokenUser, err = app.DB.GetUserFromToken(r.Form.Get("token"), models.ScopeAuthentication)
+		if err == nil && tokenUser.ID != uid {
+			err = errors.New("token is for another user")
+		}
+	}
 	if err != nil {
-		app.clientError(w, http.StatusBadRequest)
+		// Lockout emails are sent by the API; we just note the lockout.
+		for _, t := range locked {
+			app.infoLog.Printf("%s %s locked out until %s", t.Kind, t.Key, t.LockedUntil.Format(time.RFC3339))
+		}
+		app.clientError(w, http.StatusUnauthorized)
 		return
 	}
+	err = app.DB.ForgiveAttempt(keys...)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	session.Put(r.Context(), "userID", uid)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -438,6 +824,68 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// How long the link in a dunning email works, and how long the page it
+// opens has to finish updating the card.
+const (
+	updateCardLinkMinutes = 7 * 24 * 60
+	updateCardPageTTL     = time.Hour
+)
+
+// updateCardClaim must match the one in cmd/api.
+func updateCardClaim(orderID int, expires int64) string {
+	return fmt.Sprintf("update-card:%d:%d", orderID, expires)
+}
+
+// UpdateCard is where the link in a dunning email goes, so the customer
+// can put a new card on a subscription that failed to renew.
+func (app *application) UpdateCard(w http.ResponseWriter, r *http.Request) {
+	testURL := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+	if !signer.VerifyToken(testURL) {
+		app.errorLog.Println("Invalid url - tampering detected")
+		app.setFlashAndGoHome(w, r, "Sorry! There was a problem processing your link.", http.StatusSeeOther)
+		return
+	}
+	if signer.Expired(testURL, updateCardLinkMinutes) {
+		app.setFlashAndGoHome(w, r, "Sorry! Your link has expired. Please use the one in your latest email.", http.StatusSeeOther)
+		return
+	}
+
+	orderID, err := strconv.Atoi(r.URL.Query().Get("order"))
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	order, err := app.DB.GetSubscription(orderID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	// The API can't see the link, so hand the page a hash it can check.
+	expires := time.Now().Add(updateCardPageTTL).Unix()
+	hash, err := signer.GetHashWithSalt(updateCardClaim(order.ID, expires))
+	if err != nil {
+		app.errorLog.Println("hasher failed:", err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["order"] = order
+	data["hash"] = hash
+	data["expires"] = expires
+	if err := app.renderTemplate(w, r, "update-card", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) PasswordLinkSent(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "link-sent", nil); err != nil {
 		app.errorLog.Println(err)
@@ -473,12 +921,20 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusNotFound)
 		return
 	}
+	events, err := app.DB.GetOrderEvents(order.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
 	data := make(map[string]interface{})
 	data["order"] = order
+	data["events"] = events
+	intMap := make(map[string]int)
+	intMap["balance"] = order.Amount - order.RefundedAmount
 	td := templateData{
-		Data: data,
+		Data:   data,
+		IntMap: intMap,
 	}
-	if err = app.renderTemplate(w, r, "sale", &td); err != nil {
+	if err = app.renderTemplate(w, r, "sale", &td, "order-events", "order-status"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -492,12 +948,32 @@ func (app *application) GetSubscription(w http.ResponseWriter, r *http.Request)
 		http.Redirect(w, r, "/", http.StatusNotFound)
 		return
 	}
+
+	// The plans this subscription could move to.
+	widgets, err := app.DB.GetAllWidgets(false)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	var plans []*models.Widget
+	for _, widget := range widgets {
+		if widget.IsRecurring && widget.ID != order.WidgetID && widget.Currency == order.Transaction.Currency {
+			plans = append(plans, widget)
+		}
+	}
+
+	events, err := app.DB.GetOrderEvents(order.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	data := make(map[string]interface{})
 	data["order"] = order
+	data["plans"] = plans
+	data["events"] = events
 	td := templateData{
 		Data: data,
 	}
-	if err := app.renderTemplate(w, r, "subscription", &td); err != nil {
+	if err := app.renderTemplate(w, r, "subscription", &td, "order-events", "order-status"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -534,6 +1010,7 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 	}
 	data := make(map[string]interface{})
 	data["user"] = user
+	data["roles"] = models.Roles
 	td := templateData{
 		Data: data,
 	}
@@ -543,7 +1020,47 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) NewUserForm(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "new-user", nil); err != nil {
+	data := make(map[string]interface{})
+	data["roles"] = models.Roles
+	td := templateData{
+		Data: data,
+	}
+	if err := app.renderTemplate(w, r, "new-user", &td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Security lets an admin set up two-factor login for themselves.
+func (app *application) Security(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "security", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Lockouts shows the accounts and addresses with failed logins, and lets
+// an admin unlock them.
+func (app *application) Lockouts(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "lockouts", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// APIKeys shows the API keys, and a form for making new ones.
+func (app *application) APIKeys(w http.ResponseWriter, r *http.Request) {
+	var scopes []models.Permission
+	for _, p := range models.Permissions {
+		// Keys can't be used to make more keys.
+		if p != models.PermManageAPIKeys {
+			scopes = append(scopes, p)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["scopes"] = scopes
+	td := templateData{
+		Data: data,
+	}
+	if err := app.renderTemplate(w, r, "api-keys", &td); err != nil {
 		app.errorLog.Println(err)
 	}
 }
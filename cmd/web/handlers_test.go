@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/gob"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/torenware/go-stripe/internal/cards"
+	"github.com/torenware/go-stripe/internal/models"
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+func init() {
+	gob.Register(TransactionData{})
+	gob.Register(Cart{})
+	gob.Register(pendingPayment{})
+}
+
+// testApp returns an application on a fake database, the fake gateway
+// and an in-memory session store.
+func testApp(t *testing.T) (*application, *fakedb.DB, *cards.FakeGateway) {
+	db, fake := fakedb.New(t)
+	gateway := cards.NewFakeGateway()
+	session = scs.New()
+	app := &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		DB:       models.DBModel{DB: db},
+		Session:  session,
+		gateway:  gateway,
+	}
+	return app, fake, gateway
+}
+
+// browser posts forms to a handler, keeping the session cookie between
+// requests.
+type browser struct {
+	app     *application
+	cookies []*http.Cookie
+}
+
+func (b *browser) post(handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/virtual-terminal-payment-succeeded", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(handler, r)
+}
+
+// get fetches target from a handler, which may be a router.
+func (b *browser) get(handler http.Handler, target string) *httptest.ResponseRecorder {
+	return b.do(handler, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func (b *browser) do(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.app.Session.LoadAndSave(handler).ServeHTTP(w, r)
+	if cookies := w.Result().Cookies(); len(cookies) > 0 {
+		b.cookies = cookies
+	}
+	return w
+}
+
+// fakeTerminalTables keeps the tables a terminal payment is saved to in
+// memory: its idempotency keys, by key, and the status of transaction 3.
+func fakeTerminalTables(fake *fakedb.DB) (map[string]string, *models.TxnStatus) {
+	keys := map[string]string{}
+	hashes := map[string]string{}
+	fake.Handle("insert ignore into idempotency_keys").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if _, ok := keys[args[0].(string)]; ok {
+			return fakedb.Result{}, nil
+		}
+		keys[args[0].(string)] = ""
+		hashes[args[0].(string)] = args[1].(string)
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+	fake.Handle("from idempotency_keys").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":           int64(1),
+			"idem_key":     args[0],
+			"request_hash": hashes[args[0].(string)],
+			"order_id":     int64(0),
+			"response":     keys[args[0].(string)],
+			"created_at":   time.Now(),
+			"updated_at":   time.Now(),
+		})
+	}
+	fake.Handle("update idempotency_keys").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		keys[args[3].(string)] = args[1].(string)
+		return fakedb.Result{Affected: 1}, nil
+	}
+
+	fake.Handle("select id from customers")
+	fake.Handle("insert into customers").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		return fakedb.Result{ID: 4, Affected: 1}, nil
+	}
+
+	status := new(models.TxnStatus)
+	fake.Handle("insert into transactions").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		*status = models.TxnStatus(args[6].(int64))
+		return fakedb.Result{ID: 3, Affected: 1}, nil
+	}
+	fake.Handle("insert into transaction_status_changes")
+	fake.Handle("select transaction_status_id from transactions").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"transaction_status_id": int64(*status)})
+	}
+	fake.Handle("update transactions set transaction_status_id").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		*status = models.TxnStatus(args[0].(int64))
+		return fakedb.Result{Affected: 1}, nil
+	}
+	fake.Handle("update transactions set bank_return_code")
+	return keys, status
+}
+
+// Posting a payment twice shows the first receipt rather than saving it
+// again; posting it from another session shows nothing.
+func TestVTPaymentSucceededTwice(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	keys, _ := fakeTerminalTables(fake)
+
+	card := gateway.AddCard("visa", "4242", 12, 2030)
+	pi, _, err := gateway.CreatePaymentIntent(cards.PaymentIntentRequest{Currency: "cad", Amount: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateway.ConfirmPaymentIntent(pi.ID, card.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"payment_intent":   {pi.ID},
+		"payment_method":   {card.ID},
+		"payment_amount":   {"1500"},
+		"payment_currency": {"cad"},
+		"email":            {"jane@example.com"},
+		"first_name":       {"Jane"},
+		"last_name":        {"Doe"},
+		"cardholder_name":  {"Jane Doe"},
+	}
+	b := &browser{app: app}
+
+	for i := 0; i < 2; i++ {
+		w := b.post(app.VTPaymentSucceeded, form)
+		if loc := w.Header().Get("Location"); loc != "/receipt" {
+			t.Fatalf("post %d sent to %q (%d)", i+1, loc, w.Code)
+		}
+	}
+	if fake.Ran("insert into transactions") != 1 {
+		t.Error("the payment was saved twice")
+	}
+	if !strings.Contains(keys["vterm-payment-succeeded:"+pi.ID], "Jane") {
+		t.Errorf("receipt not saved: %s", keys["vterm-payment-succeeded:"+pi.ID])
+	}
+
+	other := &browser{app: app}
+	w := other.post(app.VTPaymentSucceeded, form)
+	if loc := w.Header().Get("Location"); loc != "/" {
+		t.Errorf("another session was sent to %q (%d)", loc, w.Code)
+	}
+}
+
+// A payment the bank wants authenticated is saved as pending, and the
+// customer sent to authenticate it. Posting the form again afterwards
+// settles it, rather than saving it twice.
+func TestPaymentNeedsAuthentication(t *testing.T) {
+	app, fake, gateway := testApp(t)
+	keys, status := fakeTerminalTables(fake)
+
+	card := gateway.AddCard("visa", "3155", 12, 2030)
+	gateway.AuthenticatedCards[card.ID] = true
+	pi, _, err := gateway.CreatePaymentIntent(cards.PaymentIntentRequest{Currency: "cad", Amount: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gateway.ConfirmPaymentIntent(pi.ID, card.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"payment_intent":  {pi.ID},
+		"payment_method":  {card.ID},
+		"email":           {"jane@example.com"},
+		"first_name":      {"Jane"},
+		"last_name":       {"Doe"},
+		"cardholder_name": {"Jane Doe"},
+	}
+	b := &browser{app: app}
+
+	w := b.post(app.VTPaymentSucceeded, form)
+	if loc := w.Header().Get("Location"); loc != "/payment/authenticate" {
+		t.Fatalf("sent to %q (%d)", loc, w.Code)
+	}
+	if *status != models.TxnPending {
+		t.Errorf("transaction saved as %s", status.Name())
+	}
+
+	// Coming back before authenticating goes round again.
+	w = b.post(app.VTPaymentSucceeded, form)
+	if loc := w.Header().Get("Location"); loc != "/payment/authenticate" {
+		t.Fatalf("sent to %q (%d)", loc, w.Code)
+	}
+
+	_, err = gateway.AuthenticatePaymentIntent(pi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = b.post(app.VTPaymentSucceeded, form)
+	if loc := w.Header().Get("Location"); loc != "/receipt" {
+		t.Fatalf("sent to %q (%d)", loc, w.Code)
+	}
+	if *status != models.TxnCleared {
+		t.Errorf("transaction is %s", status.Name())
+	}
+	if fake.Ran("insert into transactions") != 1 {
+		t.Error("the payment was saved twice")
+	}
+	if !strings.Contains(keys["vterm-payment-succeeded:"+pi.ID], `"Pending":false`) {
+		t.Errorf("receipt not settled: %s", keys["vterm-payment-succeeded:"+pi.ID])
+	}
+}
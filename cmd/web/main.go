@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -14,6 +15,7 @@ import (
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
 	"github.com/joho/godotenv"
+	"github.com/torenware/go-stripe/internal/cards"
 	"github.com/torenware/go-stripe/internal/driver"
 	"github.com/torenware/go-stripe/internal/models"
 
@@ -29,10 +31,11 @@ var dist embed.FS
 var session *scs.SessionManager
 
 type config struct {
-	port int
-	env  string // development | production
-	api  string // base URI
-	db   struct {
+	port    int
+	env     string // development | production
+	api     string // base URI
+	gateway string // stripe | fake
+	db      struct {
 		dsn string
 	}
 	stripe struct {
@@ -54,6 +57,7 @@ type application struct {
 	DB            models.DBModel
 	Session       *scs.SessionManager
 	vueglue       *vueglue.VueGlue
+	gateway       cards.PaymentGateway
 }
 
 func (app *application) serve() error {
@@ -72,9 +76,30 @@ func (app *application) serve() error {
 
 }
 
+// newGateway returns the payment gateway the config asks for. The fake
+// keeps its cards and payments in memory, so it is for trying the site
+// out without Stripe, never for production.
+func newGateway(config config) (cards.PaymentGateway, error) {
+	switch config.gateway {
+	case "stripe":
+		return &cards.Card{
+			Secret: config.stripe.secret,
+			Key:    config.stripe.key,
+		}, nil
+	case "fake":
+		if config.env == "production" {
+			return nil, errors.New("the fake gateway cannot be used in production")
+		}
+		return cards.NewFakeGateway(), nil
+	}
+	return nil, fmt.Errorf("unknown gateway %q", config.gateway)
+}
+
 func main() {
 	// Allow us to pass our Data map used for templates into our session.
 	gob.Register(TransactionData{})
+	gob.Register(Cart{})
+	gob.Register(pendingPayment{})
 	gob.Register(templateData{})
 
 	var config config
@@ -93,6 +118,7 @@ func main() {
 	flag.IntVar(&config.port, "port", 4000, "Port number")
 	flag.StringVar(&config.env, "env", "development", "development|production")
 	flag.StringVar(&config.api, "api", "http://localhost:4001", "Base API URI")
+	flag.StringVar(&config.gateway, "gateway", "stripe", "stripe|fake")
 	// flag.StringVar(&config.db.dsn, "dsn", "", "MySQL DSN")
 
 	flag.Parse()
@@ -129,6 +155,11 @@ func main() {
 		errorLog.Fatalln("FRONT_END must be in environment")
 	}
 
+	gateway, err := newGateway(config)
+	if err != nil {
+		errorLog.Fatalln(err)
+	}
+
 	// Initialize a new session manager and configure the session lifetime.
 	session = scs.New()
 	session.Store = mysqlstore.New(conn)
@@ -143,6 +174,7 @@ func main() {
 		version:       version,
 		DB:            models.DBModel{DB: conn},
 		Session:       session,
+		gateway:       gateway,
 	}
 
 	// set up the Vue loader
@@ -3,6 +3,8 @@ package main
 import (
 	"log"
 	"net/http"
+
+	"github.com/torenware/go-stripe/internal/models"
 )
 
 // SessionLoader implements the SCS middleware.
@@ -14,6 +16,63 @@ func (app *application) AuthHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !session.Exists(r.Context(), "userID") {
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+		if app.missingSecondFactor(r) {
+			_ = session.Destroy(r.Context())
+			_ = session.RenewToken(r.Context())
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// missingSecondFactor says whether the logged in user has to use
+// two-factor login and doesn't. Turning the requirement on revokes their
+// API tokens, but our sessions are in the session store, where they can't
+// be found by user, so they are ended here instead.
+func (app *application) missingSecondFactor(r *http.Request) bool {
+	userID, _ := session.Get(r.Context(), "userID").(int)
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return false
+	}
+	if user.TOTPEnabled {
+		return false
+	}
+	required, err := app.DB.Require2FA()
+	if err != nil {
+		app.errorLog.Println(err)
+		return false
+	}
+	return required
+}
+
+// RequirePermission lets through only admin users whose role grants p.
+// It goes after AuthHandler.
+func (app *application) RequirePermission(p models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, _ := session.Get(r.Context(), "userID").(int)
+			user, err := app.DB.GetUserByID(userID)
+			if err != nil || !user.Can(p) {
+				app.infoLog.Printf("permission %s denied", p)
+				app.clientError(w, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CustomerAuth keeps out anyone who isn't logged in to a customer account.
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.customerEmail(r) == "" {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
 		}
 		next.ServeHTTP(w, r)
 	})
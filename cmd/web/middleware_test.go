@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// Once two-factor login is required, an admin without it is logged out
+// of the web app too.
+func TestAuthHandlerRequires2FA(t *testing.T) {
+	app, fake, _ := testApp(t)
+	fake.Handle("from users").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":           args[0],
+			"first_name":   "Jane",
+			"last_name":    "Doe",
+			"email":        "jane@example.com",
+			"password":     "",
+			"role_id":      int64(1),
+			"totp_enabled": false,
+			"created_at":   time.Now(),
+			"updated_at":   time.Now(),
+		})
+	}
+	required := "false"
+	fake.Handle("from settings").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"value": required})
+	}
+
+	b := &browser{app: app}
+	b.post(func(w http.ResponseWriter, r *http.Request) {
+		session.Put(r.Context(), "userID", 1)
+	}, nil)
+
+	reached := 0
+	admin := app.AuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+	}))
+	b.post(admin.ServeHTTP, nil)
+	if reached != 1 {
+		t.Fatal("a logged in admin was turned away")
+	}
+
+	required = "true"
+	w := b.post(admin.ServeHTTP, nil)
+	if reached != 1 || w.Header().Get("Location") != "/login" {
+		t.Errorf("got %d, sent to %q", w.Code, w.Header().Get("Location"))
+	}
+	b.post(admin.ServeHTTP, nil)
+	if reached != 1 {
+		t.Error("the session was not ended")
+	}
+}
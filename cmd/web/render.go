@@ -26,6 +26,14 @@ type templateData struct {
 	User            *models.User
 	API             string `json:"api,omitempty"`
 	CSSVersion      string
+	// CustomerEmail is set when a customer is logged in to their account.
+	CustomerEmail string `json:"-"`
+}
+
+// Can reports whether the signed in admin user's role grants permission p,
+// so that pages only offer what the user is allowed to do.
+func (td *templateData) Can(p string) bool {
+	return td.User != nil && td.User.Can(models.Permission(p))
 }
 
 var functions = template.FuncMap{
@@ -57,11 +65,17 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.StringMap["STRIPE_KEY"] = app.config.stripe.key
 	td.StringMap["STRIPE_SECRET"] = app.config.stripe.secret
 	td.API = app.config.api
+	if td.IntMap == nil {
+		td.IntMap = make(map[string]int)
+	}
+	td.IntMap["cart_count"] = app.getCart(r).Count()
 
 	// if app.vueglue != nil {
 	//     td.VueGlue = app.vueglue
 	// }
 
+	td.CustomerEmail = app.customerEmail(r)
+
 	if session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		userID, ok := session.Get(r.Context(), "userID").(int)
@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/torenware/go-stripe/internal/models"
 )
 
 
@@ -15,12 +17,19 @@ func (app *application) routes() http.Handler {
 	mux.Get("/", app.HomePage)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.DisplayReceipt)
+	mux.Get("/payment/authenticate", app.AuthenticatePayment)
 
 	mux.Get("/widget/{id}", app.BuyOneItem)
-	mux.Get("/test-widget", app.TestGetWidget)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.ReceiptBronze)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/cart/remove", app.RemoveFromCart)
+	mux.Post("/cart/payment-intent", app.CartPaymentIntent)
+	mux.Post("/cart/checkout", app.CartCheckout)
+
+	mux.Get("/plans/{slug}", app.PlanPage)
+	mux.Get("/receipt/subscription", app.SubscriptionReceipt)
 
 	// Authentication
 	mux.Get("/login", app.LoginPage)
@@ -29,21 +38,50 @@ func (app *application) routes() http.Handler {
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/login-link-sent", app.PasswordLinkSent)
 	mux.Get("/reset-password", app.ResetPassword)
+	mux.Get("/update-card", app.UpdateCard)
+
+	// Customer accounts, with their own passwordless login.
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Get("/login", app.AccountLogin)
+		mux.Get("/verify", app.VerifyAccountLogin)
+		mux.Get("/logout", app.AccountLogout)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.CustomerAuth)
+			mux.Get("/", app.AccountHome)
+			mux.Get("/order/{id:[0-9]+}", app.AccountOrder)
+			mux.Post("/subscription/{id:[0-9]+}/cancel", app.AccountCancelSubscription)
+			mux.Post("/subscription/{id:[0-9]+}/resume", app.AccountResumeSubscription)
+			mux.Get("/subscription/{id:[0-9]+}/update-card", app.AccountUpdateCard)
+		})
+	})
 
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.AuthHandler)
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Post("/vterm-payment-succeeded", app.VTPaymentSucceeded)
-
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
-		mux.Get("/order/{id}", app.GetSale)
-		mux.Get("/subscription/{id}", app.GetSubscription)
-
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/user/{id:[0-9]+}", app.ShowUser)
-		mux.Get("/user/{id:[0-9]+}/edit", app.EditUser)
-		mux.Get("/user/new", app.NewUserForm)
+		can := app.RequirePermission
+
+		mux.Get("/security", app.Security)
+
+		mux.With(can(models.PermVirtualTerminal)).Get("/virtual-terminal", app.VirtualTerminal)
+		mux.With(can(models.PermVirtualTerminal)).Post("/vterm-payment-succeeded", app.VTPaymentSucceeded)
+
+		mux.With(can(models.PermViewSales)).Get("/all-sales", app.AllSales)
+		mux.With(can(models.PermViewSales)).Get("/all-subscriptions", app.AllSubscriptions)
+		mux.With(can(models.PermViewSales)).Get("/order/{id}", app.GetSale)
+		mux.With(can(models.PermViewSales)).Get("/subscription/{id}", app.GetSubscription)
+
+		mux.With(can(models.PermViewUsers)).Get("/all-users", app.AllUsers)
+		mux.With(can(models.PermViewUsers)).Get("/user/{id:[0-9]+}", app.ShowUser)
+		mux.With(can(models.PermManageUsers)).Get("/user/{id:[0-9]+}/edit", app.EditUser)
+		mux.With(can(models.PermManageUsers)).Get("/user/new", app.NewUserForm)
+		mux.With(can(models.PermManageUsers)).Get("/lockouts", app.Lockouts)
+
+		mux.With(can(models.PermManageAPIKeys)).Get("/api-keys", app.APIKeys)
+
+		mux.With(can(models.PermViewWidgets)).Get("/all-widgets", app.AllWidgets)
+		mux.With(can(models.PermManageWidgets)).Get("/widget/new", app.NewWidgetForm)
+		mux.With(can(models.PermManageWidgets)).Get("/widget/{id:[0-9]+}/edit", app.EditWidget)
+		mux.With(can(models.PermManageWidgets)).Post("/widget-image", app.UploadWidgetImage)
 	})
 
 	fileServer := http.FileServer(http.Dir("./static/"))
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Largest widget image we accept.
+const maxImageSize = 5 << 20
+
+// Where widget images are served from.
+const imageDir = "./static/images"
+
+var imageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+func (app *application) AllWidgets(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-widgets", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) NewWidgetForm(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "edit-widget", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) EditWidget(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	widget, err := app.DB.GetWidget(id)
+	if err != nil {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+	data := make(map[string]interface{})
+	data["widget"] = widget
+	td := templateData{
+		Data: data,
+	}
+	if err = app.renderTemplate(w, r, "edit-widget", &td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// UploadWidgetImage saves an image for a widget under static/images, and
+// returns the file name to store on the widget. Files get a random name,
+// so uploads can't overwrite each other or escape the directory.
+func (app *application) UploadWidgetImage(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		OK      bool   `json:"ok"`
+		Message string `json:"message,omitempty"`
+		Image   string `json:"image,omitempty"`
+	}
+
+	status := http.StatusOK
+	name, err := app.saveImage(w, r)
+	if err != nil {
+		app.errorLog.Println(err)
+		status = http.StatusBadRequest
+		resp.Message = "We could not save that image"
+	} else {
+		resp.OK = true
+		resp.Image = name
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.clientError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+func (app *application) saveImage(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Trust the content, not the name or the header the browser sent.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	contentType := http.DetectContentType(head[:n])
+	ext, ok := imageTypes[contentType]
+	if !ok {
+		return "", fmt.Errorf("unsupported image type %s", contentType)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := "widget-" + hex.EncodeToString(b) + ext
+
+	out, err := os.OpenFile(filepath.Join(imageDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if _, err := out.Write(head[:n]); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, file); err != nil {
+		_ = os.Remove(out.Name())
+		return "", err
+	}
+
+	return name, nil
+}
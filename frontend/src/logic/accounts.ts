@@ -1,8 +1,25 @@
 import { JSPO } from '../types/forms';
-import { AuthReply } from '../types/accounts';
+import { AuthReply, LoginReply } from '../types/accounts';
 import { sendFlash } from '../utils/flash';
 
 export function handleLogin(form: HTMLFormElement, api: string, payload: JSPO) {
+  postJSON(`${api}/api/authenticate`, payload).then((response) => {
+    if (!response.error) {
+      if (response.totp_required) {
+        secondStep(form, api, response);
+      } else if (response.authentication_token) {
+        // showLoginSuccess();
+        console.log('should submit', response.authentication_token);
+        finishLogin(form, response);
+      }
+    } else {
+      // showLoginError(response.message);
+      console.log(response.message);
+    }
+  });
+}
+
+function postJSON(url: string, payload: JSPO): Promise<LoginReply> {
   const requestOptions = {
     method: 'post',
     headers: {
@@ -11,28 +28,57 @@ export function handleLogin(form: HTMLFormElement, api: string, payload: JSPO) {
     },
     body: JSON.stringify(payload),
   };
+  return fetch(url, requestOptions).then((response) => response.json());
+}
 
-  fetch(`${api}/api/authenticate`, requestOptions)
-    .then((response) => response.json())
-    .then((response) => {
-      if (!response.error) {
-        if (response.authentication_token) {
-          // showLoginSuccess();
-          console.log('should submit', response.authentication_token);
-          loginUserToSite(response.authentication_token);
-          // document.getElementById("login_form").submit();
-          form.submit();
-        }
-      } else {
-        // showLoginError(response.message);
-        console.log(response.message);
-      }
-    });
+// finishLogin logs in to the site as well. The site checks the token to
+// see that any second step was passed.
+function finishLogin(form: HTMLFormElement, response: LoginReply) {
+  const auth = response.authentication_token as AuthReply;
+  loginUserToSite(auth, response.refresh_token);
+  const token = document.createElement('input');
+  token.type = 'hidden';
+  token.name = 'token';
+  token.value = auth.token;
+  form.appendChild(token);
+  form.submit();
 }
 
-export function loginUserToSite(auth_obj: AuthReply) {
+// secondStep asks for a code from the user's authenticator, setting one
+// up first if they have to.
+async function secondStep(form: HTMLFormElement, api: string, response: LoginReply) {
+  const challenge = response.challenge;
+  let msg = response.message;
+  if (response.totp_setup_required) {
+    const setup = await postJSON(`${api}/api/authenticate/2fa/setup`, { challenge });
+    if (setup.error) {
+      console.log(setup.message);
+      return;
+    }
+    msg = `Add this key to your authenticator app, then enter the code it shows:\n${setup.secret}`;
+  }
+
+  const code = window.prompt(msg);
+  if (!code) {
+    return;
+  }
+  const reply = await postJSON(`${api}/api/authenticate/2fa`, { challenge, code });
+  if (reply.error) {
+    console.log(reply.message);
+    return;
+  }
+  if (reply.recovery_codes) {
+    window.alert(`Keep these recovery codes somewhere safe:\n${reply.recovery_codes.join('\n')}`);
+  }
+  finishLogin(form, reply);
+}
+
+export function loginUserToSite(auth_obj: AuthReply, refresh_obj?: AuthReply) {
   localStorage.setItem('token', auth_obj.token);
   localStorage.setItem('expiry', auth_obj.expiry);
+  if (refresh_obj) {
+    localStorage.setItem('refresh_token', refresh_obj.token);
+  }
 }
 
 export function getTokenData() {
@@ -50,6 +96,7 @@ export function getTokenData() {
 export function logoutUser() {
   localStorage.removeItem('token');
   localStorage.removeItem('expiry');
+  localStorage.removeItem('refresh_token');
   sendFlash('session expired!');
   // prevent this redirect when on dev server.
   // @ts-ignore
@@ -34,7 +34,14 @@ appMounts.forEach((mp) => {
   console.log('loading ', ep);
   if (ep && ep in keys) {
     let { app, props } = keys[ep];
-    props = props ? props : {};
+    // Other data- attributes on the mount point become props.
+    const data: Record<string, string> = {};
+    for (const [k, v] of Object.entries((mp as HTMLElement).dataset)) {
+      if (k !== 'entryp' && v !== undefined) {
+        data[k] = v;
+      }
+    }
+    props = { ...data, ...props };
     createApp(app, props).mount(mp);
   } else {
     console.log(`${ep}: key was not found.`);
@@ -5,6 +5,19 @@ export type AuthReply = {
   expiry: string;
 };
 
+// LoginReply is the API's answer to a login, or to its second step.
+export type LoginReply = {
+  error: boolean;
+  message: string;
+  authentication_token?: AuthReply;
+  refresh_token?: AuthReply;
+  totp_required?: boolean;
+  totp_setup_required?: boolean;
+  challenge?: string;
+  secret?: string;
+  recovery_codes?: string[];
+};
+
 export type PaginatedRows<T> = {
   error: boolean;
   current_page: number;
@@ -1,14 +1,24 @@
 package cards
 
 import (
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/stripe/stripe-go/v72"
 	"github.com/stripe/stripe-go/v72/customer"
+	"github.com/stripe/stripe-go/v72/invoice"
 	"github.com/stripe/stripe-go/v72/paymentintent"
 	"github.com/stripe/stripe-go/v72/paymentmethod"
+	"github.com/stripe/stripe-go/v72/price"
 	"github.com/stripe/stripe-go/v72/refund"
+	"github.com/stripe/stripe-go/v72/setupintent"
 	"github.com/stripe/stripe-go/v72/sub"
+
+	"github.com/torenware/go-stripe/internal/models"
 )
 
+// Card is the Stripe implementation of PaymentGateway.
 type Card struct {
 	Secret   string
 	Key      string
@@ -23,26 +33,119 @@ type Transaction struct {
 	BankReturnCode      string
 }
 
+// SubscriptionOrderStatus is the order status that matches a subscription's
+// state at Stripe.
+func SubscriptionOrderStatus(subscription *stripe.Subscription) models.OrderStatus {
+	switch {
+	case subscription.Status == stripe.SubscriptionStatusCanceled,
+		subscription.Status == stripe.SubscriptionStatusIncompleteExpired:
+		return models.OrderCancelled
+	case subscription.Status == stripe.SubscriptionStatusIncomplete:
+		// The first payment hasn't gone through yet.
+		return models.OrderPending
+	case subscription.CancelAtPeriodEnd:
+		return models.OrderCancelsAtPeriodEnd
+	case subscription.Status == stripe.SubscriptionStatusTrialing:
+		return models.OrderTrialing
+	case subscription.Status == stripe.SubscriptionStatusPastDue,
+		subscription.Status == stripe.SubscriptionStatusUnpaid:
+		return models.OrderPastDue
+	default:
+		return models.OrderCharged
+	}
+}
+
+// PaymentOutcome is what a payment intent's status means for the order
+// it pays for.
+type PaymentOutcome int
+
 const (
-	STATUS_CHARGED = 1
-	STATUS_REFUNDED = 2
-	STATUS_CANCELLED_SUB = 3
+	// PaymentFailed means the customer has to start again, perhaps with
+	// another card.
+	PaymentFailed PaymentOutcome = iota
+	// PaymentNeedsAction means the customer still has to confirm the
+	// payment, usually by authenticating it with their bank (3-D Secure).
+	PaymentNeedsAction
+	// PaymentPending means the payment is on its way, and a webhook will
+	// tell us how it ends.
+	PaymentPending
+	// PaymentSucceeded means we have the money.
+	PaymentSucceeded
 )
 
+// PaymentIntentOutcome sorts a payment intent's status into a
+// PaymentOutcome.
+func PaymentIntentOutcome(pi *stripe.PaymentIntent) PaymentOutcome {
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		return PaymentSucceeded
+	case stripe.PaymentIntentStatusProcessing,
+		// We don't capture separately, but if it happens the money is held.
+		stripe.PaymentIntentStatusRequiresCapture:
+		return PaymentPending
+	case stripe.PaymentIntentStatusRequiresAction,
+		stripe.PaymentIntentStatusRequiresConfirmation:
+		return PaymentNeedsAction
+	case stripe.PaymentIntentStatusRequiresPaymentMethod,
+		stripe.PaymentIntentStatusCanceled:
+		return PaymentFailed
+	default:
+		return PaymentFailed
+	}
+}
+
+// ChargeID is the ID of a payment intent's latest charge, which is what
+// the bank knows the payment by. A payment that is still pending may not
+// have one yet.
+func ChargeID(pi *stripe.PaymentIntent) string {
+	if pi.Charges == nil || len(pi.Charges.Data) == 0 {
+		return ""
+	}
+	// Stripe lists the most recent charge first.
+	return pi.Charges.Data[0].ID
+}
+
 func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+	return c.CreatePaymentIntent(PaymentIntentRequest{Currency: currency, Amount: amount})
 }
 
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
+// idempotencyKey derives the key we send to Stripe for one kind of call.
+// Stripe refuses a key that is reused for a different request, and one
+// of our requests can make several calls.
+func idempotencyKey(key, call string) *string {
+	if key == "" {
+		return nil
+	}
+	return stripe.String(key + ":" + call)
+}
+
+// CreatePaymentIntent starts a payment. If the request has an idempotency
+// key, Stripe will return the original intent for a repeated call.
+func (c *Card) CreatePaymentIntent(req PaymentIntentRequest) (*stripe.PaymentIntent, string, error) {
 	stripe.Key = c.Secret
 
 	// create a payment intent
 	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(int64(amount)),
-		Currency: stripe.String(currency),
+		Amount:   stripe.Int64(int64(req.Amount)),
+		Currency: stripe.String(req.Currency),
+	}
+	if req.Customer != "" {
+		params.Customer = stripe.String(req.Customer)
+	}
+	if req.PaymentMethod != "" {
+		params.PaymentMethod = stripe.String(req.PaymentMethod)
+	}
+	if req.SaveCard {
+		params.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession))
+	}
+	if req.OffSession {
+		params.OffSession = stripe.Bool(true)
+		params.Confirm = stripe.Bool(true)
+	}
+	params.IdempotencyKey = idempotencyKey(req.IdempotencyKey, "payment_intent")
+	for k, v := range req.Metadata {
+		params.AddMetadata(k, v)
 	}
-
-	//params.AddMetadata("key", "value")
 
 	pi, err := paymentintent.New(params)
 	if err != nil {
@@ -75,15 +178,20 @@ func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
 	return pi, nil
 }
 
-func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
+// CreateCustomer makes a new customer. With pm set, that card is attached
+// and used for their invoices.
+func (c *Card) CreateCustomer(pm, email, idemKey string) (*stripe.Customer, string, error) {
 	stripe.Key = c.Secret
 	customerParams := &stripe.CustomerParams{
-		PaymentMethod: stripe.String(pm),
-		Email:         stripe.String(email),
-		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+		Email: stripe.String(email),
+	}
+	if pm != "" {
+		customerParams.PaymentMethod = stripe.String(pm)
+		customerParams.InvoiceSettings = &stripe.CustomerInvoiceSettingsParams{
 			DefaultPaymentMethod: stripe.String(pm),
-		},
+		}
 	}
+	customerParams.IdempotencyKey = idempotencyKey(idemKey, "customer")
 	cust, err := customer.New(customerParams)
 	if err != nil {
 		msg := ""
@@ -95,19 +203,68 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 	return cust, "", nil
 }
 
+// AttachPaymentMethod gives an existing customer a new card, and makes it
+// the one their invoices are charged to.
+func (c *Card) AttachPaymentMethod(customerID, pm, idemKey string) (*stripe.Customer, string, error) {
+	stripe.Key = c.Secret
+	attachParams := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	}
+	attachParams.IdempotencyKey = idempotencyKey(idemKey, "attach")
+	_, err := paymentmethod.Attach(pm, attachParams)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
+	}
+
+	cust, err := customer.Update(customerID, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm),
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cust, "", nil
+}
+
+// SubscriptionRequest describes a new subscription. With TrialDays set,
+// the customer isn't billed until the trial ends. PaymentMethod bills one
+// of the customer's saved cards instead of their default.
+type SubscriptionRequest struct {
+	Customer       *stripe.Customer
+	Plan           string
+	PaymentMethod  string
+	LastFour       string
+	CardType       string
+	TrialDays      int
+	IdempotencyKey string
+}
+
 // SubscribeCustomer returns a subscription ID for a customer on a given plan.
-func (c *Card) SubscribeCustomer(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
-	stripeCustomerID := cust.ID
+func (c *Card) SubscribeCustomer(req SubscriptionRequest) (*stripe.Subscription, error) {
+	stripe.Key = c.Secret
+	stripeCustomerID := req.Customer.ID
 	items := []*stripe.SubscriptionItemsParams{
-		{Plan: stripe.String(plan)},
+		{Plan: stripe.String(req.Plan)},
 	}
 	params := &stripe.SubscriptionParams{
 		Customer: stripe.String(stripeCustomerID),
 		Items:    items,
 	}
-	params.AddMetadata("last_four", last4)
-	params.AddMetadata("card_type", cardType)
+	if req.TrialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(req.TrialDays))
+	}
+	if req.PaymentMethod != "" {
+		params.DefaultPaymentMethod = stripe.String(req.PaymentMethod)
+	}
+	params.AddMetadata("last_four", req.LastFour)
+	params.AddMetadata("card_type", req.CardType)
 	params.AddExpand("latest_invoice.payment_intent")
+	params.IdempotencyKey = idempotencyKey(req.IdempotencyKey, "subscription")
 	subscription, err := sub.New(params)
 	if err != nil {
 		return nil, err
@@ -115,26 +272,220 @@ func (c *Card) SubscribeCustomer(cust *stripe.Customer, plan, email, last4, card
 	return subscription, nil
 }
 
-func (c *Card) Refund(pi string, amount int) error {
+// PlanChangeRequest describes moving a subscription to another price.
+// ProrationDate pins the proration to when the change was previewed, so
+// that committing it charges what the preview showed. Zero means now.
+type PlanChangeRequest struct {
+	SubscriptionID string
+	PriceID        string
+	ProrationDate  int64
+	IdempotencyKey string
+}
+
+// PlanChangePreview is what a plan change would cost. Proration is the
+// net charge for the rest of the current period, and is negative when the
+// customer is owed a credit. NextInvoiceTotal includes the proration.
+type PlanChangePreview struct {
+	ProrationDate    int64
+	Proration        int64
+	NextInvoiceTotal int64
+	Currency         string
+}
+
+// subscriptionItem returns the single item of a subscription, which is
+// how we sell them.
+func subscriptionItem(subscription *stripe.Subscription) (*stripe.SubscriptionItem, error) {
+	if subscription.Items == nil || len(subscription.Items.Data) != 1 {
+		return nil, fmt.Errorf("subscription %s does not have exactly one item", subscription.ID)
+	}
+	return subscription.Items.Data[0], nil
+}
+
+// PreviewPlanChange works out the proration for a plan change, without
+// making it.
+func (c *Card) PreviewPlanChange(req PlanChangeRequest) (*PlanChangePreview, error) {
 	stripe.Key = c.Secret
-	amountToRefund := int64(amount)
+	subscription, err := sub.Get(req.SubscriptionID, nil)
+	if err != nil {
+		return nil, err
+	}
+	item, err := subscriptionItem(subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	prorationDate := req.ProrationDate
+	if prorationDate == 0 {
+		prorationDate = time.Now().Unix()
+	}
+	params := &stripe.InvoiceParams{
+		Customer:     stripe.String(subscription.Customer.ID),
+		Subscription: stripe.String(subscription.ID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Price: stripe.String(req.PriceID)},
+		},
+		SubscriptionProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+		SubscriptionProrationDate:     stripe.Int64(prorationDate),
+	}
+	upcoming, err := invoice.GetNext(params)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &PlanChangePreview{
+		ProrationDate:    prorationDate,
+		NextInvoiceTotal: upcoming.Total,
+		Currency:         string(upcoming.Currency),
+	}
+	if upcoming.Lines != nil {
+		for _, line := range upcoming.Lines.Data {
+			if line.Proration {
+				preview.Proration += line.Amount
+			}
+		}
+	}
+	return preview, nil
+}
+
+// ChangePlan moves a subscription to another price, prorating the rest of
+// the current period.
+func (c *Card) ChangePlan(req PlanChangeRequest) (*stripe.Subscription, error) {
+	stripe.Key = c.Secret
+	subscription, err := sub.Get(req.SubscriptionID, nil)
+	if err != nil {
+		return nil, err
+	}
+	item, err := subscriptionItem(subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Price: stripe.String(req.PriceID)},
+		},
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+	}
+	if req.ProrationDate != 0 {
+		params.ProrationDate = stripe.Int64(req.ProrationDate)
+	}
+	params.IdempotencyKey = idempotencyKey(req.IdempotencyKey, "change_plan")
+	return sub.Update(req.SubscriptionID, params)
+}
+
+// RefundRequest describes a refund against a payment intent. Reason is
+// our own note, and RefundID is the pending refund in our records; both go
+// to Stripe as metadata, so that its webhook can find the refund again.
+type RefundRequest struct {
+	PaymentIntent  string
+	Amount         int
+	Reason         string
+	RefundID       int
+	IdempotencyKey string
+}
+
+func (c *Card) Refund(req RefundRequest) (*stripe.Refund, error) {
+	stripe.Key = c.Secret
+	amountToRefund := int64(req.Amount)
 
 	refundParams := &stripe.RefundParams{
-		Amount: &amountToRefund,
-		PaymentIntent: &pi,
+		Amount:        &amountToRefund,
+		PaymentIntent: &req.PaymentIntent,
+	}
+	if req.Reason != "" {
+		refundParams.AddMetadata("reason", req.Reason)
+	}
+	if req.RefundID != 0 {
+		refundParams.AddMetadata("refund_id", strconv.Itoa(req.RefundID))
+	}
+	refundParams.IdempotencyKey = idempotencyKey(req.IdempotencyKey, "refund")
+
+	return refund.New(refundParams)
+}
+
+func (c *Card) CancelSubscription(subID string) (*stripe.Subscription, error) {
+	stripe.Key = c.Secret
+	return sub.Cancel(subID, nil)
+}
+
+// SetCancelAtPeriodEnd schedules a subscription to end when the current
+// period does, or with cancel false, takes that back.
+func (c *Card) SetCancelAtPeriodEnd(subID string, cancel bool) (*stripe.Subscription, error) {
+	stripe.Key = c.Secret
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(cancel),
+	}
+	return sub.Update(subID, params)
+}
+
+// GetPrice looks up a price (or plan) by its ID.
+func (c *Card) GetPrice(id string) (*stripe.Price, error) {
+	stripe.Key = c.Secret
+	return price.Get(id, nil)
+}
+
+// GetSubscription looks up a subscription, along with its latest invoice.
+func (c *Card) GetSubscription(subID string) (*stripe.Subscription, error) {
+	stripe.Key = c.Secret
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice")
+	return sub.Get(subID, params)
+}
+
+// CreateSetupIntent starts saving a new card for a customer without
+// charging it. The browser finishes the job with Stripe.js.
+func (c *Card) CreateSetupIntent(customerID, idemKey string) (*stripe.SetupIntent, error) {
+	stripe.Key = c.Secret
+	params := &stripe.SetupIntentParams{
+		Customer:           stripe.String(customerID),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+	}
+	params.IdempotencyKey = idempotencyKey(idemKey, "setup-intent")
+	return setupintent.New(params)
+}
+
+// RetrieveSetupIntent returns an existing setup intent using its ID.
+func (c *Card) RetrieveSetupIntent(id string) (*stripe.SetupIntent, error) {
+	stripe.Key = c.Secret
+	return setupintent.Get(id, nil)
+}
+
+// SetDefaultPaymentMethod bills a subscription, and its customer's future
+// invoices, to a different card.
+func (c *Card) SetDefaultPaymentMethod(subID, pm string) (*stripe.Subscription, error) {
+	stripe.Key = c.Secret
+	params := &stripe.SubscriptionParams{
+		DefaultPaymentMethod: stripe.String(pm),
+	}
+	params.AddExpand("latest_invoice")
+	subscription, err := sub.Update(subID, params)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err := refund.New(refundParams)
+	_, err = customer.Update(subscription.Customer.ID, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm),
+		},
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return subscription, nil
 }
 
-func (c *Card) CancelSubscription(subID string) error {
+// PayInvoice tries again to collect an open invoice.
+func (c *Card) PayInvoice(id string) (*stripe.Invoice, string, error) {
 	stripe.Key = c.Secret
-	_, err := sub.Cancel(subID, nil)
-	return err
+	inv, err := invoice.Pay(id, nil)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
+	}
+	return inv, "", nil
 }
 
 func cardErrorMessage(code stripe.ErrorCode) string {
@@ -156,6 +507,8 @@ func cardErrorMessage(code stripe.ErrorCode) string {
 		msg = "Insufficient balance"
 	case stripe.ErrorCodePostalCodeInvalid:
 		msg = "Your postal code is invalid"
+	case stripe.ErrorCodeInvoicePamentIntentRequiresAction:
+		msg = "Your bank needs you to confirm this payment"
 	default:
 		msg = "Your card was declined"
 	}
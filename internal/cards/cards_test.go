@@ -0,0 +1,68 @@
+package cards
+
+import (
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+
+	"github.com/torenware/go-stripe/internal/models"
+)
+
+func TestSubscriptionOrderStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		subscription stripe.Subscription
+		want         models.OrderStatus
+	}{
+		{"active", stripe.Subscription{Status: stripe.SubscriptionStatusActive}, models.OrderCharged},
+		{"trial", stripe.Subscription{Status: stripe.SubscriptionStatusTrialing}, models.OrderTrialing},
+		{"past due", stripe.Subscription{Status: stripe.SubscriptionStatusPastDue}, models.OrderPastDue},
+		{"unpaid", stripe.Subscription{Status: stripe.SubscriptionStatusUnpaid}, models.OrderPastDue},
+		{"cancelling", stripe.Subscription{Status: stripe.SubscriptionStatusActive, CancelAtPeriodEnd: true}, models.OrderCancelsAtPeriodEnd},
+		{"cancelling trial", stripe.Subscription{Status: stripe.SubscriptionStatusTrialing, CancelAtPeriodEnd: true}, models.OrderCancelsAtPeriodEnd},
+		{"cancelled", stripe.Subscription{Status: stripe.SubscriptionStatusCanceled, CancelAtPeriodEnd: true}, models.OrderCancelled},
+		{"never paid", stripe.Subscription{Status: stripe.SubscriptionStatusIncompleteExpired}, models.OrderCancelled},
+	}
+	for _, tt := range tests {
+		if got := SubscriptionOrderStatus(&tt.subscription); got != tt.want {
+			t.Errorf("%s: got status %s, want %s", tt.name, got.Name(), tt.want.Name())
+		}
+	}
+}
+
+// A card saved while paying can be charged again off-session, but only
+// for the customer it was saved to.
+func TestFakeSavedCard(t *testing.T) {
+	f := NewFakeGateway()
+	card := f.AddCard("visa", "4242", 12, 2030)
+	jane, _, err := f.CreateCustomer("", "jane@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := f.CreateCustomer("", "bob@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi, _, err := f.CreatePaymentIntent(PaymentIntentRequest{Currency: "cad", Amount: 1000, Customer: jane.ID, SaveCard: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ConfirmPaymentIntent(pi.ID, card.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	pi, _, err = f.CreatePaymentIntent(PaymentIntentRequest{
+		Currency: "cad", Amount: 500, Customer: jane.ID, PaymentMethod: card.ID, OffSession: true,
+	})
+	if err != nil || pi.Status != stripe.PaymentIntentStatusSucceeded {
+		t.Fatalf("off-session charge: %v, %v", pi, err)
+	}
+
+	_, _, err = f.CreatePaymentIntent(PaymentIntentRequest{
+		Currency: "cad", Amount: 500, Customer: bob.ID, PaymentMethod: card.ID, OffSession: true,
+	})
+	if err == nil {
+		t.Error("charged Jane's card to Bob")
+	}
+}
@@ -0,0 +1,867 @@
+package cards
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// FakeGateway is an in-memory PaymentGateway, so checkout flows can run
+// without Stripe credentials or a network. IDs are handed out in
+// sequence, which keeps runs repeatable.
+//
+// Payment methods have to be registered with AddCard before use, standing
+// in for Stripe.js creating them in the browser; ConfirmPaymentIntent and
+// ConfirmSetupIntent likewise stand in for the browser confirming a
+// payment or saving a card. FailRenewal plays a renewal that didn't go
+// through, and AuthenticatePaymentIntent a customer passing their bank's
+// 3-D Secure check.
+type FakeGateway struct {
+	// DeclineCode, if set, declines every charge and new customer with
+	// this card error.
+	DeclineCode stripe.ErrorCode
+	// DeclinedCards declines charges on particular payment methods.
+	DeclinedCards map[string]stripe.ErrorCode
+	// AuthenticatedCards are payment methods whose bank wants every
+	// payment authenticated. Their payments wait in requires_action, and
+	// can't be made off session.
+	AuthenticatedCards map[string]bool
+	// SubscriptionIDs are given out in order to new subscriptions. Once
+	// they run out, IDs are generated.
+	SubscriptionIDs []string
+
+	mu            sync.Mutex
+	seq           int
+	intents       map[string]*stripe.PaymentIntent
+	methods       map[string]*stripe.PaymentMethod
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	prices        map[string]*stripe.Price
+	setupIntents  map[string]*stripe.SetupIntent
+	invoices      map[string]*stripe.Invoice
+	refunds       []*stripe.Refund
+	// keyed maps idempotency keys to the IDs of what they created.
+	keyed map[string]string
+}
+
+// NewFakeGateway returns an empty fake that approves everything.
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		DeclinedCards:      make(map[string]stripe.ErrorCode),
+		AuthenticatedCards: make(map[string]bool),
+		intents:            make(map[string]*stripe.PaymentIntent),
+		methods:            make(map[string]*stripe.PaymentMethod),
+		customers:          make(map[string]*stripe.Customer),
+		subscriptions:      make(map[string]*stripe.Subscription),
+		prices:             make(map[string]*stripe.Price),
+		setupIntents:       make(map[string]*stripe.SetupIntent),
+		invoices:           make(map[string]*stripe.Invoice),
+		keyed:              make(map[string]string),
+	}
+}
+
+// nextID must be called with the lock held.
+func (f *FakeGateway) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%04d", prefix, f.seq)
+}
+
+// declined returns the card error, if any, for a payment method.
+func (f *FakeGateway) declined(pm string) stripe.ErrorCode {
+	if f.DeclineCode != "" {
+		return f.DeclineCode
+	}
+	return f.DeclinedCards[pm]
+}
+
+// seen returns the ID created earlier under an idempotency key. It must
+// be called with the lock held.
+func (f *FakeGateway) seen(idemKey, call string) (string, bool) {
+	if idemKey == "" {
+		return "", false
+	}
+	id, ok := f.keyed[idemKey+":"+call]
+	return id, ok
+}
+
+// remember must be called with the lock held.
+func (f *FakeGateway) remember(idemKey, call, id string) {
+	if idemKey != "" {
+		f.keyed[idemKey+":"+call] = id
+	}
+}
+
+func fakeCardError(code stripe.ErrorCode) (string, error) {
+	msg := cardErrorMessage(code)
+	return msg, &stripe.Error{
+		Code:           code,
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Msg:            msg,
+		Type:           stripe.ErrorTypeCard,
+	}
+}
+
+func fakeMissing(kind, id string) error {
+	return &stripe.Error{
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", kind, id),
+		Type:           stripe.ErrorTypeInvalidRequest,
+	}
+}
+
+// AddCard registers a card payment method and returns it.
+func (f *FakeGateway) AddCard(brand, last4 string, expMonth, expYear int) *stripe.PaymentMethod {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm := &stripe.PaymentMethod{
+		ID:   f.nextID("pm"),
+		Type: stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand:       stripe.PaymentMethodCardBrand(brand),
+			Last4:       last4,
+			ExpMonth:    uint64(expMonth),
+			ExpYear:     uint64(expYear),
+			Fingerprint: fmt.Sprintf("fp_%s_%s_%d%d", brand, last4, expMonth, expYear),
+		},
+	}
+	f.methods[pm.ID] = pm
+	return pm
+}
+
+// AddPrice registers a price. Recurring prices are billed monthly.
+func (f *FakeGateway) AddPrice(id string, amount int, currency string, recurring bool) *stripe.Price {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := &stripe.Price{
+		ID:         id,
+		Active:     true,
+		Currency:   stripe.Currency(currency),
+		UnitAmount: int64(amount),
+		Type:       stripe.PriceTypeOneTime,
+	}
+	if recurring {
+		p.Type = stripe.PriceTypeRecurring
+		p.Recurring = &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringIntervalMonth,
+			IntervalCount: 1,
+		}
+	}
+	f.prices[id] = p
+	return p
+}
+
+// ConfirmPaymentIntent pays an intent with a registered payment method.
+func (f *FakeGateway) ConfirmPaymentIntent(id, pm string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.intents[id]
+	if !ok {
+		return nil, fakeMissing("payment_intent", id)
+	}
+	method, ok := f.methods[pm]
+	if !ok {
+		return nil, fakeMissing("payment_method", pm)
+	}
+	return f.charge(pi, method)
+}
+
+// charge pays an intent with a payment method, or leaves it waiting for
+// the customer to authenticate. It must be called with the lock held.
+func (f *FakeGateway) charge(pi *stripe.PaymentIntent, method *stripe.PaymentMethod) (*stripe.PaymentIntent, error) {
+	pi.PaymentMethod = method
+
+	if code := f.declined(method.ID); code != "" {
+		pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		_, err := fakeCardError(code)
+		return pi, err
+	}
+
+	if f.AuthenticatedCards[method.ID] {
+		pi.Status = stripe.PaymentIntentStatusRequiresAction
+		pi.NextAction = &stripe.PaymentIntentNextAction{Type: "use_stripe_sdk"}
+		return pi, nil
+	}
+	return f.settle(pi), nil
+}
+
+// settle marks an intent paid, saving the card to the customer if the
+// intent asks for that. It must be called with the lock held.
+func (f *FakeGateway) settle(pi *stripe.PaymentIntent) *stripe.PaymentIntent {
+	method := pi.PaymentMethod
+	pi.NextAction = nil
+	if pi.SetupFutureUsage != "" && pi.Customer != nil {
+		method.Customer = pi.Customer
+	}
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.AmountReceived = pi.Amount
+	pi.Charges = &stripe.ChargeList{
+		Data: []*stripe.Charge{
+			{
+				ID:            f.nextID("ch"),
+				Amount:        pi.Amount,
+				Currency:      stripe.Currency(pi.Currency),
+				Paid:          true,
+				PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+				Status:        "succeeded",
+			},
+		},
+	}
+	return pi
+}
+
+// AuthenticatePaymentIntent completes a payment waiting on 3-D Secure, as
+// if the customer had passed their bank's check. A subscription's first
+// invoice is paid along with it.
+func (f *FakeGateway) AuthenticatePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.intents[id]
+	if !ok {
+		return nil, fakeMissing("payment_intent", id)
+	}
+	if pi.Status != stripe.PaymentIntentStatusRequiresAction {
+		return nil, &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("PaymentIntent %s has status %s", id, pi.Status),
+			Type:           stripe.ErrorTypeInvalidRequest,
+		}
+	}
+	f.settle(pi)
+
+	for _, inv := range f.invoices {
+		if inv.PaymentIntent == nil || inv.PaymentIntent.ID != id {
+			continue
+		}
+		inv.Status = stripe.InvoiceStatusPaid
+		inv.Paid = true
+		inv.AmountPaid = inv.AmountDue
+		if subscription, ok := f.subscriptions[inv.Subscription.ID]; ok {
+			subscription.Status = stripe.SubscriptionStatusActive
+		}
+	}
+	return pi, nil
+}
+
+// Refunds returns the refunds issued so far.
+func (f *FakeGateway) Refunds() []*stripe.Refund {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*stripe.Refund(nil), f.refunds...)
+}
+
+func (f *FakeGateway) CreatePaymentIntent(req PaymentIntentRequest) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.seen(req.IdempotencyKey, "payment_intent"); ok {
+		return f.intents[id], "", nil
+	}
+
+	if f.DeclineCode != "" {
+		msg, err := fakeCardError(f.DeclineCode)
+		return nil, msg, err
+	}
+
+	id := f.nextID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Amount:       int64(req.Amount),
+		Currency:     req.Currency,
+		ClientSecret: id + "_secret",
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+		Metadata:     map[string]string{},
+	}
+	if req.Customer != "" {
+		cust, ok := f.customers[req.Customer]
+		if !ok {
+			return nil, "", fakeMissing("customer", req.Customer)
+		}
+		pi.Customer = cust
+	}
+	if req.SaveCard {
+		pi.SetupFutureUsage = stripe.PaymentIntentSetupFutureUsageOffSession
+	}
+	var method *stripe.PaymentMethod
+	if req.PaymentMethod != "" {
+		var ok bool
+		method, ok = f.methods[req.PaymentMethod]
+		if !ok || method.Customer == nil || pi.Customer == nil || method.Customer.ID != pi.Customer.ID {
+			return nil, "", fakeMissing("payment_method", req.PaymentMethod)
+		}
+		pi.PaymentMethod = method
+		pi.Status = stripe.PaymentIntentStatusRequiresConfirmation
+	}
+	for k, v := range req.Metadata {
+		pi.Metadata[k] = v
+	}
+	f.intents[id] = pi
+	f.remember(req.IdempotencyKey, "payment_intent", id)
+
+	if req.OffSession && method != nil {
+		if f.AuthenticatedCards[method.ID] {
+			// Nobody is there to authenticate it.
+			pi.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+			msg, err := fakeCardError(stripe.ErrorCodeAuthenticationRequired)
+			return pi, msg, err
+		}
+		if _, err := f.charge(pi, method); err != nil {
+			return pi, cardErrorMessage(f.declined(method.ID)), err
+		}
+	}
+	return pi, "", nil
+}
+
+func (f *FakeGateway) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.intents[id]
+	if !ok {
+		return nil, fakeMissing("payment_intent", id)
+	}
+	return pi, nil
+}
+
+func (f *FakeGateway) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm, ok := f.methods[s]
+	if !ok {
+		return nil, fakeMissing("payment_method", s)
+	}
+	return pm, nil
+}
+
+func (f *FakeGateway) CreateCustomer(pm, email, idemKey string) (*stripe.Customer, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.seen(idemKey, "customer"); ok {
+		return f.customers[id], "", nil
+	}
+
+	if code := f.declined(pm); pm != "" && code != "" {
+		msg, err := fakeCardError(code)
+		return nil, msg, err
+	}
+
+	cust := &stripe.Customer{
+		ID:    f.nextID("cus"),
+		Email: email,
+	}
+	if method, ok := f.methods[pm]; ok {
+		method.Customer = cust
+		cust.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+			DefaultPaymentMethod: method,
+		}
+	}
+	f.customers[cust.ID] = cust
+	f.remember(idemKey, "customer", cust.ID)
+	return cust, "", nil
+}
+
+func (f *FakeGateway) AttachPaymentMethod(customerID, pm, idemKey string) (*stripe.Customer, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, ok := f.customers[customerID]
+	if !ok {
+		return nil, "", fakeMissing("customer", customerID)
+	}
+	if _, ok := f.seen(idemKey, "attach"); ok {
+		return cust, "", nil
+	}
+
+	method, ok := f.methods[pm]
+	if !ok {
+		return nil, "", fakeMissing("payment_method", pm)
+	}
+	if code := f.declined(pm); code != "" {
+		msg, err := fakeCardError(code)
+		return nil, msg, err
+	}
+
+	method.Customer = cust
+	cust.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+		DefaultPaymentMethod: method,
+	}
+	f.remember(idemKey, "attach", pm)
+	return cust, "", nil
+}
+
+func (f *FakeGateway) SubscribeCustomer(req SubscriptionRequest) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, plan, idemKey := req.Customer, req.Plan, req.IdempotencyKey
+	if id, ok := f.seen(idemKey, "subscription"); ok {
+		return f.subscriptions[id], nil
+	}
+
+	cust, ok := f.customers[cust.ID]
+	if !ok {
+		return nil, fakeMissing("customer", req.Customer.ID)
+	}
+	var method *stripe.PaymentMethod
+	if req.PaymentMethod != "" {
+		method, ok = f.methods[req.PaymentMethod]
+		if !ok || method.Customer == nil || method.Customer.ID != cust.ID {
+			return nil, fakeMissing("payment_method", req.PaymentMethod)
+		}
+	}
+
+	var id string
+	if len(f.SubscriptionIDs) > 0 {
+		id = f.SubscriptionIDs[0]
+		f.SubscriptionIDs = f.SubscriptionIDs[1:]
+	} else {
+		id = f.nextID("sub")
+	}
+
+	now := time.Now()
+	subscription := &stripe.Subscription{
+		ID:                 id,
+		Customer:           cust,
+		Status:             stripe.SubscriptionStatusActive,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{
+					ID:    f.nextID("si"),
+					Plan:  &stripe.Plan{ID: plan},
+					Price: f.prices[plan],
+				},
+			},
+		},
+		Metadata: map[string]string{
+			"last_four": req.LastFour,
+			"card_type": req.CardType,
+		},
+		DefaultPaymentMethod: method,
+	}
+	if req.TrialDays > 0 {
+		subscription.Status = stripe.SubscriptionStatusTrialing
+		subscription.TrialStart = now.Unix()
+		subscription.TrialEnd = now.AddDate(0, 0, req.TrialDays).Unix()
+		subscription.CurrentPeriodEnd = subscription.TrialEnd
+	} else {
+		f.firstInvoice(subscription, method)
+	}
+	f.subscriptions[id] = subscription
+	f.remember(idemKey, "subscription", id)
+	return subscription, nil
+}
+
+// firstInvoice bills a new subscription. A card the bank wants
+// authenticated, or that is declined, leaves the subscription incomplete;
+// otherwise the invoice is paid. It must be called with the lock held.
+func (f *FakeGateway) firstInvoice(subscription *stripe.Subscription, method *stripe.PaymentMethod) {
+	if method == nil {
+		if settings := subscription.Customer.InvoiceSettings; settings != nil {
+			method = settings.DefaultPaymentMethod
+		}
+	}
+	if method == nil {
+		return
+	}
+
+	price := subscription.Items.Data[0].Price
+	pi := &stripe.PaymentIntent{
+		ID:       f.nextID("pi"),
+		Customer: subscription.Customer,
+		Metadata: map[string]string{},
+	}
+	pi.ClientSecret = pi.ID + "_secret"
+	if price != nil {
+		pi.Amount = price.UnitAmount
+		pi.Currency = string(price.Currency)
+	}
+	f.intents[pi.ID] = pi
+	_, _ = f.charge(pi, method)
+
+	inv := &stripe.Invoice{
+		ID:            f.nextID("in"),
+		Customer:      subscription.Customer,
+		Subscription:  &stripe.Subscription{ID: subscription.ID},
+		Status:        stripe.InvoiceStatusOpen,
+		AmountDue:     pi.Amount,
+		Currency:      stripe.Currency(pi.Currency),
+		PaymentIntent: pi,
+		AttemptCount:  1,
+		Attempted:     true,
+	}
+	f.invoices[inv.ID] = inv
+	subscription.LatestInvoice = inv
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		subscription.Status = stripe.SubscriptionStatusIncomplete
+		return
+	}
+	inv.Status = stripe.InvoiceStatusPaid
+	inv.Paid = true
+	inv.AmountPaid = inv.AmountDue
+}
+
+func (f *FakeGateway) Refund(req RefundRequest) (*stripe.Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.seen(req.IdempotencyKey, "refund"); ok {
+		for _, r := range f.refunds {
+			if r.ID == id {
+				return r, nil
+			}
+		}
+	}
+
+	pi, amount := req.PaymentIntent, req.Amount
+
+	intent, ok := f.intents[pi]
+	if !ok {
+		return nil, fakeMissing("payment_intent", pi)
+	}
+	if intent.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("PaymentIntent %s has not been paid", pi),
+			Type:           stripe.ErrorTypeInvalidRequest,
+		}
+	}
+
+	var refunded int64
+	for _, r := range f.refunds {
+		if r.PaymentIntent != nil && r.PaymentIntent.ID == pi {
+			refunded += r.Amount
+		}
+	}
+	if refunded+int64(amount) > intent.Amount {
+		return nil, &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            "Refund amount is greater than unrefunded amount on charge",
+			Type:           stripe.ErrorTypeInvalidRequest,
+		}
+	}
+
+	refund := &stripe.Refund{
+		ID:            f.nextID("re"),
+		Amount:        int64(amount),
+		Currency:      stripe.Currency(intent.Currency),
+		PaymentIntent: &stripe.PaymentIntent{ID: pi},
+		Status:        stripe.RefundStatusSucceeded,
+		Metadata:      map[string]string{},
+	}
+	if req.Reason != "" {
+		refund.Metadata["reason"] = req.Reason
+	}
+	if req.RefundID != 0 {
+		refund.Metadata["refund_id"] = strconv.Itoa(req.RefundID)
+	}
+	f.refunds = append(f.refunds, refund)
+	f.remember(req.IdempotencyKey, "refund", refund.ID)
+	return refund, nil
+}
+
+func (f *FakeGateway) CancelSubscription(subID string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.subscriptions[subID]
+	if !ok {
+		return nil, fakeMissing("subscription", subID)
+	}
+	subscription.Status = stripe.SubscriptionStatusCanceled
+	subscription.CanceledAt = time.Now().Unix()
+	return subscription, nil
+}
+
+func (f *FakeGateway) SetCancelAtPeriodEnd(subID string, cancel bool) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.subscriptions[subID]
+	if !ok {
+		return nil, fakeMissing("subscription", subID)
+	}
+	if subscription.Status == stripe.SubscriptionStatusCanceled {
+		return nil, &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("subscription %s has been canceled", subID),
+			Type:           stripe.ErrorTypeInvalidRequest,
+		}
+	}
+	subscription.CancelAtPeriodEnd = cancel
+	return subscription, nil
+}
+
+// planChange checks a plan change and works out its proration. It must
+// be called with the lock held.
+func (f *FakeGateway) planChange(req PlanChangeRequest) (*stripe.Subscription, *stripe.Price, *PlanChangePreview, error) {
+	subscription, ok := f.subscriptions[req.SubscriptionID]
+	if !ok {
+		return nil, nil, nil, fakeMissing("subscription", req.SubscriptionID)
+	}
+	item, err := subscriptionItem(subscription)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	newPrice, ok := f.prices[req.PriceID]
+	if !ok {
+		return nil, nil, nil, fakeMissing("price", req.PriceID)
+	}
+	var oldAmount int64
+	if item.Price != nil {
+		oldAmount = item.Price.UnitAmount
+	}
+
+	prorationDate := req.ProrationDate
+	if prorationDate == 0 {
+		prorationDate = time.Now().Unix()
+	}
+	period := subscription.CurrentPeriodEnd - subscription.CurrentPeriodStart
+	left := subscription.CurrentPeriodEnd - prorationDate
+	if left < 0 {
+		left = 0
+	}
+	var proration int64
+	if period > 0 {
+		proration = (newPrice.UnitAmount - oldAmount) * left / period
+	}
+
+	return subscription, newPrice, &PlanChangePreview{
+		ProrationDate:    prorationDate,
+		Proration:        proration,
+		NextInvoiceTotal: newPrice.UnitAmount + proration,
+		Currency:         string(newPrice.Currency),
+	}, nil
+}
+
+func (f *FakeGateway) PreviewPlanChange(req PlanChangeRequest) (*PlanChangePreview, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, _, preview, err := f.planChange(req)
+	return preview, err
+}
+
+func (f *FakeGateway) ChangePlan(req PlanChangeRequest) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, newPrice, _, err := f.planChange(req)
+	if err != nil {
+		return nil, err
+	}
+	item := subscription.Items.Data[0]
+	item.Plan = &stripe.Plan{ID: newPrice.ID}
+	item.Price = newPrice
+	return subscription, nil
+}
+
+func (f *FakeGateway) GetPrice(id string) (*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.prices[id]
+	if !ok {
+		return nil, fakeMissing("price", id)
+	}
+	return p, nil
+}
+
+func (f *FakeGateway) GetSubscription(subID string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.subscriptions[subID]
+	if !ok {
+		return nil, fakeMissing("subscription", subID)
+	}
+	return subscription, nil
+}
+
+// FailRenewal bills a subscription for another period and fails to
+// collect, leaving an open invoice and the subscription past due. Calling
+// it again counts another failed attempt on the same invoice.
+func (f *FakeGateway) FailRenewal(subID string) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.subscriptions[subID]
+	if !ok {
+		return nil, fakeMissing("subscription", subID)
+	}
+	inv := subscription.LatestInvoice
+	if inv == nil || inv.Status != stripe.InvoiceStatusOpen {
+		item, err := subscriptionItem(subscription)
+		if err != nil {
+			return nil, err
+		}
+		inv = &stripe.Invoice{
+			ID:           f.nextID("in"),
+			Customer:     subscription.Customer,
+			Subscription: &stripe.Subscription{ID: subID},
+			Status:       stripe.InvoiceStatusOpen,
+		}
+		if item.Price != nil {
+			inv.AmountDue = item.Price.UnitAmount
+			inv.Currency = item.Price.Currency
+		}
+		f.invoices[inv.ID] = inv
+		subscription.LatestInvoice = inv
+	}
+	inv.AttemptCount++
+	inv.Attempted = true
+	subscription.Status = stripe.SubscriptionStatusPastDue
+	return inv, nil
+}
+
+func (f *FakeGateway) CreateSetupIntent(customerID, idemKey string) (*stripe.SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.seen(idemKey, "setup-intent"); ok {
+		return f.setupIntents[id], nil
+	}
+
+	cust, ok := f.customers[customerID]
+	if !ok {
+		return nil, fakeMissing("customer", customerID)
+	}
+	id := f.nextID("seti")
+	si := &stripe.SetupIntent{
+		ID:           id,
+		ClientSecret: id + "_secret",
+		Customer:     cust,
+		Status:       stripe.SetupIntentStatusRequiresPaymentMethod,
+	}
+	f.setupIntents[id] = si
+	f.remember(idemKey, "setup-intent", id)
+	return si, nil
+}
+
+// ConfirmSetupIntent saves a registered payment method to the setup
+// intent's customer.
+func (f *FakeGateway) ConfirmSetupIntent(id, pm string) (*stripe.SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	si, ok := f.setupIntents[id]
+	if !ok {
+		return nil, fakeMissing("setup_intent", id)
+	}
+	method, ok := f.methods[pm]
+	if !ok {
+		return nil, fakeMissing("payment_method", pm)
+	}
+	if code := f.declined(pm); code != "" {
+		_, err := fakeCardError(code)
+		return si, err
+	}
+
+	method.Customer = si.Customer
+	si.PaymentMethod = method
+	si.Status = stripe.SetupIntentStatusSucceeded
+	return si, nil
+}
+
+func (f *FakeGateway) RetrieveSetupIntent(id string) (*stripe.SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	si, ok := f.setupIntents[id]
+	if !ok {
+		return nil, fakeMissing("setup_intent", id)
+	}
+	return si, nil
+}
+
+func (f *FakeGateway) SetDefaultPaymentMethod(subID, pm string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, ok := f.subscriptions[subID]
+	if !ok {
+		return nil, fakeMissing("subscription", subID)
+	}
+	method, ok := f.methods[pm]
+	if !ok {
+		return nil, fakeMissing("payment_method", pm)
+	}
+	subscription.DefaultPaymentMethod = method
+	subscription.Customer.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+		DefaultPaymentMethod: method,
+	}
+	return subscription, nil
+}
+
+func (f *FakeGateway) PayInvoice(id string) (*stripe.Invoice, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	inv, ok := f.invoices[id]
+	if !ok {
+		return nil, "", fakeMissing("invoice", id)
+	}
+	if inv.Status != stripe.InvoiceStatusOpen {
+		return nil, "", &stripe.Error{
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("invoice %s is %s", id, inv.Status),
+			Type:           stripe.ErrorTypeInvalidRequest,
+		}
+	}
+
+	subscription := f.subscriptions[inv.Subscription.ID]
+	var pm string
+	if subscription.DefaultPaymentMethod != nil {
+		pm = subscription.DefaultPaymentMethod.ID
+	} else if settings := subscription.Customer.InvoiceSettings; settings != nil && settings.DefaultPaymentMethod != nil {
+		pm = settings.DefaultPaymentMethod.ID
+	}
+
+	inv.AttemptCount++
+	if code := f.declined(pm); code != "" {
+		msg, err := fakeCardError(code)
+		return nil, msg, err
+	}
+	if f.AuthenticatedCards[pm] {
+		pi := inv.PaymentIntent
+		if pi == nil {
+			pi = &stripe.PaymentIntent{
+				ID:       f.nextID("pi"),
+				Amount:   inv.AmountDue,
+				Currency: string(inv.Currency),
+				Customer: subscription.Customer,
+				Metadata: map[string]string{},
+			}
+			pi.ClientSecret = pi.ID + "_secret"
+			f.intents[pi.ID] = pi
+			inv.PaymentIntent = pi
+		}
+		_, _ = f.charge(pi, f.methods[pm])
+		msg := cardErrorMessage(stripe.ErrorCodeInvoicePamentIntentRequiresAction)
+		return nil, msg, &stripe.Error{
+			Code:           stripe.ErrorCodeInvoicePamentIntentRequiresAction,
+			HTTPStatusCode: http.StatusPaymentRequired,
+			Msg:            msg,
+			Type:           stripe.ErrorTypeCard,
+			PaymentIntent:  pi,
+		}
+	}
+
+	inv.Status = stripe.InvoiceStatusPaid
+	inv.Paid = true
+	inv.AmountPaid = inv.AmountDue
+	subscription.Status = stripe.SubscriptionStatusActive
+	return inv, "", nil
+}
@@ -0,0 +1,51 @@
+package cards
+
+import "github.com/stripe/stripe-go/v72"
+
+// PaymentGateway is everything the apps need from a payment processor.
+// Card talks to Stripe; FakeGateway keeps everything in memory.
+//
+// Calls that can fail because of the card itself also return a message
+// that is safe to show to the customer. Calls that create something take
+// an idempotency key, which may be empty.
+type PaymentGateway interface {
+	CreatePaymentIntent(req PaymentIntentRequest) (*stripe.PaymentIntent, string, error)
+	RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(s string) (*stripe.PaymentMethod, error)
+	CreateCustomer(pm, email, idemKey string) (*stripe.Customer, string, error)
+	AttachPaymentMethod(customerID, pm, idemKey string) (*stripe.Customer, string, error)
+	SubscribeCustomer(req SubscriptionRequest) (*stripe.Subscription, error)
+	Refund(req RefundRequest) (*stripe.Refund, error)
+	CancelSubscription(subID string) (*stripe.Subscription, error)
+	SetCancelAtPeriodEnd(subID string, cancel bool) (*stripe.Subscription, error)
+	PreviewPlanChange(req PlanChangeRequest) (*PlanChangePreview, error)
+	ChangePlan(req PlanChangeRequest) (*stripe.Subscription, error)
+	GetPrice(id string) (*stripe.Price, error)
+	GetSubscription(subID string) (*stripe.Subscription, error)
+	CreateSetupIntent(customerID, idemKey string) (*stripe.SetupIntent, error)
+	RetrieveSetupIntent(id string) (*stripe.SetupIntent, error)
+	SetDefaultPaymentMethod(subID, pm string) (*stripe.Subscription, error)
+	PayInvoice(id string) (*stripe.Invoice, string, error)
+}
+
+// PaymentIntentRequest describes a payment to start. Amount is in cents,
+// and should always be worked out on the server. Customer is the
+// gateway's customer ID, if the buyer already has one.
+//
+// PaymentMethod pays with one of the customer's saved cards. SaveCard
+// keeps the card the customer pays with for next time, and needs a
+// Customer. OffSession charges a saved card straight away, for when the
+// customer isn't there to confirm the payment themselves.
+type PaymentIntentRequest struct {
+	Currency       string
+	Amount         int
+	Customer       string
+	PaymentMethod  string
+	SaveCard       bool
+	OffSession     bool
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+var _ PaymentGateway = (*Card)(nil)
+var _ PaymentGateway = (*FakeGateway)(nil)
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Customers don't have passwords. A customer account is everything bought
+// under one email address, and they log in with a link sent there.
+
+// HasCustomerEmail reports whether anyone has bought anything using an
+// email address.
+func (m *DBModel) HasCustomerEmail(email string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	row := m.DB.QueryRowContext(ctx,
+		`select count(*) from customers where email = ?`, NormalizeEmail(email))
+	err := row.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetCustomerOrders returns the orders and subscriptions bought with an
+// email address, newest first. Only the order, its widget and its
+// transaction's currency are filled in; use GetOrder for the rest.
+func (m *DBModel) GetCustomerOrders(email string) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			o.id, o.widget_id, o.transaction_id, o.customer_id, o.status_id,
+			o.quantity, o.amount, o.reference, o.created_at,
+			w.name, w.is_recurring, t.currency
+		from
+			orders o
+			inner join customers c on (o.customer_id = c.id)
+			left join widgets w on (o.widget_id = w.id)
+			left join transactions t on (o.transaction_id = t.id)
+		where
+			c.email = ?
+		order by
+			o.created_at desc, o.id desc
+	`
+	rows, err := m.DB.QueryContext(ctx, query, NormalizeEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []*Order
+	for rows.Next() {
+		var o Order
+		err = rows.Scan(
+			&o.ID,
+			&o.WidgetID,
+			&o.TransactionID,
+			&o.CustomerID,
+			&o.StatusID,
+			&o.Quantity,
+			&o.Amount,
+			&o.Reference,
+			&o.CreatedAt,
+			&o.Widget.Name,
+			&o.Widget.IsRecurring,
+			&o.Transaction.Currency,
+		)
+		if err != nil {
+			return nil, err
+		}
+		o.Widget.ID = o.WidgetID
+		orders = append(orders, &o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, so they can be told apart from
+// bearer tokens.
+const APIKeyPrefix = "gsk_"
+
+// APIKey lets a script use the API without anyone's password. It acts as
+// the admin who made it, but only for its scopes. Only the hash of the key
+// is kept; PlainText is set just when the key is made.
+type APIKey struct {
+	ID        int          `json:"id"`
+	UserID    int          `json:"user_id"`
+	UserName  string       `json:"user_name"`
+	Name      string       `json:"name"`
+	PlainText string       `json:"key,omitempty"`
+	Prefix    string       `json:"prefix"`
+	Hash      []byte       `json:"-"`
+	Scopes    []Permission `json:"scopes"`
+	// Expiry is zero for a key that doesn't expire.
+	Expiry     time.Time `json:"expiry"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GenerateAPIKey makes a new key for userID, not yet saved.
+func GenerateAPIKey(userID int, name string, scopes []Permission, expiry time.Time) (*APIKey, error) {
+	key := APIKey{
+		UserID: userID,
+		Name:   name,
+		Scopes: scopes,
+		Expiry: expiry,
+	}
+
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	key.PlainText = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.PlainText[:len(APIKeyPrefix)+6]
+	key.Hash = CreateTokenHash(key.PlainText)
+	return &key, nil
+}
+
+func joinScopes(scopes []Permission) string {
+	names := make([]string, len(scopes))
+	for i, p := range scopes {
+		names[i] = string(p)
+	}
+	return strings.Join(names, ",")
+}
+
+func splitScopes(s string) []Permission {
+	scopes := []Permission{}
+	for _, name := range strings.Split(s, ",") {
+		if name != "" {
+			scopes = append(scopes, Permission(name))
+		}
+	}
+	return scopes
+}
+
+// InsertAPIKey saves a key, and sets its ID.
+func (m *DBModel) InsertAPIKey(key *APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		insert into api_keys
+			(user_id, name, key_prefix, key_hash, scopes, expiry,
+			 created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.Hash,
+		joinScopes(key.Scopes),
+		nullTime(key.Expiry),
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.ID = int(id)
+	return nil
+}
+
+// GetUserFromAPIKey returns the user an API key acts as, with Scopes set
+// to the key's scopes.
+func (m *DBModel) GetUserFromAPIKey(key string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var u User
+	var keyID int
+	var scopes string
+	var expiry sql.NullTime
+
+	row := m.DB.QueryRowContext(ctx, `
+		select
+			u.id, u.first_name, u.last_name,
+			u.email, u.role_id,
+			k.id, k.scopes, k.expiry
+		from users u
+		inner join api_keys k on k.user_id = u.id
+		where k.key_hash = ?`,
+		CreateTokenHash(key))
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.RoleID,
+		&keyID,
+		&scopes,
+		&expiry,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiry.Valid && expiry.Time.Before(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+	u.Scopes = splitScopes(scopes)
+
+	_, err = m.DB.ExecContext(ctx,
+		`update api_keys set last_used_at = ? where id = ?`, time.Now(), keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetAPIKeys lists every API key, newest first.
+func (m *DBModel) GetAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select
+			k.id, k.user_id, concat(u.first_name, ' ', u.last_name),
+			k.name, k.key_prefix, k.scopes, k.expiry, k.last_used_at,
+			k.created_at
+		from
+			api_keys k
+			inner join users u on (k.user_id = u.id)
+		order by
+			k.id desc
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		var expiry, lastUsed sql.NullTime
+		err = rows.Scan(
+			&k.ID,
+			&k.UserID,
+			&k.UserName,
+			&k.Name,
+			&k.Prefix,
+			&scopes,
+			&expiry,
+			&lastUsed,
+			&k.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		k.Scopes = splitScopes(scopes)
+		k.Expiry = expiry.Time
+		k.LastUsedAt = lastUsed.Time
+		keys = append(keys, &k)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey revokes an API key. It returns sql.ErrNoRows if there is
+// no such key.
+func (m *DBModel) DeleteAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from api_keys where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
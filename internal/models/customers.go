@@ -0,0 +1,260 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// A customer is one email address. Addresses are stored normalized, so
+// that a repeat buyer typing in different case finds their old record.
+
+// NormalizeEmail is the form an email address is stored and looked up in.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+const customerColumns = `
+	id, first_name, last_name, email, gateway_customer_id, created_at, updated_at
+`
+
+func scanCustomer(row rowScanner) (*Customer, error) {
+	var c Customer
+	err := row.Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.GatewayCustomerID,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// UpsertCustomer returns the id of the customer with the same email,
+// inserting them if they are new. An existing customer gets the name and
+// gateway customer ID from the latest purchase, where it has them, but
+// only if verified says the buyer is logged in as them; anyone can type
+// in an email address.
+func (tx *Tx) UpsertCustomer(customer Customer, verified bool) (int, error) {
+	customer.Email = NormalizeEmail(customer.Email)
+
+	// Locking the row, or the gap where it would go, keeps two purchases
+	// by a new customer from both inserting.
+	var id int
+	row := tx.tx.QueryRowContext(tx.ctx, `
+		select id from customers where email = ? order by id limit 1 for update
+	`, customer.Email)
+	err := row.Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return insertCustomer(tx.ctx, tx.tx, customer)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !verified {
+		return id, nil
+	}
+
+	stmt := `
+		update customers set
+			first_name = if(? = '', first_name, ?),
+			last_name = if(? = '', last_name, ?),
+			gateway_customer_id = if(? = '', gateway_customer_id, ?),
+			updated_at = ?
+		where id = ?
+	`
+	_, err = tx.tx.ExecContext(tx.ctx, stmt,
+		customer.FirstName, customer.FirstName,
+		customer.LastName, customer.LastName,
+		customer.GatewayCustomerID, customer.GatewayCustomerID,
+		time.Now(),
+		id,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetCustomer gets one customer by id.
+func (m *DBModel) GetCustomer(id int) (*Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx,
+		`select `+customerColumns+` from customers where id = ?`, id)
+	return scanCustomer(row)
+}
+
+// GetCustomerByEmail returns the customer with an email address, or nil if
+// they have never bought anything.
+func (m *DBModel) GetCustomerByEmail(email string) (*Customer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx,
+		`select `+customerColumns+` from customers where email = ? order by id limit 1`,
+		NormalizeEmail(email))
+	c, err := scanCustomer(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return c, err
+}
+
+// SetGatewayCustomerID records the gateway's customer for one of ours.
+func (m *DBModel) SetGatewayCustomerID(customerID int, gatewayID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx,
+		`update customers set gateway_customer_id = ?, updated_at = ? where id = ?`,
+		gatewayID, time.Now(), customerID)
+	return err
+}
+
+// CustomerMerge describes the duplicates of one email address folded into
+// a single customer.
+type CustomerMerge struct {
+	Email   string
+	KeptID  int
+	Merged  []int
+	Orders  int64
+	Subs    int64
+	Gateway string
+}
+
+// DuplicateCustomerEmails lists the email addresses that have more than
+// one customer row, however they were typed.
+func (m *DBModel) DuplicateCustomerEmails() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select lower(trim(email)) as normalized
+		from customers
+		group by normalized
+		having count(*) > 1
+		order by normalized
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// MergeCustomers folds every customer with an email address into the
+// oldest of them, moving their orders, subscriptions and saved cards
+// across. The customer kept takes the most recent name and gateway customer ID that
+// anyone had. Nothing is written when dryRun is set.
+func (m *DBModel) MergeCustomers(email string, dryRun bool) (*CustomerMerge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	merge := &CustomerMerge{Email: NormalizeEmail(email)}
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		rows, err := tx.tx.QueryContext(tx.ctx, `
+			select id, first_name, last_name, gateway_customer_id
+			from customers
+			where lower(trim(email)) = ?
+			order by id
+			for update
+		`, merge.Email)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var first, last string
+		for rows.Next() {
+			var id int
+			var f, l, gateway string
+			if err := rows.Scan(&id, &f, &l, &gateway); err != nil {
+				return err
+			}
+			if merge.KeptID == 0 {
+				merge.KeptID = id
+			} else {
+				merge.Merged = append(merge.Merged, id)
+			}
+			if f != "" || l != "" {
+				first, last = f, l
+			}
+			if gateway != "" {
+				merge.Gateway = gateway
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if len(merge.Merged) == 0 {
+			return nil
+		}
+
+		merged := make([]interface{}, len(merge.Merged))
+		for i, id := range merge.Merged {
+			merged[i] = id
+		}
+		in := "?" + strings.Repeat(", ?", len(merged)-1)
+
+		err = tx.tx.QueryRowContext(tx.ctx,
+			`select count(*) from orders where customer_id in (`+in+`)`, merged...).Scan(&merge.Orders)
+		if err != nil {
+			return err
+		}
+		err = tx.tx.QueryRowContext(tx.ctx,
+			`select count(*) from subscriptions where customer_id in (`+in+`)`, merged...).Scan(&merge.Subs)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+
+		for _, table := range []string{"orders", "subscriptions", "payment_methods"} {
+			_, err = tx.tx.ExecContext(tx.ctx,
+				`update `+table+` set customer_id = ?, updated_at = ? where customer_id in (`+in+`)`,
+				append([]interface{}{merge.KeptID, time.Now()}, merged...)...)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx, `delete from customers where id in (`+in+`)`, merged...)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx, `
+			update customers set
+				email = ?, first_name = ?, last_name = ?, gateway_customer_id = ?, updated_at = ?
+			where id = ?
+		`, merge.Email, first, last, merge.Gateway, time.Now(), merge.KeptID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return merge, nil
+}
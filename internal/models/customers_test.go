@@ -0,0 +1,46 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// Anyone can type in an email address, so only a verified purchase may
+// change the customer who has it.
+func TestUpsertCustomer(t *testing.T) {
+	for _, verified := range []bool{false, true} {
+		db, fake := fakedb.New(t)
+		m := DBModel{DB: db}
+
+		fake.Handle("select id from customers").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+			if args[0] != "jane@example.com" {
+				t.Errorf("looked up %v", args[0])
+			}
+			return fakedb.RowsFrom(q, map[string]driver.Value{"id": int64(4)})
+		}
+		update := fake.Handle("update customers")
+
+		var id int
+		err := m.WithTx(context.Background(), func(tx *Tx) error {
+			var err error
+			id, err = tx.UpsertCustomer(Customer{
+				FirstName:         "Mallory",
+				Email:             " Jane@Example.com",
+				GatewayCustomerID: "cus_mallory",
+			}, verified)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 4 {
+			t.Errorf("verified %t: got customer %d, want 4", verified, id)
+		}
+		if want := map[bool]int{false: 0, true: 1}[verified]; update.Calls != want {
+			t.Errorf("verified %t: updated the customer %d times, want %d", verified, update.Calls, want)
+		}
+	}
+}
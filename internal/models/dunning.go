@@ -0,0 +1,160 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DunningAttempt is a failed try at collecting a subscription renewal.
+// Stripe retries an unpaid invoice a few times, and each failure is
+// recorded here. Attempts are resolved once the subscription is paid up
+// again; NextAttemptAt and ResolvedAt are zero when they don't apply.
+type DunningAttempt struct {
+	ID            int       `json:"id"`
+	OrderID       int       `json:"order_id"`
+	InvoiceID     string    `json:"invoice_id"`
+	Attempt       int       `json:"attempt"`
+	Amount        int       `json:"amount"`
+	Currency      string    `json:"currency"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	Emailed       bool      `json:"emailed"`
+	ResolvedAt    time.Time `json:"resolved_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+const dunningColumns = `
+	id, order_id, invoice_id, attempt, amount, currency,
+	next_attempt_at, emailed, resolved_at, created_at, updated_at
+`
+
+func scanDunningAttempt(row rowScanner) (*DunningAttempt, error) {
+	var a DunningAttempt
+	var next, resolved sql.NullTime
+	err := row.Scan(
+		&a.ID,
+		&a.OrderID,
+		&a.InvoiceID,
+		&a.Attempt,
+		&a.Amount,
+		&a.Currency,
+		&next,
+		&a.Emailed,
+		&resolved,
+		&a.CreatedAt,
+		&a.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	a.NextAttemptAt = next.Time
+	a.ResolvedAt = resolved.Time
+	return &a, nil
+}
+
+// RecordFailedRenewal saves a failed renewal attempt, and returns it along
+// with how many unresolved failures the subscription has run up. Stripe
+// may tell us about the same attempt more than once; the attempt we
+// already have is returned then, so check Emailed before writing to the
+// customer again.
+func (m *DBModel) RecordFailedRenewal(attempt DunningAttempt) (*DunningAttempt, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var saved *DunningAttempt
+	var failures int
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		_, err := tx.tx.ExecContext(tx.ctx, `
+			insert ignore into dunning_attempts
+				(order_id, invoice_id, attempt, amount, currency,
+				 next_attempt_at, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`,
+			attempt.OrderID,
+			attempt.InvoiceID,
+			attempt.Attempt,
+			attempt.Amount,
+			attempt.Currency,
+			sql.NullTime{Time: attempt.NextAttemptAt, Valid: !attempt.NextAttemptAt.IsZero()},
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+
+		row := tx.tx.QueryRowContext(tx.ctx,
+			`select `+dunningColumns+` from dunning_attempts where invoice_id = ? and attempt = ?`,
+			attempt.InvoiceID, attempt.Attempt)
+		saved, err = scanDunningAttempt(row)
+		if err != nil {
+			return err
+		}
+
+		row = tx.tx.QueryRowContext(tx.ctx,
+			`select count(*) from dunning_attempts where order_id = ? and resolved_at is null`,
+			saved.OrderID)
+		return row.Scan(&failures)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return saved, failures, nil
+}
+
+// MarkDunningEmailed notes that the customer has been told about an attempt.
+func (m *DBModel) MarkDunningEmailed(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx,
+		`update dunning_attempts set emailed = 1, updated_at = ? where id = ?`,
+		time.Now(), id)
+	return err
+}
+
+// ResolveDunning closes out a subscription's failed attempts once it has
+// been paid. It returns how many were open.
+func (m *DBModel) ResolveDunning(orderID int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		update dunning_attempts
+		set resolved_at = ?, updated_at = ?
+		where order_id = ? and resolved_at is null`,
+		time.Now(), time.Now(), orderID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetDunningAttempts returns a subscription's failed renewals, oldest first.
+func (m *DBModel) GetDunningAttempts(orderID int) ([]*DunningAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx,
+		`select `+dunningColumns+` from dunning_attempts where order_id = ? order by id`,
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []*DunningAttempt
+	for rows.Next() {
+		a, err := scanDunningAttempt(rows)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
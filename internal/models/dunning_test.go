@@ -0,0 +1,61 @@
+package models
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// Stripe can tell us about an attempt twice. The second time gets the
+// attempt saved the first time, so the customer isn't emailed again.
+func TestRecordFailedRenewal(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	var saved map[string]driver.Value
+	fake.Handle("insert ignore into dunning_attempts").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if saved != nil {
+			return fakedb.Result{}, nil
+		}
+		saved = map[string]driver.Value{
+			"id":              int64(1),
+			"order_id":        args[0],
+			"invoice_id":      args[1],
+			"attempt":         args[2],
+			"amount":          args[3],
+			"currency":        args[4],
+			"next_attempt_at": args[5],
+			"emailed":         false,
+			"resolved_at":     nil,
+			"created_at":      time.Now(),
+			"updated_at":      time.Now(),
+		}
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+	fake.Handle("from dunning_attempts where invoice_id").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, saved)
+	}
+	fake.Handle("select count(*) from dunning_attempts").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"count(*)": int64(1)})
+	}
+
+	attempt := DunningAttempt{OrderID: 7, InvoiceID: "in_1", Attempt: 1, Amount: 1000, Currency: "cad"}
+	first, failures, err := m.RecordFailedRenewal(attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != 1 || first.OrderID != 7 || failures != 1 || !first.NextAttemptAt.IsZero() {
+		t.Errorf("got %+v, %d failures", first, failures)
+	}
+
+	saved["emailed"] = true
+	again, _, err := m.RecordFailedRenewal(attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID || !again.Emailed {
+		t.Errorf("got %+v the second time", again)
+	}
+}
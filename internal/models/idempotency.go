@@ -0,0 +1,148 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IdempotencyKey remembers a request that creates an order, so that a
+// repeat of the same request returns the original result. Response is
+// empty while the first request is still being worked on. RequestHash
+// identifies who made the first request, and what they asked for.
+type IdempotencyKey struct {
+	ID          int       `json:"id"`
+	Key         string    `json:"idem_key"`
+	RequestHash string    `json:"-"`
+	OrderID     int       `json:"order_id"`
+	Response    string    `json:"response"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"-"`
+}
+
+// ErrIdempotencyKeyReused is returned for a key that was first used by
+// someone else, or for a different request. The first response is not
+// theirs to see.
+var ErrIdempotencyKeyReused = errors.New("idempotency key was used for a different request")
+
+// RequestHash identifies a request made under an idempotency key: who
+// made it, and what they asked for.
+func RequestHash(caller string, request interface{}) string {
+	body, err := json.Marshal(request)
+	if err != nil {
+		// Nothing will match it, so the key can't be replayed.
+		body = []byte(err.Error())
+	}
+	h := sha256.New()
+	h.Write([]byte(caller))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ClaimIdempotencyKey records a key before the work it protects is done.
+// If the key was already claimed for the same request, it returns false
+// along with the existing record; if for another, ErrIdempotencyKeyReused.
+func (m *DBModel) ClaimIdempotencyKey(key, requestHash string) (*IdempotencyKey, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert ignore into idempotency_keys
+			(idem_key, request_hash, created_at, updated_at)
+		values (?, ?, ?, ?)
+	`
+	result, err := m.DB.ExecContext(ctx, stmt,
+		key,
+		requestHash,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	existing, err := m.GetIdempotencyKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if count == 0 && existing.RequestHash != requestHash {
+		return nil, false, ErrIdempotencyKeyReused
+	}
+
+	return existing, count > 0, nil
+}
+
+// GetIdempotencyKey looks up a key.
+func (m *DBModel) GetIdempotencyKey(key string) (*IdempotencyKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var k IdempotencyKey
+	var response sql.NullString
+
+	query := `
+		select id, idem_key, request_hash, order_id, response, created_at, updated_at
+		from idempotency_keys
+		where idem_key = ?
+	`
+	row := m.DB.QueryRowContext(ctx, query, key)
+	err := row.Scan(
+		&k.ID,
+		&k.Key,
+		&k.RequestHash,
+		&k.OrderID,
+		&response,
+		&k.CreatedAt,
+		&k.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	k.Response = response.String
+
+	return &k, nil
+}
+
+// CompleteIdempotencyKey saves the result of a request, which repeats of
+// the request will be given.
+func (m *DBModel) CompleteIdempotencyKey(key string, orderID int, response string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update idempotency_keys
+		set order_id = ?, response = ?, updated_at = ?
+		where idem_key = ?
+	`
+	_, err := m.DB.ExecContext(ctx, stmt, orderID, response, time.Now(), key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey gives up a claimed key after a failed request, so
+// that the request can be tried again.
+func (m *DBModel) ReleaseIdempotencyKey(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `delete from idempotency_keys where idem_key = ? and response is null`
+	_, err := m.DB.ExecContext(ctx, stmt, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
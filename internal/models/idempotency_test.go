@@ -0,0 +1,60 @@
+package models
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// The first claim of a key wins; a repeat gets the first one's record,
+// with its response once there is one. A different request under the key
+// gets nothing.
+func TestClaimIdempotencyKey(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	hash := ""
+	fake.Handle("insert ignore into idempotency_keys").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if hash != "" {
+			return fakedb.Result{}, nil
+		}
+		hash = args[1].(string)
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+	var response driver.Value
+	fake.Handle("from idempotency_keys").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":           int64(1),
+			"idem_key":     args[0],
+			"request_hash": hash,
+			"order_id":     int64(0),
+			"response":     response,
+			"created_at":   time.Now(),
+			"updated_at":   time.Now(),
+		})
+	}
+
+	request := map[string]int{"widget_id": 1, "quantity": 2}
+	k, isNew, err := m.ClaimIdempotencyKey("widget:abc", RequestHash("user:1", request))
+	if err != nil || !isNew || k.Response != "" {
+		t.Fatalf("first claim: got %+v, %v, %v", k, isNew, err)
+	}
+
+	response = `{"ok":true}`
+	k, isNew, err = m.ClaimIdempotencyKey("widget:abc", RequestHash("user:1", request))
+	if err != nil || isNew || k.Response != `{"ok":true}` {
+		t.Fatalf("repeat claim: got %+v, %v, %v", k, isNew, err)
+	}
+
+	k, _, err = m.ClaimIdempotencyKey("widget:abc", RequestHash("user:2", request))
+	if err != ErrIdempotencyKeyReused || k != nil {
+		t.Errorf("another user's claim: got %+v, %v", k, err)
+	}
+	request["quantity"] = 3
+	k, _, err = m.ClaimIdempotencyKey("widget:abc", RequestHash("user:1", request))
+	if err != ErrIdempotencyKeyReused || k != nil {
+		t.Errorf("a different request: got %+v, %v", k, err)
+	}
+}
@@ -0,0 +1,363 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrOutOfStock is returned when there aren't enough of a widget left.
+var ErrOutOfStock = errors.New("out of stock")
+
+// PendingPaymentHold is how long stock is held for an order whose payment
+// is still pending, such as one waiting on 3-D Secure. A customer who
+// abandons the bank's check never tells us so, and the stock goes back
+// when the hold runs out.
+const PendingPaymentHold = time.Hour
+
+// OutOfStockError says which widget ran out. It matches ErrOutOfStock
+// with errors.Is.
+type OutOfStockError struct {
+	WidgetID  int
+	Name      string
+	Available int
+}
+
+func (e *OutOfStockError) Error() string {
+	if e.Available <= 0 {
+		return fmt.Sprintf("%s is out of stock", e.Name)
+	}
+	return fmt.Sprintf("only %d of %s left in stock", e.Available, e.Name)
+}
+
+func (e *OutOfStockError) Is(target error) bool {
+	return target == ErrOutOfStock
+}
+
+// InventoryReservation holds stock for a payment that is in progress.
+// Reservations are made under an order reference, since the order does
+// not exist until the payment goes through.
+type InventoryReservation struct {
+	ID        int       `json:"id"`
+	Reference string    `json:"reference"`
+	WidgetID  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// available returns how many of a widget can still be sold, allowing for
+// unexpired reservations other than the one under reference. The widget
+// row is locked until the transaction ends, so two checkouts can't both
+// take the last one.
+func (tx *Tx) available(widgetID int, reference string) (int, *Widget, error) {
+	var w Widget
+	row := tx.tx.QueryRowContext(tx.ctx, `
+		select id, name, inventory_level, is_recurring
+		from widgets
+		where id = ?
+		for update`, widgetID)
+	err := row.Scan(&w.ID, &w.Name, &w.InventoryLevel, &w.IsRecurring)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var reserved int
+	row = tx.tx.QueryRowContext(tx.ctx, `
+		select coalesce(sum(quantity), 0)
+		from inventory_reservations
+		where widget_id = ? and expires_at > ? and reference <> ?`,
+		widgetID, time.Now(), reference)
+	err = row.Scan(&reserved)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return w.InventoryLevel - reserved, &w, nil
+}
+
+// AvailableInventory returns how many of a widget can be sold right now.
+// Subscriptions don't use stock, and always have some.
+func (m *DBModel) AvailableInventory(widgetID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		n, w, err := tx.available(widgetID, "")
+		if err != nil {
+			return err
+		}
+		if w.IsRecurring {
+			n = w.InventoryLevel
+		}
+		count = n
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// ReserveInventory holds stock for the items of a checkout until it
+// expires or is released. Any earlier reservation under the same
+// reference is replaced. If anything is short, nothing is reserved and
+// the error is an *OutOfStockError.
+func (m *DBModel) ReserveInventory(reference string, ttl time.Duration, items []OrderItem) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		return tx.reserve(reference, ttl, items)
+	})
+}
+
+func (tx *Tx) reserve(reference string, ttl time.Duration, items []OrderItem) error {
+	_, err := tx.tx.ExecContext(tx.ctx,
+		`delete from inventory_reservations where reference = ? or expires_at <= ?`,
+		reference, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		n, w, err := tx.available(item.WidgetID, reference)
+		if err != nil {
+			return err
+		}
+		if w.IsRecurring {
+			continue
+		}
+		if n < item.Quantity {
+			return &OutOfStockError{WidgetID: w.ID, Name: w.Name, Available: n}
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx, `
+			insert into inventory_reservations
+				(reference, widget_id, quantity, expires_at, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?)`,
+			reference,
+			item.WidgetID,
+			item.Quantity,
+			time.Now().Add(ttl),
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseInventory gives up the stock held under a reference.
+func (m *DBModel) ReleaseInventory(reference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `delete from inventory_reservations where reference = ?`
+	_, err := m.DB.ExecContext(ctx, stmt, reference)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// takeInventory takes the items of an order out of stock, and clears any
+// reservation that was holding them.
+func (tx *Tx) takeInventory(reference string, items []OrderItem) error {
+	for _, item := range items {
+		n, w, err := tx.available(item.WidgetID, reference)
+		if err != nil {
+			return err
+		}
+		if w.IsRecurring {
+			continue
+		}
+		if n < item.Quantity {
+			return &OutOfStockError{WidgetID: w.ID, Name: w.Name, Available: n}
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx,
+			`update widgets set inventory_level = inventory_level - ?, updated_at = ? where id = ?`,
+			item.Quantity, time.Now(), item.WidgetID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if reference == "" {
+		return nil
+	}
+	_, err := tx.tx.ExecContext(tx.ctx, `delete from inventory_reservations where reference = ?`, reference)
+	return err
+}
+
+// MarkOrderRefunded sets an order's status to refunded and puts its items
+// back in stock. It does nothing to an order that is already refunded, so
+// it is safe to call again when Stripe tells us about a refund we made.
+// It returns whether the order changed.
+func (m *DBModel) MarkOrderRefunded(orderID int, event OrderEvent) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	changed := false
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		var err error
+		changed, err = tx.markRefunded(orderID, event)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return changed, nil
+}
+
+func (tx *Tx) markRefunded(orderID int, event OrderEvent) (bool, error) {
+	changed, err := tx.setOrderStatus(orderID, OrderRefunded, event)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	err = tx.restock(orderID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ClearPendingPayment records that a payment saved while it was pending
+// has gone through. The transaction clears, with the charge's bank return
+// code, and a pending order is charged and takes the stock held for it.
+// orderID is 0 for a payment with no order. Stripe's webhook for the
+// payment may get here first, so an order already charged is left alone.
+func (m *DBModel) ClearPendingPayment(txnID, orderID int, bankReturnCode string, event OrderEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		_, err := tx.setTxnStatus(txnID, TxnCleared)
+		if err != nil {
+			return err
+		}
+		if bankReturnCode != "" {
+			_, err = tx.tx.ExecContext(tx.ctx, `
+				update transactions set bank_return_code = ?, updated_at = ?
+				where id = ? and bank_return_code = ''`,
+				bankReturnCode, time.Now(), txnID)
+			if err != nil {
+				return err
+			}
+		}
+
+		if orderID == 0 {
+			return nil
+		}
+		status, err := tx.orderStatus(orderID)
+		if err != nil || status != OrderPending {
+			return err
+		}
+		_, err = tx.setOrderStatus(orderID, OrderCharged, event)
+		if err != nil {
+			return err
+		}
+		return tx.unstock(orderID)
+	})
+}
+
+// MarkOrderPaymentFailed records that the payment for a pending order
+// didn't go through after all. The order's transaction is declined, and
+// the stock held for it is let go. Orders that aren't pending are left
+// alone, and it returns whether the order changed.
+func (m *DBModel) MarkOrderPaymentFailed(orderID int, event OrderEvent) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	changed := false
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		status, err := tx.orderStatus(orderID)
+		if err != nil || status != OrderPending {
+			return err
+		}
+		_, err = tx.setOrderStatus(orderID, OrderPaymentFailed, event)
+		if err != nil {
+			return err
+		}
+		changed = true
+
+		var txnID int
+		row := tx.tx.QueryRowContext(tx.ctx,
+			`select transaction_id from orders where id = ?`, orderID)
+		err = row.Scan(&txnID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.setTxnStatus(txnID, TxnDeclined)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx, `
+			delete r from inventory_reservations r
+				join orders o on (o.reference = r.reference)
+			where o.id = ?`, orderID)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return changed, nil
+}
+
+// unstock takes the items of an order that was pending out of stock, now
+// that it has been paid for, and lets go of the hold on them. The stock
+// is taken even if the hold ran out and someone else has had it since;
+// the customer has paid.
+func (tx *Tx) unstock(orderID int) error {
+	_, err := tx.tx.ExecContext(tx.ctx, `
+		update widgets w
+			join (
+				select widget_id, sum(quantity) as quantity
+				from order_items
+				where order_id = ?
+				group by widget_id
+			) i on (i.widget_id = w.id)
+		set w.inventory_level = w.inventory_level - i.quantity, w.updated_at = ?
+		where w.is_recurring = 0`,
+		orderID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.tx.ExecContext(tx.ctx, `
+		delete r from inventory_reservations r
+			join orders o on (o.reference = r.reference)
+		where o.id = ?`, orderID)
+	return err
+}
+
+// restock puts an order's items back in stock. The lines are summed per
+// widget first, since a multi-table update only changes each widget once
+// however many of the order's lines it joins to.
+func (tx *Tx) restock(orderID int) error {
+	_, err := tx.tx.ExecContext(tx.ctx, `
+		update widgets w
+			join (
+				select widget_id, sum(quantity) as quantity
+				from order_items
+				where order_id = ?
+				group by widget_id
+			) i on (i.widget_id = w.id)
+		set w.inventory_level = w.inventory_level + i.quantity, w.updated_at = ?
+		where w.is_recurring = 0`,
+		orderID, time.Now())
+	return err
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// A refund puts back every line of the order, with an order that has two
+// lines for one widget counted twice. An order already refunded is left
+// alone.
+func TestMarkOrderRefunded(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	status := OrderCharged
+	fake.Handle("select status_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status_id": int64(status)})
+	}
+	fake.Handle("update orders set status_id")
+	fake.Handle("insert into order_events")
+	restocked := fake.Handle("update widgets w join")
+	restocked.Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if !strings.Contains(q, "sum(quantity)") || args[0] != int64(7) {
+			t.Errorf("restocked with %q %v", q, args)
+		}
+		return fakedb.Result{Affected: 1}, nil
+	}
+
+	changed, err := m.MarkOrderRefunded(7, OrderEvent{})
+	if err != nil || !changed || restocked.Calls != 1 {
+		t.Fatalf("got %v, %v, restocked %d times", changed, err, restocked.Calls)
+	}
+
+	status = OrderRefunded
+	changed, err = m.MarkOrderRefunded(7, OrderEvent{})
+	if err != nil || changed || restocked.Calls != 1 {
+		t.Errorf("again: got %v, %v, restocked %d times", changed, err, restocked.Calls)
+	}
+}
+
+// A payment the customer authenticated clears its transaction and charges
+// its pending order, through the state machine. Only then is the stock
+// held for the order taken.
+func TestClearPendingPayment(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	fake.Handle("select transaction_status_id from transactions").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"transaction_status_id": int64(TxnPending)})
+	}
+	txnStatus := fake.Handle("update transactions set transaction_status_id")
+	fake.Handle("insert into transaction_status_changes")
+	bankCode := fake.Handle("update transactions set bank_return_code")
+	fake.Handle("select status_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status_id": int64(OrderPending)})
+	}
+	orderStatus := fake.Handle("update orders set status_id")
+	orderStatus.Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if args[0] != int64(OrderCharged) {
+			t.Errorf("order went to %v", args[0])
+		}
+		return fakedb.Result{Affected: 1}, nil
+	}
+	fake.Handle("insert into order_events")
+	taken := fake.Handle("update widgets w join")
+	released := fake.Handle("delete r from inventory_reservations")
+
+	err := m.ClearPendingPayment(3, 7, "ch_1", OrderEvent{GatewayReference: "pi_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txnStatus.Calls != 1 || bankCode.Calls != 1 || orderStatus.Calls != 1 {
+		t.Errorf("transaction moved %d times, bank code set %d times, order moved %d times",
+			txnStatus.Calls, bankCode.Calls, orderStatus.Calls)
+	}
+	if taken.Calls != 1 || released.Calls != 1 {
+		t.Errorf("stock taken %d times, hold released %d times", taken.Calls, released.Calls)
+	}
+}
+
+// A pending payment that fails lets go of the stock held for its order,
+// which was never taken, so there is nothing to put back.
+func TestMarkOrderPaymentFailed(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	fake.Handle("select status_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status_id": int64(OrderPending)})
+	}
+	fake.Handle("update orders set status_id")
+	fake.Handle("insert into order_events")
+	fake.Handle("select transaction_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"transaction_id": int64(3)})
+	}
+	fake.Handle("select transaction_status_id from transactions").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"transaction_status_id": int64(TxnPending)})
+	}
+	fake.Handle("update transactions set transaction_status_id")
+	fake.Handle("insert into transaction_status_changes")
+	released := fake.Handle("delete r from inventory_reservations")
+
+	changed, err := m.MarkOrderPaymentFailed(7, OrderEvent{Reason: "payment failed"})
+	if err != nil || !changed {
+		t.Fatalf("got %v, %v", changed, err)
+	}
+	if released.Calls != 1 {
+		t.Errorf("hold released %d times", released.Calls)
+	}
+	if fake.Ran("update widgets") != 0 {
+		t.Error("stock was put back that was never taken")
+	}
+}
+
+// inventoryDB fakes widgets with stock on hand, of which reserved are held
+// by other checkouts.
+func inventoryDB(t *testing.T, stock, reserved map[int64]int64) (DBModel, *fakedb.Handler) {
+	db, fake := fakedb.New(t)
+	fake.Handle("delete from inventory_reservations")
+	fake.Handle("from widgets").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		id := args[0].(int64)
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":              id,
+			"name":            "Widget",
+			"inventory_level": stock[id],
+			"is_recurring":    false,
+		})
+	}
+	fake.Handle("from inventory_reservations").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"coalesce(sum(quantity), 0)": reserved[args[0].(int64)],
+		})
+	}
+	return DBModel{DB: db}, fake.Handle("insert into inventory_reservations")
+}
+
+// Stock held by other checkouts can't be reserved again.
+func TestReserveInventory(t *testing.T) {
+	m, inserts := inventoryDB(t, map[int64]int64{1: 5, 2: 3}, map[int64]int64{2: 2})
+
+	err := m.ReserveInventory("ORD-1", 15*time.Minute, []OrderItem{
+		{WidgetID: 1, Quantity: 5},
+		{WidgetID: 2, Quantity: 2},
+	})
+	var short *OutOfStockError
+	if !errors.Is(err, ErrOutOfStock) || !errors.As(err, &short) || short.WidgetID != 2 || short.Available != 1 {
+		t.Fatalf("got %v", err)
+	}
+
+	inserts.Calls = 0
+	err = m.ReserveInventory("ORD-1", 15*time.Minute, []OrderItem{
+		{WidgetID: 1, Quantity: 5},
+		{WidgetID: 2, Quantity: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserts.Calls != 2 {
+		t.Errorf("reserved %d times", inserts.Calls)
+	}
+}
@@ -2,7 +2,9 @@ package models
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base32"
 	"strings"
 	"time"
 
@@ -35,38 +37,52 @@ type Widget struct {
 	Price          int       `json:"price"`
 	IsRecurring    bool      `json:"is_recurring"`
 	PlanID         string    `json:"plan_id"`
+	Currency       string    `json:"currency"`
 	Image          string    `json:"image"`
+	IsArchived     bool      `json:"is_archived"`
+	Slug           string    `json:"slug"`
+	TrialDays      int       `json:"trial_days"`
 	CreatedAt      time.Time `json:"-"`
 	UpdatedAt      time.Time `json:"-"`
 }
 
 // Order is the type for all orders
 type Order struct {
-	ID            int         `json:"id"`
-	WidgetID      int         `json:"widget_id"`
-	TransactionID int         `json:"transaction_id"`
-	CustomerID    int         `json:"customer_id"`
-	StatusID      int         `json:"status_id"`
-	Quantity      int         `json:"quantity"`
-	Amount        int         `json:"amount"`
-	CreatedAt     time.Time   `json:"created_at"`
-	UpdatedAt     time.Time   `json:"-"`
-	Widget        Widget      `json:"widget"`
-	Transaction   Transaction `json:"transaction"`
-	Customer      Customer    `json:"customer"`
+	ID            int           `json:"id"`
+	WidgetID      int           `json:"widget_id"`
+	TransactionID int           `json:"transaction_id"`
+	CustomerID    int           `json:"customer_id"`
+	StatusID      OrderStatus   `json:"status_id"`
+	Quantity      int           `json:"quantity"`
+	Amount        int           `json:"amount"`
+	Reference     string        `json:"reference"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"-"`
+	Widget        Widget        `json:"widget"`
+	Transaction   Transaction   `json:"transaction"`
+	Customer      Customer      `json:"customer"`
+	Items         []OrderItem   `json:"items,omitempty"`
+	Refunds       []*Refund     `json:"refunds,omitempty"`
+	PlanChanges   []*PlanChange `json:"plan_changes,omitempty"`
+	// Subscription is the gateway subscription, for subscription orders.
+	Subscription *Subscription `json:"subscription,omitempty"`
+	// DunningAttempts are failed renewals, for subscriptions.
+	DunningAttempts []*DunningAttempt `json:"dunning_attempts,omitempty"`
+	// RefundedAmount is the sum of Refunds, less any that failed.
+	RefundedAmount int `json:"refunded_amount"`
 }
 
 // Status is the type for order statuses
 type Status struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID        OrderStatus `json:"id"`
+	Name      string      `json:"name"`
+	CreatedAt time.Time   `json:"-"`
+	UpdatedAt time.Time   `json:"-"`
 }
 
 // TransactionStatus is the type for transaction statuses
 type TransactionStatus struct {
-	ID        int       `json:"id"`
+	ID        TxnStatus `json:"id"`
 	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
@@ -83,7 +99,7 @@ type Transaction struct {
 	BankReturnCode      string    `json:"bank_return_code"`
 	PaymentIntent       string    `json:"payment_intent"`
 	PaymentMethod       string    `json:"payment_method"`
-	TransactionStatusID int       `json:"transaction_status_id"`
+	TransactionStatusID TxnStatus `json:"transaction_status_id"`
 	CreatedAt           time.Time `json:"-"`
 	UpdatedAt           time.Time `json:"-"`
 }
@@ -95,8 +111,14 @@ type User struct {
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
 	Password  string    `json:"password"`
+	RoleID    Role      `json:"role_id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// TOTPEnabled is true once the user has set up two-factor login.
+	TOTPEnabled bool `json:"totp_enabled"`
+	// Scopes limits what the user may do when they come in with an API
+	// key. It is nil otherwise.
+	Scopes []Permission `json:"-"`
 }
 
 // Customer is the type for users
@@ -107,6 +129,9 @@ type Customer struct {
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
+	// GatewayCustomerID is the payment gateway's customer, once they have
+	// subscribed or saved a card.
+	GatewayCustomerID string `json:"gateway_customer_id,omitempty"`
 }
 
 // GetWidget gets one widget by id
@@ -116,26 +141,8 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 
 	var widget Widget
 
-	row := m.DB.QueryRowContext(ctx, `
-		select
-			id, name, description, inventory_level, price, coalesce(image, ''),
-			is_recurring, plan_id,
-			created_at, updated_at
-		from
-			widgets
-		where id = ?`, id)
-	err := row.Scan(
-		&widget.ID,
-		&widget.Name,
-		&widget.Description,
-		&widget.InventoryLevel,
-		&widget.Price,
-		&widget.Image,
-		&widget.IsRecurring,
-		&widget.PlanID,
-		&widget.CreatedAt,
-		&widget.UpdatedAt,
-	)
+	row := m.DB.QueryRowContext(ctx, `select `+widgetColumns+` from widgets where id = ?`, id)
+	err := scanWidget(row, &widget)
 	if err != nil {
 		return widget, err
 	}
@@ -148,6 +155,10 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertTransaction(ctx, m.DB, txn)
+}
+
+func insertTransaction(ctx context.Context, db execer, txn Transaction) (int, error) {
 	stmt := `
 		insert into transactions
 			(amount, currency, last_four, bank_return_code,
@@ -158,7 +169,7 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		txn.Amount,
 		txn.Currency,
 		txn.LastFour,
@@ -180,6 +191,11 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 		return 0, err
 	}
 
+	err = recordTxnStatus(ctx, db, int(id), 0, txn.TransactionStatusID)
+	if err != nil {
+		return 0, err
+	}
+
 	return int(id), nil
 }
 
@@ -188,20 +204,25 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertOrder(ctx, m.DB, order)
+}
+
+func insertOrder(ctx context.Context, db execer, order Order) (int, error) {
 	stmt := `
 		insert into orders
 			(amount, quantity, widget_id, transaction_id,
-			 status_id, customer_id, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?, ?, ?)
+			 status_id, customer_id, reference, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		order.Amount,
 		order.Quantity,
 		order.WidgetID,
 		order.TransactionID,
 		order.StatusID,
 		order.CustomerID,
+		order.Reference,
 		time.Now(),
 		time.Now(),
 	)
@@ -214,6 +235,15 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 		return 0, err
 	}
 
+	err = insertOrderEvent(ctx, db, OrderEvent{
+		OrderID:    int(id),
+		Kind:       EventCreated,
+		ToStatusID: order.StatusID,
+	})
+	if err != nil {
+		return 0, err
+	}
+
 	return int(id), nil
 }
 
@@ -222,17 +252,22 @@ func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertCustomer(ctx, m.DB, customer)
+}
+
+func insertCustomer(ctx context.Context, db execer, customer Customer) (int, error) {
 	stmt := `
 		insert into customers
-			(first_name, last_name, email,
+			(first_name, last_name, email, gateway_customer_id,
 			 created_at, updated_at)
-		values (?, ?, ?, ?, ?)
+		values (?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		customer.FirstName,
 		customer.LastName,
-		customer.Email,
+		NormalizeEmail(customer.Email),
+		customer.GatewayCustomerID,
 		time.Now(),
 		time.Now(),
 	)
@@ -254,7 +289,7 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 
 	stmt := `
 select
-    id, first_name, last_name, email, created_at, updated_at
+    id, first_name, last_name, email, role_id, created_at, updated_at
 
 from users
 order by
@@ -275,6 +310,7 @@ order by
 			&u.FirstName,
 			&u.LastName,
 			&u.Email,
+			&u.RoleID,
 			&u.CreatedAt,
 			&u.UpdatedAt,
 		)
@@ -295,7 +331,8 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 	var u User
 	row := m.DB.QueryRowContext(ctx, `
 		select
-			id, first_name, last_name, email, password
+			id, first_name, last_name, email, password, role_id,
+			totp_enabled
 		from users
 		where email = ?
 	`, strings.ToLower(email))
@@ -305,6 +342,8 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 		&u.LastName,
 		&u.Email,
 		&u.Password,
+		&u.RoleID,
+		&u.TOTPEnabled,
 	)
 	if err != nil {
 		return u, err
@@ -319,8 +358,8 @@ func (m *DBModel) GetUserByID(id int) (*User, error) {
 	var u User
 	row := m.DB.QueryRowContext(ctx, `
 		select
-			id, first_name, last_name, email, password,
-		    created_at, updated_at
+			id, first_name, last_name, email, password, role_id,
+		    totp_enabled, created_at, updated_at
 		from users
 		where id = ?
 	`, id)
@@ -330,6 +369,8 @@ func (m *DBModel) GetUserByID(id int) (*User, error) {
 		&u.LastName,
 		&u.Email,
 		&u.Password,
+		&u.RoleID,
+		&u.TOTPEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -339,14 +380,20 @@ func (m *DBModel) GetUserByID(id int) (*User, error) {
 	return &u, nil
 }
 
+// InsertUser inserts a new user, and returns its id. Users get the viewer
+// role unless they are given another.
 func (m *DBModel) InsertUser(user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	if user.RoleID == 0 {
+		user.RoleID = RoleViewer
+	}
+
 	stmt := `
 		insert into users
-			(first_name, last_name, email, password, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?)
+			(first_name, last_name, email, password, role_id, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
 	`
 
 	result, err := m.DB.ExecContext(ctx, stmt,
@@ -354,6 +401,7 @@ func (m *DBModel) InsertUser(user User) (int, error) {
 		user.LastName,
 		user.Email,
 		user.Password,
+		user.RoleID,
 		time.Now(),
 		time.Now(),
 	)
@@ -369,38 +417,50 @@ func (m *DBModel) InsertUser(user User) (int, error) {
 	return int(id), nil
 }
 
+// EditUser saves a user's name, email and role. A RoleID of 0 leaves the
+// role alone. It returns ErrLastOwner rather than demote the only owner.
 func (m *DBModel) EditUser(u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `
+	return m.WithTx(ctx, func(tx *Tx) error {
+		if u.RoleID != 0 && u.RoleID != RoleOwner {
+			err := tx.checkOwnersLeft(u.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		stmt := `
 update users
 set
 	first_name = ?,
 	last_name = ?,
 	email = ?,
+	role_id = if(? = 0, role_id, ?),
     updated_at = now()
 where id = ?
 `
-	_, err := m.DB.ExecContext(ctx, stmt, u.FirstName, u.LastName, u.Email, u.ID)
-	if err != nil {
+		_, err := tx.tx.ExecContext(tx.ctx, stmt, u.FirstName, u.LastName, u.Email, u.RoleID, u.RoleID, u.ID)
 		return err
-	}
-
-	return nil
+	})
 }
 
+// DeleteUser removes a user. It returns ErrLastOwner rather than delete
+// the only owner.
 func (m *DBModel) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `delete from users where id = ?`
-	_, err := m.DB.ExecContext(ctx, stmt, id)
-	if err != nil {
-		return err
-	}
+	return m.WithTx(ctx, func(tx *Tx) error {
+		err := tx.checkOwnersLeft(id)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		_, err = tx.tx.ExecContext(tx.ctx, `delete from users where id = ?`, id)
+		return err
+	})
 }
 
 func (m *DBModel) Authenticate(email, password string) (int, error) {
@@ -468,7 +528,7 @@ func (m *DBModel) GetPaginatedOrders(isRecurring bool, pageSize, page int) ([]*O
 select
     o.amount, o.quantity, w.price, t.currency,
     o.id as order_id, o.widget_id, o.transaction_id,o.customer_id,
-    o.created_at,  o.status_id,
+    o.created_at,  o.status_id, o.reference,
     w.name as item, w.description,
     t.last_four, t.expiry_month, t.expiry_year,
     t.payment_intent, t.bank_return_code,
@@ -514,6 +574,7 @@ limit ? offset ?
 			&o.CustomerID,
 			&o.CreatedAt,
 			&o.StatusID,
+			&o.Reference,
 			&o.Widget.Name,
 			&o.Widget.Description,
 			&o.Transaction.LastFour,
@@ -568,7 +629,7 @@ func (m *DBModel) GetAllSales() ([]*Order, error) {
 select
     o.amount, o.quantity, w.price, t.currency,
     o.id as order_id, o.widget_id, o.transaction_id,o.customer_id,
-    o.created_at,  o.status_id,
+    o.created_at,  o.status_id, o.reference,
     w.name as item, w.description,
     t.last_four, t.expiry_month, t.expiry_year,
     t.payment_intent, t.bank_return_code,
@@ -605,6 +666,7 @@ order by
 			&o.CustomerID,
 			&o.CreatedAt,
 			&o.StatusID,
+			&o.Reference,
 			&o.Widget.Name,
 			&o.Widget.Description,
 			&o.Transaction.LastFour,
@@ -633,7 +695,7 @@ func (m *DBModel) GetAllSubscriptions() ([]*Order, error) {
 select
     o.amount, o.quantity, w.price, t.currency,
     o.id as order_id, o.widget_id, o.transaction_id,o.customer_id,
-    o.created_at,  o.status_id,
+    o.created_at,  o.status_id, o.reference,
     w.name as item, w.description,
     t.last_four, t.expiry_month, t.expiry_year,
     t.payment_intent, t.bank_return_code,
@@ -670,6 +732,7 @@ order by
 			&o.CustomerID,
 			&o.CreatedAt,
 			&o.StatusID,
+			&o.Reference,
 			&o.Widget.Name,
 			&o.Widget.Description,
 			&o.Transaction.LastFour,
@@ -702,7 +765,7 @@ func (m *DBModel) GetOrder(id int, any bool, recurring int) (*Order, error) {
 select
     o.amount, o.quantity, w.price, t.currency,
     o.id as order_id, o.widget_id, o.transaction_id,o.customer_id,
-    o.created_at,  o.status_id,
+    o.created_at,  o.status_id, o.reference,
     w.name as item, w.description, w.is_recurring,
     t.last_four, t.expiry_month, t.expiry_year,
     t.payment_intent, t.bank_return_code,
@@ -743,6 +806,7 @@ from orders o
 		&o.CustomerID,
 		&o.CreatedAt,
 		&o.StatusID,
+		&o.Reference,
 		&o.Widget.Name,
 		&o.Widget.Description,
 		&o.Widget.IsRecurring,
@@ -758,6 +822,35 @@ from orders o
 	if err != nil {
 		return nil, err
 	}
+
+	o.Items, err = m.GetOrderItems(o.ID)
+	if err != nil {
+		return nil, err
+	}
+	o.Refunds, err = m.GetRefunds(o.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, refund := range o.Refunds {
+		if refund.Status != RefundFailed {
+			o.RefundedAmount += refund.Amount
+		}
+	}
+	if o.Widget.IsRecurring {
+		o.PlanChanges, err = m.GetPlanChanges(o.ID)
+		if err != nil {
+			return nil, err
+		}
+		o.Subscription, err = m.GetSubscriptionForOrder(o.ID)
+		if err != nil {
+			return nil, err
+		}
+		o.DunningAttempts, err = m.GetDunningAttempts(o.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &o, nil
 }
 
@@ -769,18 +862,40 @@ func (m *DBModel) GetSubscription(id int) (*Order, error) {
 	return m.GetOrder(id, false, 1)
 }
 
-func (m *DBModel) SetOrderStatusID(orderID, statusID int) error {
+// NewOrderReference makes up a short, hard to guess reference for an order,
+// which we can hand to Stripe before the order itself exists.
+func NewOrderReference() (string, error) {
+	randomBytes := make([]byte, 10)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return "ORD-" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// GetOrderByPaymentIntent finds the order paid for by a payment intent.
+// For subscriptions, see GetOrderBySubscriptionID.
+func (m *DBModel) GetOrderByPaymentIntent(pi string) (*Order, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	stmt := `
-	update orders set status_id = ?, updated_at = now() where id = ?
+select
+    o.id
+from orders o
+         inner join transactions t on (o.transaction_id = t.id)
+where
+        t.payment_intent = ?
+order by
+		o.id desc
+limit 1
 `
-	_, err := m.DB.ExecContext(ctx, stmt, statusID, orderID)
+	var id int
+	row := m.DB.QueryRowContext(ctx, stmt, pi)
+	err := row.Scan(&id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-
+	return m.GetOrder(id, true, 0)
 }
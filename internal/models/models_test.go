@@ -0,0 +1,108 @@
+package models
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// orderRecord is a row of the order listings, by column.
+func orderRecord(id int64, recurring bool) map[string]driver.Value {
+	return map[string]driver.Value{
+		"amount":           int64(2000),
+		"quantity":         int64(2),
+		"price":            int64(1000),
+		"currency":         "cad",
+		"order_id":         id,
+		"widget_id":        int64(1),
+		"transaction_id":   int64(3),
+		"customer_id":      int64(4),
+		"created_at":       time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC),
+		"status_id":        int64(1),
+		"reference":        "ORD-TEST",
+		"item":             "Widget",
+		"description":      "A very nice widget.",
+		"is_recurring":     recurring,
+		"last_four":        "4242",
+		"expiry_month":     int64(12),
+		"expiry_year":      int64(2030),
+		"payment_intent":   "pi_test",
+		"bank_return_code": "ch_test",
+		"first_name":       "Jane",
+		"last_name":        "Doe",
+		"email":            "jane@example.com",
+	}
+}
+
+func checkOrder(t *testing.T, o *Order) {
+	t.Helper()
+	if o.ID != 7 || o.Reference != "ORD-TEST" || o.StatusID != 1 {
+		t.Errorf("order scanned wrongly: id %d, reference %q, status %d", o.ID, o.Reference, o.StatusID)
+	}
+	if o.Widget.Name != "Widget" || o.Customer.Email != "jane@example.com" {
+		t.Errorf("order scanned wrongly: widget %q, customer %q", o.Widget.Name, o.Customer.Email)
+	}
+}
+
+// The order listings select the same columns; each must scan every one.
+func TestOrderListings(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	fake.Handle("select count(*) from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"count(*)": int64(1)})
+	}
+	fake.Handle("from orders o").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, orderRecord(7, false))
+	}
+	fake.Handle("from order_items")
+	fake.Handle("from refunds")
+
+	t.Run("GetPaginatedOrders", func(t *testing.T) {
+		for _, pageSize := range []int{0, 10} {
+			orders, lastPage, total, err := m.GetPaginatedOrders(false, pageSize, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orders) != 1 || total != 1 {
+				t.Fatalf("got %d orders of %d", len(orders), total)
+			}
+			if pageSize > 0 && lastPage != 1 {
+				t.Errorf("last page is %d", lastPage)
+			}
+			checkOrder(t, orders[0])
+		}
+	})
+
+	t.Run("GetAllSales", func(t *testing.T) {
+		orders, err := m.GetAllSales()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 1 {
+			t.Fatalf("got %d orders", len(orders))
+		}
+		checkOrder(t, orders[0])
+	})
+
+	t.Run("GetAllSubscriptions", func(t *testing.T) {
+		orders, err := m.GetAllSubscriptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 1 {
+			t.Fatalf("got %d orders", len(orders))
+		}
+		checkOrder(t, orders[0])
+	})
+
+	t.Run("GetOrder", func(t *testing.T) {
+		o, err := m.GetSale(7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkOrder(t, o)
+	})
+}
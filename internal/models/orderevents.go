@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Kinds of order event.
+const (
+	EventCreated       = "created"
+	EventStatusChanged = "status_changed"
+	EventRefund        = "refund"
+	EventCancellation  = "cancellation"
+)
+
+// OrderEvent is an entry in an order's history: a status change, refund
+// or cancellation. UserID is the admin who made it, or 0 for changes that
+// came from Stripe or the customer. GatewayReference is the Stripe object
+// behind the change, if there is one.
+//
+// Functions that change an order take an OrderEvent to say who is making
+// the change and why. They fill in the rest.
+type OrderEvent struct {
+	ID               int         `json:"id"`
+	OrderID          int         `json:"order_id"`
+	Kind             string      `json:"kind"`
+	FromStatusID     OrderStatus `json:"from_status_id"`
+	ToStatusID       OrderStatus `json:"to_status_id"`
+	Amount           int         `json:"amount"`
+	UserID           int         `json:"user_id"`
+	UserName         string      `json:"user_name"`
+	GatewayReference string      `json:"gateway_reference"`
+	Reason           string      `json:"reason"`
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"-"`
+}
+
+// insertOrderEvent adds an entry to an order's history.
+func insertOrderEvent(ctx context.Context, db execer, event OrderEvent) error {
+	if event.Kind == "" {
+		event.Kind = EventStatusChanged
+	}
+
+	_, err := db.ExecContext(ctx, `
+		insert into order_events
+			(order_id, kind, from_status_id, to_status_id, amount, user_id,
+			 gateway_reference, reason, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.OrderID,
+		event.Kind,
+		sql.NullInt64{Int64: int64(event.FromStatusID), Valid: event.FromStatusID > 0},
+		event.ToStatusID,
+		event.Amount,
+		sql.NullInt64{Int64: int64(event.UserID), Valid: event.UserID > 0},
+		event.GatewayReference,
+		event.Reason,
+		time.Now(),
+		time.Now(),
+	)
+	return err
+}
+
+// GetOrderEvents returns an order's history, oldest first.
+func (m *DBModel) GetOrderEvents(orderID int) ([]*OrderEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			e.id, e.order_id, e.kind, coalesce(e.from_status_id, 0), e.to_status_id,
+			e.amount, coalesce(e.user_id, 0),
+			coalesce(concat(u.first_name, ' ', u.last_name), ''),
+			e.gateway_reference, e.reason, e.created_at, e.updated_at
+		from
+			order_events e
+			left join users u on (e.user_id = u.id)
+		where
+			e.order_id = ?
+		order by
+			e.id
+	`
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*OrderEvent
+	for rows.Next() {
+		var e OrderEvent
+		err = rows.Scan(
+			&e.ID,
+			&e.OrderID,
+			&e.Kind,
+			&e.FromStatusID,
+			&e.ToStatusID,
+			&e.Amount,
+			&e.UserID,
+			&e.UserName,
+			&e.GatewayReference,
+			&e.Reason,
+			&e.CreatedAt,
+			&e.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
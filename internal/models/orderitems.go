@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// OrderItem is one line of an order. UnitPrice is the widget's price at
+// the time of the sale, so later price changes don't rewrite history.
+type OrderItem struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	WidgetID  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice int       `json:"unit_price"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Widget    Widget    `json:"widget"`
+}
+
+// InsertOrderItem inserts a line of an order, and returns its id
+func (tx *Tx) InsertOrderItem(item OrderItem) (int, error) {
+	stmt := `
+		insert into order_items
+			(order_id, widget_id, quantity, unit_price, amount,
+			 created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := tx.tx.ExecContext(tx.ctx, stmt,
+		item.OrderID,
+		item.WidgetID,
+		item.Quantity,
+		item.UnitPrice,
+		item.Amount,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetOrderItems gets the lines of an order, with their widgets.
+func (m *DBModel) GetOrderItems(orderID int) ([]OrderItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			i.id, i.order_id, i.widget_id, i.quantity, i.unit_price, i.amount,
+			i.created_at, i.updated_at,
+			w.name, w.description
+		from
+			order_items i
+			left join widgets w on (i.widget_id = w.id)
+		where
+			i.order_id = ?
+		order by
+			i.id
+	`
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []OrderItem
+	for rows.Next() {
+		var i OrderItem
+		err = rows.Scan(
+			&i.ID,
+			&i.OrderID,
+			&i.WidgetID,
+			&i.Quantity,
+			&i.UnitPrice,
+			&i.Amount,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.Name,
+			&i.Widget.Description,
+		)
+		if err != nil {
+			return nil, err
+		}
+		i.Widget.ID = i.WidgetID
+		items = append(items, i)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// PaymentMethod is a card a customer has saved with the gateway. We only
+// keep enough to show it back to them; the card itself stays with the
+// gateway. Fingerprint is the gateway's ID for the card number, which is
+// the same each time the same card is entered.
+type PaymentMethod struct {
+	ID                     int       `json:"id"`
+	CustomerID             int       `json:"customer_id"`
+	GatewayPaymentMethodID string    `json:"gateway_payment_method_id"`
+	Fingerprint            string    `json:"-"`
+	Brand                  string    `json:"brand"`
+	LastFour               string    `json:"last_four"`
+	ExpiryMonth            int       `json:"expiry_month"`
+	ExpiryYear             int       `json:"expiry_year"`
+	CreatedAt              time.Time `json:"created_at"`
+	UpdatedAt              time.Time `json:"-"`
+}
+
+const paymentMethodColumns = `
+	id, customer_id, gateway_payment_method_id, fingerprint, brand,
+	last_four, expiry_month, expiry_year, created_at, updated_at
+`
+
+func scanPaymentMethod(row rowScanner) (*PaymentMethod, error) {
+	var pm PaymentMethod
+	err := row.Scan(
+		&pm.ID,
+		&pm.CustomerID,
+		&pm.GatewayPaymentMethodID,
+		&pm.Fingerprint,
+		&pm.Brand,
+		&pm.LastFour,
+		&pm.ExpiryMonth,
+		&pm.ExpiryYear,
+		&pm.CreatedAt,
+		&pm.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &pm, nil
+}
+
+// SavePaymentMethod saves a customer's card. Entering the same card again
+// makes a new gateway payment method, so it replaces the one we had.
+func (tx *Tx) SavePaymentMethod(pm PaymentMethod) error {
+	if pm.Fingerprint != "" {
+		_, err := tx.tx.ExecContext(tx.ctx, `
+			delete from payment_methods
+			where customer_id = ? and fingerprint = ? and gateway_payment_method_id <> ?
+		`, pm.CustomerID, pm.Fingerprint, pm.GatewayPaymentMethodID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.tx.ExecContext(tx.ctx, `
+		insert into payment_methods
+			(customer_id, gateway_payment_method_id, fingerprint, brand,
+			 last_four, expiry_month, expiry_year, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		on duplicate key update
+			customer_id = values(customer_id),
+			expiry_month = values(expiry_month),
+			expiry_year = values(expiry_year),
+			updated_at = values(updated_at)
+	`,
+		pm.CustomerID,
+		pm.GatewayPaymentMethodID,
+		pm.Fingerprint,
+		pm.Brand,
+		pm.LastFour,
+		pm.ExpiryMonth,
+		pm.ExpiryYear,
+		time.Now(),
+		time.Now(),
+	)
+	return err
+}
+
+// GetPaymentMethods returns a customer's saved cards that haven't expired,
+// newest first.
+func (m *DBModel) GetPaymentMethods(customerID int) ([]*PaymentMethod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, `
+		select `+paymentMethodColumns+`
+		from payment_methods
+		where customer_id = ?
+			and (expiry_year > ? or (expiry_year = ? and expiry_month >= ?))
+		order by created_at desc, id desc
+	`, customerID, now.Year(), now.Year(), int(now.Month()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var methods []*PaymentMethod
+	for rows.Next() {
+		pm, err := scanPaymentMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, pm)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return methods, nil
+}
+
+// GetPaymentMethod gets one saved card by id.
+func (m *DBModel) GetPaymentMethod(id int) (*PaymentMethod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx,
+		`select `+paymentMethodColumns+` from payment_methods where id = ?`, id)
+	return scanPaymentMethod(row)
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PlanChange records a subscription moving from one plan to another.
+// Proration is what the customer was charged (or, if negative, credited)
+// for the rest of the billing period at the time.
+type PlanChange struct {
+	ID           int       `json:"id"`
+	OrderID      int       `json:"order_id"`
+	FromWidgetID int       `json:"from_widget_id"`
+	ToWidgetID   int       `json:"to_widget_id"`
+	FromAmount   int       `json:"from_amount"`
+	ToAmount     int       `json:"to_amount"`
+	Proration    int       `json:"proration"`
+	Currency     string    `json:"currency"`
+	UserID       int       `json:"user_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"-"`
+	FromWidget   Widget    `json:"from_widget"`
+	ToWidget     Widget    `json:"to_widget"`
+}
+
+// ChangeSubscriptionPlan moves a subscription order to another plan, and
+// records the change. The order then shows the plan it is on now.
+func (m *DBModel) ChangeSubscriptionPlan(change PlanChange) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		_, err := tx.tx.ExecContext(tx.ctx,
+			`update orders set widget_id = ?, amount = ?, updated_at = ? where id = ?`,
+			change.ToWidgetID, change.ToAmount, time.Now(), change.OrderID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx, `
+			update order_items
+			set widget_id = ?, unit_price = ?, amount = ? * quantity, updated_at = ?
+			where order_id = ? and widget_id = ?`,
+			change.ToWidgetID, change.ToAmount, change.ToAmount, time.Now(),
+			change.OrderID, change.FromWidgetID)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.tx.ExecContext(tx.ctx, `
+			insert into plan_changes
+				(order_id, from_widget_id, to_widget_id, from_amount, to_amount,
+				 proration, currency, user_id, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			change.OrderID,
+			change.FromWidgetID,
+			change.ToWidgetID,
+			change.FromAmount,
+			change.ToAmount,
+			change.Proration,
+			change.Currency,
+			sql.NullInt64{Int64: int64(change.UserID), Valid: change.UserID > 0},
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+		newID, err := result.LastInsertId()
+		id = int(newID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetPlanChanges returns the plan changes of a subscription, oldest first.
+func (m *DBModel) GetPlanChanges(orderID int) ([]*PlanChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			p.id, p.order_id, p.from_widget_id, p.to_widget_id,
+			p.from_amount, p.to_amount, p.proration, p.currency,
+			coalesce(p.user_id, 0), p.created_at, p.updated_at,
+			coalesce(fw.name, ''), coalesce(tw.name, '')
+		from
+			plan_changes p
+			left join widgets fw on (p.from_widget_id = fw.id)
+			left join widgets tw on (p.to_widget_id = tw.id)
+		where
+			p.order_id = ?
+		order by
+			p.id
+	`
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*PlanChange
+	for rows.Next() {
+		var c PlanChange
+		err = rows.Scan(
+			&c.ID,
+			&c.OrderID,
+			&c.FromWidgetID,
+			&c.ToWidgetID,
+			&c.FromAmount,
+			&c.ToAmount,
+			&c.Proration,
+			&c.Currency,
+			&c.UserID,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+			&c.FromWidget.Name,
+			&c.ToWidget.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		c.FromWidget.ID = c.FromWidgetID
+		c.ToWidget.ID = c.ToWidgetID
+		changes = append(changes, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
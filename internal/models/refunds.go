@@ -0,0 +1,374 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrRefundExceedsBalance is returned for a refund larger than what is
+// left on the order.
+var ErrRefundExceedsBalance = errors.New("refund is more than the order's remaining balance")
+
+// A refund we make is pending from when we ask the gateway for it until
+// its answer is saved, so that it counts against the order's balance
+// while it is in flight. One the gateway turns down is failed, and
+// doesn't count.
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+// Refund is money returned on an order. UserID is the admin who made it,
+// or 0 for refunds made in the Stripe dashboard.
+type Refund struct {
+	ID              int       `json:"id"`
+	OrderID         int       `json:"order_id"`
+	Amount          int       `json:"amount"`
+	Currency        string    `json:"currency"`
+	Reason          string    `json:"reason"`
+	GatewayRefundID string    `json:"gateway_refund_id"`
+	UserID          int       `json:"user_id"`
+	Status          string    `json:"status"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"-"`
+}
+
+// refundedAmount returns how much of an order has been refunded so far,
+// counting refunds still pending.
+func (tx *Tx) refundedAmount(orderID int) (int, error) {
+	var refunded int
+	row := tx.tx.QueryRowContext(tx.ctx,
+		`select coalesce(sum(amount), 0) from refunds where order_id = ? and status <> ?`,
+		orderID, RefundFailed)
+	err := row.Scan(&refunded)
+	return refunded, err
+}
+
+// lockForRefund locks an order and its transaction for the rest of the
+// database transaction, so that refunds of one order are worked out one
+// at a time. It returns the order's amount, and the statuses of the order
+// and its transaction.
+func (tx *Tx) lockForRefund(orderID int) (int, OrderStatus, int, TxnStatus, error) {
+	var total, txnID int
+	var status OrderStatus
+	row := tx.tx.QueryRowContext(tx.ctx,
+		`select amount, status_id, transaction_id from orders where id = ? for update`, orderID)
+	err := row.Scan(&total, &status, &txnID)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	var txnStatus TxnStatus
+	row = tx.tx.QueryRowContext(tx.ctx,
+		`select transaction_status_id from transactions where id = ? for update`, txnID)
+	err = row.Scan(&txnStatus)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return total, status, txnID, txnStatus, nil
+}
+
+// refundStatuses are where a refund leaves an order and its transaction:
+// refunded if it takes all of what is left, and partially refunded if not.
+func refundStatuses(remaining int) (OrderStatus, TxnStatus) {
+	if remaining > 0 {
+		return OrderPartiallyRefunded, TxnPartiallyRefunded
+	}
+	return OrderRefunded, TxnRefunded
+}
+
+// RefundableBalance returns how much of an order can still be refunded.
+func (m *DBModel) RefundableBalance(orderID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var balance int
+	row := m.DB.QueryRowContext(ctx, `
+		select
+			o.amount - coalesce((
+				select sum(r.amount) from refunds r
+				where r.order_id = o.id and r.status <> ?), 0)
+		from
+			orders o
+		where
+			o.id = ?`, RefundFailed, orderID)
+	err := row.Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// BeginRefund saves a refund as pending before the gateway is asked for
+// it. An amount of 0 refunds whatever is left. The order is locked while
+// the balance is worked out, so two refunds at once can't both spend it.
+// It returns the pending refund's ID, its amount, and the balance before
+// it; ErrRefundExceedsBalance if there isn't enough left; or a
+// *TransitionError if the order or its transaction can't be refunded.
+func (m *DBModel) BeginRefund(refund Refund) (id, amount, balance int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.WithTx(ctx, func(tx *Tx) error {
+		total, status, txnID, txnStatus, err := tx.lockForRefund(refund.OrderID)
+		if err != nil {
+			return err
+		}
+		refunded, err := tx.refundedAmount(refund.OrderID)
+		if err != nil {
+			return err
+		}
+
+		balance = total - refunded
+		amount = refund.Amount
+		if amount == 0 {
+			amount = balance
+		}
+		if amount <= 0 || amount > balance {
+			return ErrRefundExceedsBalance
+		}
+
+		next, nextTxn := refundStatuses(balance - amount)
+		if !status.CanBecome(next) {
+			return &TransitionError{Subject: "order", ID: refund.OrderID, From: status.Name(), To: next.Name()}
+		}
+		if !txnStatus.CanBecome(nextTxn) {
+			return &TransitionError{Subject: "transaction", ID: txnID, From: txnStatus.Name(), To: nextTxn.Name()}
+		}
+
+		result, err := tx.tx.ExecContext(tx.ctx, `
+			insert into refunds
+				(order_id, amount, currency, reason, gateway_refund_id, user_id,
+				 status, created_at, updated_at)
+			values (?, ?, ?, ?, null, ?, ?, ?, ?)`,
+			refund.OrderID,
+			amount,
+			refund.Currency,
+			refund.Reason,
+			sql.NullInt64{Int64: int64(refund.UserID), Valid: refund.UserID > 0},
+			RefundPending,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+		newID, err := result.LastInsertId()
+		id = int(newID)
+		return err
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return id, amount, balance, nil
+}
+
+// FailRefund marks a pending refund the gateway turned down, giving its
+// amount back to the order's balance.
+func (m *DBModel) FailRefund(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx,
+		`update refunds set status = ?, updated_at = ? where id = ? and status = ?`,
+		RefundFailed, time.Now(), id, RefundPending)
+	return err
+}
+
+// RecordRefund saves a refund made at the gateway, and moves the order and
+// its transaction to refunded or partially refunded. A refund with an ID
+// completes the pending one BeginRefund saved; one without, such as a
+// refund made in the dashboard, is added. A refund we already have is
+// skipped, so it is safe to call again when Stripe tells us about a
+// refund we made. It returns the order's status afterwards, or
+// ErrRefundExceedsBalance if the refund no longer fits in what is left.
+//
+// The money has gone back whatever state the order is in, so the refund is
+// saved even when the order can't move, as for a refund made in the
+// dashboard on a cancelled subscription.
+func (m *DBModel) RecordRefund(refund Refund) (OrderStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var status OrderStatus
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		total, current, txnID, txnStatus, err := tx.lockForRefund(refund.OrderID)
+		if err != nil {
+			return err
+		}
+		status = current
+
+		var was string
+		var pendingAmount int
+		if refund.ID != 0 {
+			row := tx.tx.QueryRowContext(tx.ctx,
+				`select status, amount from refunds where id = ? and order_id = ? for update`,
+				refund.ID, refund.OrderID)
+			err = row.Scan(&was, &pendingAmount)
+			if err != nil || was == RefundSucceeded {
+				return err
+			}
+		} else {
+			var count int
+			row := tx.tx.QueryRowContext(tx.ctx,
+				`select count(id) from refunds where gateway_refund_id = ?`, refund.GatewayRefundID)
+			err = row.Scan(&count)
+			if err != nil || count > 0 {
+				return err
+			}
+		}
+
+		refunded, err := tx.refundedAmount(refund.OrderID)
+		if err != nil {
+			return err
+		}
+
+		if refund.ID != 0 {
+			// A pending refund already counts against the balance, though
+			// the gateway has the last word on how much it was for.
+			if was == RefundFailed {
+				pendingAmount = 0
+			}
+			// A failed refund no longer holds its share of the balance,
+			// which another refund may have taken since.
+			if refunded+refund.Amount-pendingAmount > total {
+				return ErrRefundExceedsBalance
+			}
+			refunded += refund.Amount - pendingAmount
+
+			_, err = tx.tx.ExecContext(tx.ctx, `
+				update refunds set
+					amount = ?, gateway_refund_id = ?, status = ?, updated_at = ?
+				where id = ?`,
+				refund.Amount,
+				refund.GatewayRefundID,
+				RefundSucceeded,
+				time.Now(),
+				refund.ID,
+			)
+			if err != nil {
+				return err
+			}
+		} else {
+			if refunded+refund.Amount > total {
+				return ErrRefundExceedsBalance
+			}
+			refunded += refund.Amount
+
+			_, err = tx.tx.ExecContext(tx.ctx, `
+				insert into refunds
+					(order_id, amount, currency, reason, gateway_refund_id, user_id,
+					 status, created_at, updated_at)
+				values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				refund.OrderID,
+				refund.Amount,
+				refund.Currency,
+				refund.Reason,
+				refund.GatewayRefundID,
+				sql.NullInt64{Int64: int64(refund.UserID), Valid: refund.UserID > 0},
+				RefundSucceeded,
+				time.Now(),
+				time.Now(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		next, nextTxn := refundStatuses(total - refunded)
+		if txnStatus.CanBecome(nextTxn) {
+			_, err = tx.setTxnStatus(txnID, nextTxn)
+			if err != nil {
+				return err
+			}
+		}
+
+		event := OrderEvent{
+			OrderID:          refund.OrderID,
+			Kind:             EventRefund,
+			FromStatusID:     status,
+			ToStatusID:       status,
+			Amount:           refund.Amount,
+			UserID:           refund.UserID,
+			GatewayReference: refund.GatewayRefundID,
+			Reason:           refund.Reason,
+		}
+		changed := false
+		if status.CanBecome(next) {
+			if next == OrderPartiallyRefunded {
+				changed, err = tx.setOrderStatus(refund.OrderID, next, event)
+			} else {
+				changed, err = tx.markRefunded(refund.OrderID, event)
+			}
+			if err != nil {
+				return err
+			}
+			status = next
+		}
+		if changed {
+			return nil
+		}
+		// A further partial refund, or one on an order that can't move,
+		// still goes in the history.
+		return insertOrderEvent(tx.ctx, tx.tx, event)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return status, nil
+}
+
+// GetRefunds returns the refunds on an order, oldest first.
+func (m *DBModel) GetRefunds(orderID int) ([]*Refund, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			id, order_id, amount, currency, reason, coalesce(gateway_refund_id, ''),
+			coalesce(user_id, 0), status, created_at, updated_at
+		from
+			refunds
+		where
+			order_id = ?
+		order by
+			id
+	`
+	rows, err := m.DB.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refunds []*Refund
+	for rows.Next() {
+		var r Refund
+		err = rows.Scan(
+			&r.ID,
+			&r.OrderID,
+			&r.Amount,
+			&r.Currency,
+			&r.Reason,
+			&r.GatewayRefundID,
+			&r.UserID,
+			&r.Status,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, &r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return refunds, nil
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// refundDB fakes an order of 2000 with refunded already refunded, whose
+// transaction has cleared.
+func refundDB(t *testing.T, refunded int64) (DBModel, *fakedb.DB) {
+	db, fake := fakedb.New(t)
+
+	fake.Handle("select amount, status_id, transaction_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		status := OrderCharged
+		if refunded > 0 {
+			status = OrderPartiallyRefunded
+		}
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"amount":         int64(2000),
+			"status_id":      int64(status),
+			"transaction_id": int64(3),
+		})
+	}
+	fake.Handle("select transaction_status_id from transactions").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		status := TxnCleared
+		if refunded > 0 {
+			status = TxnPartiallyRefunded
+		}
+		return fakedb.RowsFrom(q, map[string]driver.Value{"transaction_status_id": int64(status)})
+	}
+	fake.Handle("select coalesce(sum(amount), 0) from refunds").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		if args[1] != RefundFailed {
+			t.Errorf("failed refunds are counted: %v", args)
+		}
+		return fakedb.RowsFrom(q, map[string]driver.Value{"coalesce(sum(amount), 0)": refunded})
+	}
+	return DBModel{DB: db}, fake
+}
+
+func TestBeginRefund(t *testing.T) {
+	t.Run("whatever is left", func(t *testing.T) {
+		m, fake := refundDB(t, 500)
+		insert := fake.Handle("insert into refunds")
+		insert.Exec = func(q string, args []driver.Value) (driver.Result, error) {
+			if args[1] != int64(1500) || args[5] != RefundPending {
+				t.Errorf("inserted %v", args)
+			}
+			return fakedb.Result{ID: 9, Affected: 1}, nil
+		}
+
+		id, amount, balance, err := m.BeginRefund(Refund{OrderID: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 9 || amount != 1500 || balance != 1500 {
+			t.Errorf("got refund %d of %d from %d", id, amount, balance)
+		}
+		if fake.Ran("for update") != 2 {
+			t.Errorf("order and transaction were not both locked: %q", fake.Log)
+		}
+	})
+
+	t.Run("more than is left", func(t *testing.T) {
+		// A pending refund counts, so a second one can't spend it too.
+		m, _ := refundDB(t, 1500)
+		_, _, _, err := m.BeginRefund(Refund{OrderID: 7, Amount: 600})
+		if !errors.Is(err, ErrRefundExceedsBalance) {
+			t.Errorf("got %v", err)
+		}
+	})
+}
+
+func TestRecordRefund(t *testing.T) {
+	// 500 refunded before, and the 1500 pending.
+	m, fake := refundDB(t, 2000)
+	fake.Handle("select status, amount from refunds").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status": RefundPending, "amount": int64(1500)})
+	}
+	fake.Handle("update refunds set")
+	txnStatus := fake.Handle("update transactions set")
+	txnStatus.Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if args[0] != int64(TxnRefunded) {
+			t.Errorf("transaction went to %v", args[0])
+		}
+		return fakedb.Result{Affected: 1}, nil
+	}
+	fake.Handle("insert into transaction_status_changes")
+	fake.Handle("select status_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status_id": int64(OrderPartiallyRefunded)})
+	}
+	fake.Handle("update orders set")
+	fake.Handle("insert into order_events")
+	restock := fake.Handle("update widgets w")
+
+	status, err := m.RecordRefund(Refund{ID: 9, OrderID: 7, Amount: 1500, GatewayRefundID: "re_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != OrderRefunded {
+		t.Errorf("order is %s", status.Name())
+	}
+	if txnStatus.Calls != 1 || restock.Calls != 1 {
+		t.Errorf("transaction moved %d times, restocked %d times", txnStatus.Calls, restock.Calls)
+	}
+	if fake.Ran("insert into refunds") != 0 {
+		t.Error("the pending refund was added again")
+	}
+}
+
+// A refund that failed gave its share of the balance back. If the gateway
+// goes on to say it went through after all, it must still fit.
+func TestRecordFailedRefund(t *testing.T) {
+	// 1500 of the order was refunded since the 1000 one failed.
+	m, fake := refundDB(t, 1500)
+	fake.Handle("select status, amount from refunds").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status": RefundFailed, "amount": int64(1000)})
+	}
+
+	_, err := m.RecordRefund(Refund{ID: 9, OrderID: 7, Amount: 1000, GatewayRefundID: "re_1"})
+	if !errors.Is(err, ErrRefundExceedsBalance) {
+		t.Errorf("got %v", err)
+	}
+	if fake.Ran("update refunds") != 0 {
+		t.Error("the refund was recorded")
+	}
+}
+
+// A further partial refund leaves the order where it was, but still goes
+// in its history.
+func TestRecordRefundHistory(t *testing.T) {
+	m, fake := refundDB(t, 500)
+	fake.Handle("select count(id) from refunds").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"count(id)": int64(0)})
+	}
+	fake.Handle("insert into refunds")
+	fake.Handle("select status_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status_id": int64(OrderPartiallyRefunded)})
+	}
+	history := fake.Handle("insert into order_events")
+	history.Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if args[1] != EventRefund || args[4] != int64(300) || args[6] != "re_2" {
+			t.Errorf("recorded %v", args)
+		}
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+
+	status, err := m.RecordRefund(Refund{OrderID: 7, Amount: 300, GatewayRefundID: "re_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != OrderPartiallyRefunded || history.Calls != 1 {
+		t.Errorf("order is %s, with %d events", status.Name(), history.Calls)
+	}
+	if fake.Ran("update orders") != 0 || fake.Ran("update transactions") != 0 {
+		t.Error("a status was changed")
+	}
+}
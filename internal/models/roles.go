@@ -0,0 +1,126 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Role is what an admin user is allowed to do, from the roles table.
+type Role int
+
+const (
+	RoleViewer  Role = 1
+	RoleSupport Role = 2
+	RoleFinance Role = 3
+	RoleOwner   Role = 4
+)
+
+// Roles lists every role, least powerful first.
+var Roles = []Role{RoleViewer, RoleSupport, RoleFinance, RoleOwner}
+
+var roleNames = map[Role]string{
+	RoleViewer:  "Viewer",
+	RoleSupport: "Support",
+	RoleFinance: "Finance",
+	RoleOwner:   "Owner",
+}
+
+// Name is the role's name in the roles table.
+func (r Role) Name() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Valid reports whether r is one of the roles in the roles table.
+func (r Role) Valid() bool {
+	_, ok := roleNames[r]
+	return ok
+}
+
+// Permission is something an admin user can be allowed to do.
+type Permission string
+
+const (
+	PermViewSales           Permission = "sales:view"
+	PermRefund              Permission = "sales:refund"
+	PermManageSubscriptions Permission = "subscriptions:manage"
+	PermVirtualTerminal     Permission = "terminal:charge"
+	PermViewWidgets         Permission = "widgets:view"
+	PermManageWidgets       Permission = "widgets:manage"
+	PermViewUsers           Permission = "users:view"
+	PermManageUsers         Permission = "users:manage"
+	PermManageAPIKeys       Permission = "apikeys:manage"
+)
+
+// Permissions lists every permission.
+var Permissions = []Permission{
+	PermViewSales, PermRefund, PermManageSubscriptions, PermVirtualTerminal,
+	PermViewWidgets, PermManageWidgets, PermViewUsers, PermManageUsers,
+	PermManageAPIKeys,
+}
+
+// Valid reports whether p is one of the permissions roles can grant.
+func (p Permission) Valid() bool {
+	return hasPermission(Permissions, p)
+}
+
+func hasPermission(perms []Permission, p Permission) bool {
+	for _, granted := range perms {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// rolePermissions lists what each role may do. Owners may do anything.
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {PermViewSales, PermViewWidgets},
+	RoleSupport: {PermViewSales, PermViewWidgets,
+		PermManageSubscriptions},
+	RoleFinance: {PermViewSales, PermViewWidgets,
+		PermManageSubscriptions, PermRefund, PermVirtualTerminal},
+}
+
+// Can reports whether the role grants permission p.
+func (r Role) Can(p Permission) bool {
+	if r == RoleOwner {
+		return true
+	}
+	return hasPermission(rolePermissions[r], p)
+}
+
+// Can reports whether the user's role grants permission p. A user signed
+// in with an API key also needs p to be one of the key's scopes.
+func (u *User) Can(p Permission) bool {
+	if u.Scopes != nil && !hasPermission(u.Scopes, p) {
+		return false
+	}
+	return u.RoleID.Can(p)
+}
+
+// ErrLastOwner is returned for a change that would leave nobody able to
+// manage users.
+var ErrLastOwner = errors.New("there must be at least one owner")
+
+// checkOwnersLeft returns ErrLastOwner if userID is the only owner. It is
+// called before a user is demoted or deleted.
+func (tx *Tx) checkOwnersLeft(userID int) error {
+	var owners, others int
+	row := tx.tx.QueryRowContext(tx.ctx, `
+		select count(id), coalesce(sum(id <> ?), 0)
+		from users
+		where role_id = ?
+		for update`,
+		userID, RoleOwner)
+	err := row.Scan(&owners, &others)
+	if err != nil {
+		return err
+	}
+	if owners > 0 && others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role Role
+		p    Permission
+		want bool
+	}{
+		{RoleViewer, PermViewSales, true},
+		{RoleViewer, PermRefund, false},
+		{RoleSupport, PermManageSubscriptions, true},
+		{RoleSupport, PermRefund, false},
+		{RoleFinance, PermRefund, true},
+		{RoleFinance, PermManageUsers, false},
+		{RoleOwner, PermManageUsers, true},
+		{Role(0), PermViewSales, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Can(tt.p); got != tt.want {
+			t.Errorf("%s can %s: got %v", tt.role.Name(), tt.p, got)
+		}
+	}
+}
+
+// The only owner can't be deleted, or nobody could manage users.
+func TestDeleteLastOwner(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	deleted := fake.Handle("delete from users")
+	others := int64(0)
+	fake.Handle("from users").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"count(id)":                 int64(1) + others,
+			"coalesce(sum(id <> ?), 0)": others,
+		})
+	}
+
+	err := m.DeleteUser(1)
+	if !errors.Is(err, ErrLastOwner) || deleted.Calls != 0 {
+		t.Fatalf("got %v, deleted %d times", err, deleted.Calls)
+	}
+
+	others = 1
+	err = m.DeleteUser(1)
+	if err != nil || deleted.Calls != 1 {
+		t.Errorf("with another owner: got %v, deleted %d times", err, deleted.Calls)
+	}
+}
@@ -0,0 +1,251 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OrderStatus is an order's status, from the statuses table.
+type OrderStatus int
+
+const (
+	OrderCharged            OrderStatus = 1
+	OrderRefunded           OrderStatus = 2
+	OrderCancelled          OrderStatus = 3
+	OrderPastDue            OrderStatus = 4
+	OrderDisputed           OrderStatus = 5
+	OrderPartiallyRefunded  OrderStatus = 6
+	OrderTrialing           OrderStatus = 7
+	OrderCancelsAtPeriodEnd OrderStatus = 8
+	OrderPending            OrderStatus = 9
+	OrderPaymentFailed      OrderStatus = 10
+)
+
+var orderStatusNames = map[OrderStatus]string{
+	OrderCharged:            "Cleared",
+	OrderRefunded:           "Refunded",
+	OrderCancelled:          "Cancelled",
+	OrderPastDue:            "Past due",
+	OrderDisputed:           "Disputed",
+	OrderPartiallyRefunded:  "Partially refunded",
+	OrderTrialing:           "Trialing",
+	OrderCancelsAtPeriodEnd: "Cancels at period end",
+	OrderPending:            "Pending",
+	OrderPaymentFailed:      "Payment failed",
+}
+
+// Name is the status's name in the statuses table. It isn't String, so
+// that templates still write the status out as a number.
+func (s OrderStatus) Name() string {
+	if name, ok := orderStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("OrderStatus(%d)", int(s))
+}
+
+// orderTransitions lists where an order can go from each status. Refunded,
+// cancelled and failed orders are finished, and go nowhere.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending: {OrderCharged, OrderTrialing, OrderPastDue, OrderCancelled, OrderPaymentFailed},
+	OrderCharged: {OrderRefunded, OrderPartiallyRefunded, OrderDisputed, OrderPastDue,
+		OrderCancelsAtPeriodEnd, OrderCancelled},
+	OrderPartiallyRefunded:  {OrderRefunded, OrderDisputed, OrderCancelled},
+	OrderDisputed:           {OrderCharged, OrderRefunded, OrderPartiallyRefunded, OrderCancelled},
+	OrderTrialing:           {OrderCharged, OrderPastDue, OrderCancelsAtPeriodEnd, OrderCancelled},
+	OrderPastDue:            {OrderCharged, OrderDisputed, OrderCancelsAtPeriodEnd, OrderCancelled},
+	OrderCancelsAtPeriodEnd: {OrderCharged, OrderTrialing, OrderPastDue, OrderDisputed, OrderCancelled},
+}
+
+// CanBecome reports whether an order in status s may move to next.
+// Staying where it is is always allowed.
+func (s OrderStatus) CanBecome(next OrderStatus) bool {
+	if s == next {
+		return true
+	}
+	for _, to := range orderTransitions[s] {
+		if to == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TxnStatus is a transaction's status, from the
+// transaction_statuses table.
+type TxnStatus int
+
+const (
+	TxnPending           TxnStatus = 1
+	TxnCleared           TxnStatus = 2
+	TxnDeclined          TxnStatus = 3
+	TxnRefunded          TxnStatus = 4
+	TxnPartiallyRefunded TxnStatus = 5
+)
+
+var txnStatusNames = map[TxnStatus]string{
+	TxnPending:           "Pending",
+	TxnCleared:           "Cleared",
+	TxnDeclined:          "Declined",
+	TxnRefunded:          "Refunded",
+	TxnPartiallyRefunded: "Partially refunded",
+}
+
+// Name is the status's name in the transaction_statuses table.
+func (s TxnStatus) Name() string {
+	if name, ok := txnStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("TxnStatus(%d)", int(s))
+}
+
+// txnTransitions lists where a transaction can go from each status.
+var txnTransitions = map[TxnStatus][]TxnStatus{
+	TxnPending:           {TxnCleared, TxnDeclined},
+	TxnCleared:           {TxnRefunded, TxnPartiallyRefunded},
+	TxnPartiallyRefunded: {TxnRefunded},
+}
+
+// CanBecome reports whether a transaction in status s may move to next.
+// Staying where it is is always allowed.
+func (s TxnStatus) CanBecome(next TxnStatus) bool {
+	if s == next {
+		return true
+	}
+	for _, to := range txnTransitions[s] {
+		if to == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrIllegalTransition is returned for a status change that the state
+// machine doesn't allow, such as refunding a cancelled subscription.
+var ErrIllegalTransition = errors.New("illegal status transition")
+
+// TransitionError says which status change was refused. It matches
+// ErrIllegalTransition with errors.Is.
+type TransitionError struct {
+	// Subject is "order" or "transaction".
+	Subject string
+	ID      int
+	From    string
+	To      string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s %d can't go from %s to %s", e.Subject, e.ID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+// recordTxnStatus logs a transaction's move to a new status. from is 0
+// for a new transaction.
+func recordTxnStatus(ctx context.Context, db execer, txnID int, from, to TxnStatus) error {
+	_, err := db.ExecContext(ctx, `
+		insert into transaction_status_changes
+			(transaction_id, from_status_id, to_status_id, created_at, updated_at)
+		values (?, ?, ?, ?, ?)`,
+		txnID,
+		sql.NullInt64{Int64: int64(from), Valid: from > 0},
+		to,
+		time.Now(),
+		time.Now(),
+	)
+	return err
+}
+
+// orderStatus returns an order's status, and locks the order until the
+// transaction ends.
+func (tx *Tx) orderStatus(orderID int) (OrderStatus, error) {
+	var status OrderStatus
+	row := tx.tx.QueryRowContext(tx.ctx,
+		`select status_id from orders where id = ? for update`, orderID)
+	err := row.Scan(&status)
+	return status, err
+}
+
+// setOrderStatus moves an order to a new status, if the state machine
+// allows it, and adds event to the order's history. It returns whether the
+// status changed; nothing is recorded if it didn't.
+func (tx *Tx) setOrderStatus(orderID int, to OrderStatus, event OrderEvent) (bool, error) {
+	from, err := tx.orderStatus(orderID)
+	if err != nil {
+		return false, err
+	}
+	if from == to {
+		return false, nil
+	}
+	if !from.CanBecome(to) {
+		return false, &TransitionError{Subject: "order", ID: orderID, From: from.Name(), To: to.Name()}
+	}
+
+	_, err = tx.tx.ExecContext(tx.ctx,
+		`update orders set status_id = ?, updated_at = ? where id = ?`,
+		to, time.Now(), orderID)
+	if err != nil {
+		return false, err
+	}
+
+	event.OrderID = orderID
+	event.FromStatusID = from
+	event.ToStatusID = to
+	return true, insertOrderEvent(tx.ctx, tx.tx, event)
+}
+
+// setTxnStatus moves a transaction to a new status, if the state machine
+// allows it, and records the change. It returns whether the status changed.
+func (tx *Tx) setTxnStatus(txnID int, to TxnStatus) (bool, error) {
+	var from TxnStatus
+	row := tx.tx.QueryRowContext(tx.ctx,
+		`select transaction_status_id from transactions where id = ? for update`, txnID)
+	err := row.Scan(&from)
+	if err != nil {
+		return false, err
+	}
+	if from == to {
+		return false, nil
+	}
+	if !from.CanBecome(to) {
+		return false, &TransitionError{Subject: "transaction", ID: txnID, From: from.Name(), To: to.Name()}
+	}
+
+	_, err = tx.tx.ExecContext(tx.ctx,
+		`update transactions set transaction_status_id = ?, updated_at = ? where id = ?`,
+		to, time.Now(), txnID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, recordTxnStatus(tx.ctx, tx.tx, txnID, from, to)
+}
+
+// SetOrderStatus moves an order to a new status, and adds event to its
+// history. It returns a *TransitionError if the order can't go there from
+// where it is.
+func (m *DBModel) SetOrderStatus(orderID int, status OrderStatus, event OrderEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		_, err := tx.setOrderStatus(orderID, status, event)
+		return err
+	})
+}
+
+// SetTransactionStatus moves a transaction to a new status. It returns a
+// *TransitionError if the transaction can't go there from where it is.
+func (m *DBModel) SetTransactionStatus(txnID int, status TxnStatus) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		_, err := tx.setTxnStatus(txnID, status)
+		return err
+	})
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+func TestOrderStatusCanBecome(t *testing.T) {
+	tests := []struct {
+		from, to OrderStatus
+		ok       bool
+	}{
+		{OrderPending, OrderCharged, true},
+		{OrderPending, OrderPaymentFailed, true},
+		{OrderCharged, OrderPartiallyRefunded, true},
+		{OrderPartiallyRefunded, OrderRefunded, true},
+		{OrderCharged, OrderCharged, true},
+		{OrderPending, OrderRefunded, false},
+		{OrderRefunded, OrderCharged, false},
+		{OrderCancelled, OrderRefunded, false},
+		{OrderPaymentFailed, OrderCharged, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanBecome(tt.to); got != tt.ok {
+			t.Errorf("%s to %s: got %v", tt.from.Name(), tt.to.Name(), got)
+		}
+	}
+}
+
+func TestTxnStatusCanBecome(t *testing.T) {
+	tests := []struct {
+		from, to TxnStatus
+		ok       bool
+	}{
+		{TxnPending, TxnCleared, true},
+		{TxnPending, TxnDeclined, true},
+		{TxnCleared, TxnPartiallyRefunded, true},
+		{TxnPartiallyRefunded, TxnRefunded, true},
+		{TxnPending, TxnRefunded, false},
+		{TxnDeclined, TxnCleared, false},
+		{TxnRefunded, TxnPartiallyRefunded, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanBecome(tt.to); got != tt.ok {
+			t.Errorf("%s to %s: got %v", tt.from.Name(), tt.to.Name(), got)
+		}
+	}
+}
+
+// A refused transition changes nothing, and says what was refused.
+func TestSetOrderStatusRefused(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	fake.Handle("select status_id from orders").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{"status_id": int64(OrderCancelled)})
+	}
+
+	changed, err := m.MarkOrderRefunded(7, OrderEvent{})
+	if changed || !errors.Is(err, ErrIllegalTransition) {
+		t.Fatalf("got %v, %v", changed, err)
+	}
+	var te *TransitionError
+	if !errors.As(err, &te) || te.ID != 7 || te.From != "Cancelled" || te.To != "Refunded" {
+		t.Errorf("got %v", err)
+	}
+	if fake.Ran("update orders") > 0 || fake.Ran("insert into order_events") > 0 {
+		t.Error("refused transition was recorded")
+	}
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Subscription is the gateway's side of a subscription order. Status is
+// the gateway's own status ("active", "past_due" and so on); the order
+// status is ours. The times are zero when the gateway hasn't told us.
+type Subscription struct {
+	ID                    int       `json:"id"`
+	OrderID               int       `json:"order_id"`
+	CustomerID            int       `json:"customer_id"`
+	GatewaySubscriptionID string    `json:"gateway_subscription_id"`
+	GatewayCustomerID     string    `json:"gateway_customer_id"`
+	PriceID               string    `json:"price_id"`
+	Status                string    `json:"status"`
+	CurrentPeriodStart    time.Time `json:"current_period_start"`
+	CurrentPeriodEnd      time.Time `json:"current_period_end"`
+	CancelAt              time.Time `json:"cancel_at"`
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"-"`
+}
+
+// nullTime stores a zero time as null.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+const subscriptionColumns = `
+	id, order_id, customer_id, gateway_subscription_id, gateway_customer_id,
+	price_id, status, current_period_start, current_period_end, cancel_at,
+	created_at, updated_at
+`
+
+func scanSubscription(row rowScanner) (*Subscription, error) {
+	var s Subscription
+	var start, end, cancelAt sql.NullTime
+	err := row.Scan(
+		&s.ID,
+		&s.OrderID,
+		&s.CustomerID,
+		&s.GatewaySubscriptionID,
+		&s.GatewayCustomerID,
+		&s.PriceID,
+		&s.Status,
+		&start,
+		&end,
+		&cancelAt,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.CurrentPeriodStart = start.Time
+	s.CurrentPeriodEnd = end.Time
+	s.CancelAt = cancelAt.Time
+	return &s, nil
+}
+
+// InsertSubscription inserts a new subscription, and returns its id
+func (tx *Tx) InsertSubscription(s Subscription) (int, error) {
+	stmt := `
+		insert into subscriptions
+			(order_id, customer_id, gateway_subscription_id, gateway_customer_id,
+			 price_id, status, current_period_start, current_period_end, cancel_at,
+			 created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := tx.tx.ExecContext(tx.ctx, stmt,
+		s.OrderID,
+		s.CustomerID,
+		s.GatewaySubscriptionID,
+		s.GatewayCustomerID,
+		s.PriceID,
+		s.Status,
+		nullTime(s.CurrentPeriodStart),
+		nullTime(s.CurrentPeriodEnd),
+		nullTime(s.CancelAt),
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// UpdateSubscription saves what the gateway last told us about a
+// subscription, found by its gateway ID.
+func (m *DBModel) UpdateSubscription(s Subscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update subscriptions set
+			gateway_customer_id = ?, price_id = ?, status = ?,
+			current_period_start = ?, current_period_end = ?, cancel_at = ?,
+			updated_at = ?
+		where gateway_subscription_id = ?
+	`
+	_, err := m.DB.ExecContext(ctx, stmt,
+		s.GatewayCustomerID,
+		s.PriceID,
+		s.Status,
+		nullTime(s.CurrentPeriodStart),
+		nullTime(s.CurrentPeriodEnd),
+		nullTime(s.CancelAt),
+		time.Now(),
+		s.GatewaySubscriptionID,
+	)
+	return err
+}
+
+// GetSubscriptionForOrder returns the subscription behind an order, or
+// nil if the order isn't a subscription.
+func (m *DBModel) GetSubscriptionForOrder(orderID int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx,
+		`select `+subscriptionColumns+` from subscriptions where order_id = ?`, orderID)
+	s, err := scanSubscription(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return s, err
+}
+
+// GetOrderBySubscriptionID finds the order for a gateway subscription.
+func (m *DBModel) GetOrderBySubscriptionID(subID string) (*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	row := m.DB.QueryRowContext(ctx,
+		`select order_id from subscriptions where gateway_subscription_id = ?`, subID)
+	err := row.Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.GetOrder(id, true, 0)
+}
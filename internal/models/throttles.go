@@ -0,0 +1,376 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ThrottleKind is what a throttle counts failures against.
+type ThrottleKind string
+
+const (
+	// ThrottleAccount counts failed logins for an email address, whether
+	// or not there is an account for it.
+	ThrottleAccount ThrottleKind = "account"
+	// ThrottleIP counts failed logins from an IP address.
+	ThrottleIP ThrottleKind = "ip"
+	// ThrottleReset counts password reset requests for an email address.
+	ThrottleReset ThrottleKind = "reset"
+	// ThrottleResetIP counts password reset requests from an IP address.
+	// They are kept apart from logins, so asking for reset links can't
+	// lock an address out of logging in.
+	ThrottleResetIP ThrottleKind = "reset-ip"
+)
+
+// throttlePolicy says how hard a kind of throttle is on failures. The
+// first Free failures cost nothing. After that each failure doubles the
+// wait before the next try, from BaseDelay up to MaxDelay, until LockAfter
+// failures lock the key out for LockFor. Failures are forgotten once there
+// have been none for Window.
+type throttlePolicy struct {
+	Free      int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	LockAfter int
+	LockFor   time.Duration
+	Window    time.Duration
+}
+
+var throttlePolicies = map[ThrottleKind]throttlePolicy{
+	ThrottleAccount: {
+		Free:      3,
+		BaseDelay: time.Second,
+		MaxDelay:  time.Minute,
+		LockAfter: 10,
+		LockFor:   15 * time.Minute,
+		Window:    time.Hour,
+	},
+	// Many people can share an address, so it gets more slack.
+	ThrottleIP: {
+		Free:      20,
+		BaseDelay: time.Second,
+		MaxDelay:  time.Minute,
+		LockAfter: 100,
+		LockFor:   time.Hour,
+		Window:    time.Hour,
+	},
+	ThrottleReset: {
+		Free:      2,
+		BaseDelay: time.Minute,
+		MaxDelay:  15 * time.Minute,
+		LockAfter: 10,
+		LockFor:   24 * time.Hour,
+		Window:    24 * time.Hour,
+	},
+	ThrottleResetIP: {
+		Free:      10,
+		BaseDelay: time.Minute,
+		MaxDelay:  15 * time.Minute,
+		LockAfter: 50,
+		LockFor:   24 * time.Hour,
+		Window:    24 * time.Hour,
+	},
+}
+
+// ThrottleKey names what a failure counts against.
+type ThrottleKey struct {
+	Kind ThrottleKind
+	Key  string
+}
+
+// AccountKey is the throttle key for logins to email.
+func AccountKey(email string) ThrottleKey {
+	return ThrottleKey{ThrottleAccount, strings.ToLower(strings.TrimSpace(email))}
+}
+
+// IPKey is the throttle key for an IP address.
+func IPKey(ip string) ThrottleKey {
+	return ThrottleKey{ThrottleIP, ip}
+}
+
+// ResetKey is the throttle key for password resets for email.
+func ResetKey(email string) ThrottleKey {
+	return ThrottleKey{ThrottleReset, strings.ToLower(strings.TrimSpace(email))}
+}
+
+// ResetIPKey is the throttle key for password resets from an IP address.
+func ResetIPKey(ip string) ThrottleKey {
+	return ThrottleKey{ThrottleResetIP, ip}
+}
+
+// Throttle is the run of failures counted against a key.
+type Throttle struct {
+	ID          int          `json:"id"`
+	Kind        ThrottleKind `json:"kind"`
+	Key         string       `json:"key"`
+	Failures    int          `json:"failures"`
+	LastFailure time.Time    `json:"last_failure_at"`
+	// LockedUntil is zero if the key was never locked out.
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Locked says whether the key is locked out at now.
+func (t *Throttle) Locked(now time.Time) bool {
+	return t.LockedUntil.After(now)
+}
+
+// current says whether the failures still count at now. Once a lockout
+// is over, or the key has gone quiet for long enough, it starts afresh.
+func (t *Throttle) current(now time.Time) bool {
+	if !t.LockedUntil.IsZero() {
+		return t.Locked(now)
+	}
+	return now.Sub(t.LastFailure) < throttlePolicies[t.Kind].Window
+}
+
+// Wait is how long the key has to wait at now before it can try again.
+func (t *Throttle) Wait(now time.Time) time.Duration {
+	if t.Locked(now) {
+		return t.LockedUntil.Sub(now)
+	}
+	if !t.current(now) {
+		return 0
+	}
+
+	p := throttlePolicies[t.Kind]
+	extra := t.Failures - p.Free
+	if extra <= 0 {
+		return 0
+	}
+	delay := p.MaxDelay
+	if extra < 32 && p.BaseDelay<<(extra-1) < p.MaxDelay {
+		delay = p.BaseDelay << (extra - 1)
+	}
+	if wait := t.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// ReserveAttempt counts an attempt against each of keys before it is
+// checked, so that attempts made at the same time can't all get in under
+// the limit. If any key has to wait first, nothing is counted and it
+// returns the longest wait. Otherwise it returns the throttles this
+// attempt locked out, so their owners can be told if it fails. A good
+// attempt is given back with ForgiveAttempt.
+func (m *DBModel) ReserveAttempt(keys ...ThrottleKey) (time.Duration, []*Throttle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var wait time.Duration
+	var locked []*Throttle
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		now := time.Now()
+		throttles := make([]*Throttle, len(keys))
+		for i, key := range keys {
+			t, err := getThrottle(tx.ctx, tx.tx, key, true)
+			if errors.Is(err, sql.ErrNoRows) {
+				t = &Throttle{Kind: key.Kind, Key: key.Key}
+			} else if err != nil {
+				return err
+			}
+			if w := t.Wait(now); w > wait {
+				wait = w
+			}
+			throttles[i] = t
+		}
+		if wait > 0 {
+			return nil
+		}
+
+		for _, t := range throttles {
+			if !t.current(now) {
+				t.Failures = 0
+				t.LockedUntil = time.Time{}
+			}
+
+			t.Failures++
+			t.LastFailure = now
+			p := throttlePolicies[t.Kind]
+			if t.Failures >= p.LockAfter && t.LockedUntil.IsZero() {
+				t.LockedUntil = now.Add(p.LockFor)
+				locked = append(locked, t)
+			}
+
+			err := saveThrottle(tx, t, now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return wait, locked, nil
+}
+
+// ForgiveAttempt takes back an attempt ReserveAttempt counted against
+// each of keys, once it has turned out to be good. A lockout the attempt
+// brought on is lifted with it.
+func (m *DBModel) ForgiveAttempt(keys ...ThrottleKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		now := time.Now()
+		for _, key := range keys {
+			t, err := getThrottle(tx.ctx, tx.tx, key, true)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if t.Failures == 0 {
+				continue
+			}
+
+			t.Failures--
+			if t.Failures < throttlePolicies[t.Kind].LockAfter {
+				t.LockedUntil = time.Time{}
+			}
+			err = saveThrottle(tx, t, now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func saveThrottle(tx *Tx, t *Throttle, now time.Time) error {
+	_, err := tx.tx.ExecContext(tx.ctx, `
+		insert into login_throttles
+			(kind, throttle_key, failures, last_failure_at, locked_until,
+			 created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
+		on duplicate key update
+			failures = values(failures),
+			last_failure_at = values(last_failure_at),
+			locked_until = values(locked_until),
+			updated_at = values(updated_at)`,
+		t.Kind,
+		t.Key,
+		t.Failures,
+		t.LastFailure,
+		nullTime(t.LockedUntil),
+		now,
+		now,
+	)
+	return err
+}
+
+func getThrottle(ctx context.Context, db queryer, key ThrottleKey, forUpdate bool) (*Throttle, error) {
+	query := `
+		select id, kind, throttle_key, failures, last_failure_at, locked_until
+		from login_throttles
+		where kind = ? and throttle_key = ?`
+	if forUpdate {
+		query += " for update"
+	}
+
+	var t Throttle
+	var lockedUntil sql.NullTime
+	err := db.QueryRowContext(ctx, query, key.Kind, key.Key).Scan(
+		&t.ID,
+		&t.Kind,
+		&t.Key,
+		&t.Failures,
+		&t.LastFailure,
+		&lockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.LockedUntil = lockedUntil.Time
+	return &t, nil
+}
+
+// ClearThrottle forgets the failures against key, as after a good login.
+func (m *DBModel) ClearThrottle(key ThrottleKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx,
+		`delete from login_throttles where kind = ? and throttle_key = ?`,
+		key.Kind, key.Key)
+	return err
+}
+
+// GetThrottles lists the keys that have failures that still count, the
+// most recent first. Keys that have gone quiet are cleaned up.
+func (m *DBModel) GetThrottles() ([]*Throttle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select id, kind, throttle_key, failures, last_failure_at, locked_until
+		from login_throttles
+		order by last_failure_at desc
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var throttles []*Throttle
+	var stale []int
+	for rows.Next() {
+		var t Throttle
+		var lockedUntil sql.NullTime
+		err = rows.Scan(
+			&t.ID,
+			&t.Kind,
+			&t.Key,
+			&t.Failures,
+			&t.LastFailure,
+			&lockedUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		t.LockedUntil = lockedUntil.Time
+		if !t.current(now) {
+			stale = append(stale, t.ID)
+			continue
+		}
+		throttles = append(throttles, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range stale {
+		_, err = m.DB.ExecContext(ctx, `delete from login_throttles where id = ?`, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return throttles, nil
+}
+
+// DeleteThrottle clears a lockout. It returns sql.ErrNoRows if there is no
+// such throttle.
+func (m *DBModel) DeleteThrottle(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from login_throttles where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+func TestThrottleWait(t *testing.T) {
+	now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		throttle Throttle
+		want     time.Duration
+	}{
+		{"free failures", Throttle{Kind: ThrottleAccount, Failures: 3, LastFailure: now}, 0},
+		{"first delay", Throttle{Kind: ThrottleAccount, Failures: 4, LastFailure: now}, time.Second},
+		{"doubled", Throttle{Kind: ThrottleAccount, Failures: 6, LastFailure: now}, 4 * time.Second},
+		{"partly waited", Throttle{Kind: ThrottleAccount, Failures: 6, LastFailure: now.Add(-time.Second)}, 3 * time.Second},
+		{"capped", Throttle{Kind: ThrottleIP, Failures: 60, LastFailure: now}, time.Minute},
+		{"locked", Throttle{Kind: ThrottleAccount, Failures: 10, LastFailure: now, LockedUntil: now.Add(15 * time.Minute)}, 15 * time.Minute},
+		{"lock over", Throttle{Kind: ThrottleAccount, Failures: 10, LastFailure: now.Add(-time.Hour), LockedUntil: now.Add(-time.Minute)}, 0},
+		{"gone quiet", Throttle{Kind: ThrottleAccount, Failures: 9, LastFailure: now.Add(-2 * time.Hour)}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.throttle.Wait(now); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The attempt that reaches the limit locks the key out, and is reported;
+// a key with no attempts yet starts counting.
+func TestReserveAttempt(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	account := AccountKey(" Jane@Example.com")
+	fake.Handle("from login_throttles").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		if args[0] != string(ThrottleAccount) {
+			return fakedb.RowsFrom(q)
+		}
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":              int64(1),
+			"kind":            args[0],
+			"throttle_key":    args[1],
+			"failures":        int64(9),
+			"last_failure_at": time.Now().Add(-time.Minute),
+			"locked_until":    nil,
+		})
+	}
+	saved := map[string]driver.Value{}
+	fake.Handle("insert into login_throttles").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		saved[args[0].(string)+":"+args[1].(string)] = args[2]
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+
+	wait, locked, err := m.ReserveAttempt(account, IPKey("10.0.0.1"))
+	if err != nil || wait != 0 {
+		t.Fatal(wait, err)
+	}
+	if len(locked) != 1 || locked[0].Key != "jane@example.com" || !locked[0].Locked(time.Now()) {
+		t.Errorf("got locked %+v", locked)
+	}
+	if saved["account:jane@example.com"] != int64(10) || saved["ip:10.0.0.1"] != int64(1) {
+		t.Errorf("saved failures %v", saved)
+	}
+}
+
+// An attempt that has to wait isn't counted; one that turned out good is
+// taken back, along with the lockout it brought on.
+func TestForgiveAttempt(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	failures := int64(9)
+	lastFailure := time.Now()
+	var lockedUntil driver.Value
+	fake.Handle("from login_throttles").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":              int64(1),
+			"kind":            args[0],
+			"throttle_key":    args[1],
+			"failures":        failures,
+			"last_failure_at": lastFailure,
+			"locked_until":    lockedUntil,
+		})
+	}
+	fake.Handle("insert into login_throttles").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		failures = args[2].(int64)
+		lockedUntil = args[4]
+		return fakedb.Result{ID: 1, Affected: 1}, nil
+	}
+
+	account := AccountKey("jane@example.com")
+	wait, _, err := m.ReserveAttempt(account)
+	if err != nil || wait == 0 {
+		t.Fatalf("got wait %v, %v", wait, err)
+	}
+	if failures != 9 {
+		t.Errorf("an attempt that had to wait was counted: %d", failures)
+	}
+
+	lastFailure = time.Now().Add(-10 * time.Minute)
+	_, locked, err := m.ReserveAttempt(account)
+	if err != nil || failures != 10 || len(locked) != 1 {
+		t.Fatalf("reserved to %d, locked %v, %v", failures, locked, err)
+	}
+	err = m.ForgiveAttempt(account)
+	if err != nil || failures != 9 || lockedUntil != nil {
+		t.Errorf("forgiven to %d, locked until %v, %v", failures, lockedUntil, err)
+	}
+}
@@ -4,15 +4,27 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
 	"errors"
 	"time"
 )
 
 const (
+	// ScopeAuthentication tokens are short-lived access tokens, sent as
+	// the bearer token on API calls.
 	ScopeAuthentication = "authentication"
+	// ScopeRefresh tokens are traded for a new access token when the old
+	// one runs out. Each one is a session: a device the user is logged in on.
+	ScopeRefresh = "refresh"
+	// ScopeTwoFactor tokens are for a login that is waiting on its second
+	// step.
+	ScopeTwoFactor = "2fa"
 )
 
+// ErrTokenExpired is returned for a token that is past its expiry.
+var ErrTokenExpired = errors.New("token expired")
+
 type Token struct {
 	ID        int       `json:"id"`
 	PlainText string    `json:"token"`
@@ -22,6 +34,24 @@ type Token struct {
 	Hash      []byte    `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// RefreshTokenID is the refresh token an access token was issued
+	// with, or 0.
+	RefreshTokenID int    `json:"-"`
+	Label          string `json:"-"`
+	UserAgent      string `json:"-"`
+}
+
+// Session is a device a user is logged in on. It is a refresh token, with
+// the access tokens issued from it.
+type Session struct {
+	ID         int       `json:"id"`
+	Label      string    `json:"label"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	// Current is true for the session making the request.
+	Current bool `json:"current"`
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -42,82 +72,307 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	return &token, nil
 }
 
-func (m *DBModel) InsertToken(token *Token, user User) error {
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	// Delete any stray tokens still hanging out.
-	delete := `
-	delete from tokens where user_id = ?
-	`
-	_, err := m.DB.ExecContext(ctx, delete, user.ID)
-	if err != nil {
-		return err
-	}
-
+// insertToken saves a token, and sets its ID.
+func insertToken(ctx context.Context, db execer, token *Token, user User) error {
 	stmt := `
 		insert into tokens
-			(user_id, name, email, token_hash,
+			(user_id, name, email, token_hash, scope, expiry,
+			 refresh_token_id, label, user_agent,
 			 created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err = m.DB.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		user.ID,
 		user.LastName,
 		user.Email,
 		token.Hash,
+		token.Scope,
+		token.Expiry,
+		sql.NullInt64{Int64: int64(token.RefreshTokenID), Valid: token.RefreshTokenID > 0},
+		token.Label,
+		token.UserAgent,
 		time.Now(),
 		time.Now(),
 	)
 	if err != nil {
 		return err
 	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	token.ID = int(id)
 	return nil
 }
 
+// InsertToken saves a token. A user may have any number of them.
+func (m *DBModel) InsertToken(token *Token, user User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertToken(ctx, m.DB, token, user)
+}
+
+// issueTokens starts a session for user: a refresh token, and an access
+// token that belongs to it.
+func (tx *Tx) issueTokens(user User, label, userAgent string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	refresh, err := GenerateToken(user.ID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh.Label = label
+	refresh.UserAgent = userAgent
+	err = insertToken(tx.ctx, tx.tx, refresh, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, err := GenerateToken(user.ID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	access.RefreshTokenID = refresh.ID
+	access.Label = label
+	access.UserAgent = userAgent
+	err = insertToken(tx.ctx, tx.tx, access, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// NewSession logs user in on another device. It returns an access token
+// and the refresh token that renews it. The label names the device for
+// the user; it may be empty.
+func (m *DBModel) NewSession(user User, label, userAgent string, accessTTL, refreshTTL time.Duration) (access, refresh *Token, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.WithTx(ctx, func(tx *Tx) error {
+		access, refresh, err = tx.issueTokens(user, label, userAgent, accessTTL, refreshTTL)
+		return err
+	})
+	return access, refresh, err
+}
+
+// RefreshSession trades a refresh token for a new access token and a new
+// refresh token. The old refresh token, and any access tokens issued from
+// it, stop working.
+func (m *DBModel) RefreshSession(refreshToken string, accessTTL, refreshTTL time.Duration) (access, refresh *Token, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.WithTx(ctx, func(tx *Tx) error {
+		var old Token
+		var u User
+		row := tx.tx.QueryRowContext(tx.ctx, `
+			select
+				t.id, t.label, t.user_agent, t.expiry,
+				u.id, u.last_name, u.email
+			from tokens t
+			inner join users u on t.user_id = u.id
+			where t.token_hash = ? and t.scope = ?
+			for update`,
+			CreateTokenHash(refreshToken), ScopeRefresh)
+		err := row.Scan(
+			&old.ID,
+			&old.Label,
+			&old.UserAgent,
+			&old.Expiry,
+			&u.ID,
+			&u.LastName,
+			&u.Email,
+		)
+		if err != nil {
+			return err
+		}
+
+		if old.Expiry.Before(time.Now()) {
+			return ErrTokenExpired
+		}
+
+		// Deleting the refresh token deletes its access tokens too.
+		_, err = tx.tx.ExecContext(tx.ctx, `delete from tokens where id = ?`, old.ID)
+		if err != nil {
+			return err
+		}
+
+		access, refresh, err = tx.issueTokens(u, old.Label, old.UserAgent, accessTTL, refreshTTL)
+		return err
+	})
+	return access, refresh, err
+}
+
 func CreateTokenHash(token string) []byte {
 	hash := sha256.Sum256([]byte(token))
 	return hash[:]
 }
 
-func (m *DBModel) GetUserFromToken(token string, ttl time.Duration) (*User, error) {
+// GetUserFromToken returns the user a token belongs to. The token must be
+// for scope, and not have expired.
+func (m *DBModel) GetUserFromToken(token, scope string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	hash := CreateTokenHash(token)
-	var created time.Time
+	var t Token
 	var u User
 
 	query := `
 		select
 			u.id, u.first_name, u.last_name,
-			u.email, t.created_at
+			u.email, u.role_id,
+			t.id, coalesce(t.refresh_token_id, 0), t.expiry
 		from users u
 		inner join tokens t on t.user_id = u.id
-		where t.token_hash = ?
+		where t.token_hash = ? and t.scope = ?
 	`
-	row := m.DB.QueryRowContext(ctx, query, hash)
+	row := m.DB.QueryRowContext(ctx, query, hash, scope)
 	err := row.Scan(
 		&u.ID,
 		&u.FirstName,
 		&u.LastName,
 		&u.Email,
-		&created,
+		&u.RoleID,
+		&t.ID,
+		&t.RefreshTokenID,
+		&t.Expiry,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
-	expired := created.Add(ttl)
-	if expired.Before(time.Now()) {
-		return nil, errors.New("token expired")
+	if t.Expiry.Before(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	// The session was used too, so mark its refresh token as well.
+	_, err = m.DB.ExecContext(ctx, `
+		update tokens set last_used_at = ? where id in (?, ?)`,
+		time.Now(), t.ID, t.RefreshTokenID)
+	if err != nil {
+		return nil, err
 	}
 	return &u, nil
 }
 
+// sessionOf returns the ID of the session a token belongs to. An access
+// token from before refresh tokens is a session of its own.
+func sessionOf(ctx context.Context, db *sql.DB, token string) (int, error) {
+	var id int
+	row := db.QueryRowContext(ctx, `
+		select coalesce(refresh_token_id, id) from tokens where token_hash = ?`,
+		CreateTokenHash(token))
+	err := row.Scan(&id)
+	return id, err
+}
+
+// RevokeSession logs out the session that token, an access or refresh
+// token, belongs to.
+func (m *DBModel) RevokeSession(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	id, err := sessionOf(ctx, m.DB, token)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `
+		delete from tokens where id = ? or refresh_token_id = ?`, id, id)
+	return err
+}
+
+// RevokeUserSession logs out one of a user's sessions. It returns
+// sql.ErrNoRows if the user has no such session.
+func (m *DBModel) RevokeUserSession(userID, sessionID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		delete from tokens
+		where id = ? and user_id = ? and refresh_token_id is null
+			and scope in (?, ?)`,
+		sessionID, userID, ScopeRefresh, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeAllSessions logs a user out everywhere.
+func (m *DBModel) RevokeAllSessions(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		delete from tokens where user_id = ? and scope in (?, ?)`,
+		userID, ScopeRefresh, ScopeAuthentication)
+	return err
+}
+
+// GetSessions lists the sessions a user is logged in with, most recently
+// used first. The session that token belongs to is marked as current.
+func (m *DBModel) GetSessions(userID int, token string) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	current, err := sessionOf(ctx, m.DB, token)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select
+			id, label, user_agent, created_at,
+			coalesce(last_used_at, created_at), expiry
+		from tokens
+		where
+			user_id = ? and refresh_token_id is null
+			and scope in (?, ?) and expiry > ?
+		order by
+			coalesce(last_used_at, created_at) desc
+	`, userID, ScopeRefresh, ScopeAuthentication, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		var s Session
+		err = rows.Scan(
+			&s.ID,
+			&s.Label,
+			&s.UserAgent,
+			&s.CreatedAt,
+			&s.LastUsedAt,
+			&s.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+		s.Current = s.ID == current
+		sessions = append(sessions, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
 func (m *DBModel) GetEmailFromToken(token string, ttl time.Duration) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+)
+
+// Only a token's hash is stored, so the hash must be what it is looked up
+// by.
+func TestGenerateToken(t *testing.T) {
+	a, err := GenerateToken(1, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateToken(1, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PlainText == b.PlainText || len(a.PlainText) != 26 {
+		t.Errorf("got tokens %q and %q", a.PlainText, b.PlainText)
+	}
+	if !bytes.Equal(a.Hash, CreateTokenHash(a.PlainText)) {
+		t.Error("token hash differs from its lookup hash")
+	}
+}
+
+// tokenDB fakes a token for user 4 that expires at expiry, and returns the
+// handler for marking tokens used.
+func tokenDB(t *testing.T, token string, expiry time.Time) (DBModel, *fakedb.Handler) {
+	db, fake := fakedb.New(t)
+	fake.Handle("from users u").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		if !bytes.Equal(args[0].([]byte), CreateTokenHash(token)) || args[1] != ScopeRefresh {
+			return fakedb.RowsFrom(q)
+		}
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":                              int64(4),
+			"first_name":                      "Jane",
+			"last_name":                       "Doe",
+			"email":                           "jane@example.com",
+			"role_id":                         int64(1),
+			"coalesce(t.refresh_token_id, 0)": int64(0),
+			"expiry":                          expiry,
+		})
+	}
+	return DBModel{DB: db}, fake.Handle("update tokens set last_used_at")
+}
+
+func TestGetUserFromToken(t *testing.T) {
+	m, used := tokenDB(t, "GOODTOKEN", time.Now().Add(time.Hour))
+	u, err := m.GetUserFromToken("GOODTOKEN", ScopeRefresh)
+	if err != nil || u.ID != 4 || used.Calls != 1 {
+		t.Fatalf("got %+v, %v, used %d times", u, err, used.Calls)
+	}
+
+	_, err = m.GetUserFromToken("GOODTOKEN", ScopeAuthentication)
+	if err == nil {
+		t.Error("token found for the wrong scope")
+	}
+	_, err = m.GetUserFromToken("BADTOKEN", ScopeRefresh)
+	if err == nil {
+		t.Error("unknown token found")
+	}
+
+	m, used = tokenDB(t, "OLDTOKEN", time.Now().Add(-time.Minute))
+	_, err = m.GetUserFromToken("OLDTOKEN", ScopeRefresh)
+	if !errors.Is(err, ErrTokenExpired) || used.Calls != 0 {
+		t.Errorf("expired token: got %v, used %d times", err, used.Calls)
+	}
+}
+
+// Refreshing a session swaps its refresh token for a new pair. The old
+// one, and the access tokens it issued, are deleted with it.
+func TestRefreshSession(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	expiry := time.Now().Add(time.Hour)
+	fake.Handle("from tokens t").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		if !bytes.Equal(args[0].([]byte), CreateTokenHash("REFRESHTOKEN")) || args[1] != ScopeRefresh {
+			return fakedb.RowsFrom(q)
+		}
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"id":         int64(4),
+			"label":      "laptop",
+			"user_agent": "test",
+			"expiry":     expiry,
+			"last_name":  "Doe",
+			"email":      "jane@example.com",
+		})
+	}
+	deleted := fake.Handle("delete from tokens")
+	inserted := fake.Handle("insert into tokens")
+	inserted.Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		return fakedb.Result{ID: int64(10 + inserted.Calls), Affected: 1}, nil
+	}
+
+	access, refresh, err := m.RefreshSession("REFRESHTOKEN", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.Calls != 1 || inserted.Calls != 2 {
+		t.Errorf("deleted %d tokens, inserted %d", deleted.Calls, inserted.Calls)
+	}
+	if access.RefreshTokenID != refresh.ID || refresh.Label != "laptop" || access.Scope != ScopeAuthentication {
+		t.Errorf("got access %+v, refresh %+v", access, refresh)
+	}
+
+	_, _, err = m.RefreshSession("ACCESSTOKEN", time.Hour, 24*time.Hour)
+	if err == nil {
+		t.Error("refreshed with an unknown token")
+	}
+
+	expiry = time.Now().Add(-time.Minute)
+	_, _, err = m.RefreshSession("REFRESHTOKEN", time.Hour, 24*time.Hour)
+	if !errors.Is(err, ErrTokenExpired) || deleted.Calls != 1 {
+		t.Errorf("expired token: got %v, deleted %d tokens", err, deleted.Calls)
+	}
+}
@@ -0,0 +1,384 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/totp"
+)
+
+// How many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+// settingRequire2FA is the settings row for the two-factor policy.
+const settingRequire2FA = "require_2fa"
+
+var (
+	// ErrBadCode is returned for a wrong, expired or already used
+	// authenticator or recovery code.
+	ErrBadCode = errors.New("that code is not right")
+	// ErrTwoFactorEnabled is returned when setting up two-factor login for
+	// a user who already has it.
+	ErrTwoFactorEnabled = errors.New("two-factor login is already on")
+	// ErrNoTwoFactorSetup is returned when turning on two-factor login
+	// before a secret has been made for it.
+	ErrNoTwoFactorSetup = errors.New("two-factor login has not been set up")
+	// ErrTwoFactorRequired is returned for a change the two-factor policy
+	// doesn't allow.
+	ErrTwoFactorRequired = errors.New("two-factor login is required")
+)
+
+// TwoFactor is a user's two-factor login state.
+type TwoFactor struct {
+	Secret  string `json:"-"`
+	Enabled bool   `json:"enabled"`
+	// Pending is true part way through setting it up: there is a secret,
+	// but it hasn't been turned on.
+	Pending bool `json:"pending"`
+	// Required is true if the policy makes every admin use it.
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// GetTwoFactor returns a user's two-factor login state.
+func (m *DBModel) GetTwoFactor(userID int) (*TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tf TwoFactor
+	row := m.DB.QueryRowContext(ctx, `
+		select
+			u.totp_secret, u.totp_enabled,
+			(select count(id) from recovery_codes
+			 where user_id = u.id and used_at is null)
+		from users u
+		where u.id = ?`, userID)
+	err := row.Scan(&tf.Secret, &tf.Enabled, &tf.RecoveryCodesLeft)
+	if err != nil {
+		return nil, err
+	}
+	tf.Pending = tf.Secret != "" && !tf.Enabled
+
+	tf.Required, err = m.require2FA(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// SetTOTPSecret starts setting up two-factor login for a user, with a new
+// secret. Nothing changes at login until EnableTwoFactor is called.
+func (m *DBModel) SetTOTPSecret(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		update users
+		set totp_secret = ?, totp_last_step = 0, updated_at = ?
+		where id = ? and totp_enabled = 0`,
+		secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// useTOTPCode checks an authenticator code against a secret. A code is
+// only good once: the step it was for is stored, and codes for that step
+// or earlier are refused.
+func (tx *Tx) useTOTPCode(userID int, secret string, lastStep int64, code string) error {
+	step, ok := totp.Verify(secret, code, time.Now())
+	if !ok || step <= lastStep {
+		return ErrBadCode
+	}
+	_, err := tx.tx.ExecContext(tx.ctx,
+		`update users set totp_last_step = ? where id = ?`, step, userID)
+	return err
+}
+
+// EnableTwoFactor finishes setting up two-factor login, once the user
+// shows that their authenticator gives the right code. It returns the
+// user's recovery codes; they can't be seen again.
+func (m *DBModel) EnableTwoFactor(userID int, code string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var codes []string
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		var secret string
+		var enabled bool
+		var lastStep int64
+		row := tx.tx.QueryRowContext(tx.ctx, `
+			select totp_secret, totp_enabled, totp_last_step
+			from users
+			where id = ?
+			for update`, userID)
+		err := row.Scan(&secret, &enabled, &lastStep)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return ErrTwoFactorEnabled
+		}
+		if secret == "" {
+			return ErrNoTwoFactorSetup
+		}
+
+		err = tx.useTOTPCode(userID, secret, lastStep, code)
+		if err != nil {
+			return err
+		}
+		_, err = tx.tx.ExecContext(tx.ctx, `
+			update users set totp_enabled = 1, updated_at = ? where id = ?`,
+			time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		codes, err = tx.newRecoveryCodes(userID)
+		return err
+	})
+	return codes, err
+}
+
+// CheckSecondFactor checks the second step of a login: a code from the
+// user's authenticator, or one of their recovery codes. Either can only
+// be used once. It returns ErrBadCode if the code is no good.
+func (m *DBModel) CheckSecondFactor(userID int, code string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		var secret string
+		var enabled bool
+		var lastStep int64
+		row := tx.tx.QueryRowContext(tx.ctx, `
+			select totp_secret, totp_enabled, totp_last_step
+			from users
+			where id = ?
+			for update`, userID)
+		err := row.Scan(&secret, &enabled, &lastStep)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrNoTwoFactorSetup
+		}
+
+		// People type codes the way they are shown, "123 456", so spaces
+		// are dropped before telling the two kinds apart.
+		code = strings.Join(strings.Fields(code), "")
+		if len(code) == totp.Digits {
+			return tx.useTOTPCode(userID, secret, lastStep, code)
+		}
+
+		result, err := tx.tx.ExecContext(tx.ctx, `
+			update recovery_codes
+			set used_at = ?, updated_at = ?
+			where user_id = ? and code_hash = ? and used_at is null`,
+			time.Now(), time.Now(), userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrBadCode
+		}
+		return nil
+	})
+}
+
+// DisableTwoFactor turns off two-factor login for a user, and throws away
+// their secret and recovery codes.
+func (m *DBModel) DisableTwoFactor(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		_, err := tx.tx.ExecContext(tx.ctx, `
+			update users
+			set totp_secret = '', totp_enabled = 0, totp_last_step = 0,
+				updated_at = ?
+			where id = ?`,
+			time.Now(), userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.tx.ExecContext(tx.ctx, `delete from recovery_codes where user_id = ?`, userID)
+		return err
+	})
+}
+
+// NewRecoveryCodes replaces a user's recovery codes.
+func (m *DBModel) NewRecoveryCodes(userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var codes []string
+	err := m.WithTx(ctx, func(tx *Tx) error {
+		var err error
+		codes, err = tx.newRecoveryCodes(userID)
+		return err
+	})
+	return codes, err
+}
+
+// normalizeRecoveryCode lets a code be typed in any case, with or
+// without its dash.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func hashRecoveryCode(code string) []byte {
+	return CreateTokenHash(normalizeRecoveryCode(code))
+}
+
+// newRecoveryCodes throws away a user's recovery codes, and makes new
+// ones. Only their hashes are kept.
+func (tx *Tx) newRecoveryCodes(userID int) ([]string, error) {
+	_, err := tx.tx.ExecContext(tx.ctx, `delete from recovery_codes where user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err = rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(enc.EncodeToString(randomBytes))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+
+		_, err = tx.tx.ExecContext(tx.ctx, `
+			insert into recovery_codes (user_id, code_hash, created_at, updated_at)
+			values (?, ?, ?, ?)`,
+			userID, hashRecoveryCode(codes[i]), time.Now(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func (m *DBModel) require2FA(ctx context.Context) (bool, error) {
+	var value string
+	row := m.DB.QueryRowContext(ctx,
+		`select value from settings where name = ?`, settingRequire2FA)
+	err := row.Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return value == "true", err
+}
+
+// Require2FA reports whether every admin must use two-factor login.
+func (m *DBModel) Require2FA() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.require2FA(ctx)
+}
+
+// SetRequire2FA sets whether every admin must use two-factor login. When
+// it is turned on, users without it are logged out, so that they have to
+// set it up when they next log in. Their API tokens are deleted here; the
+// web app ends their sessions when it sees the setting.
+func (m *DBModel) SetRequire2FA(required bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	value := "false"
+	if required {
+		value = "true"
+	}
+
+	return m.WithTx(ctx, func(tx *Tx) error {
+		_, err := tx.tx.ExecContext(tx.ctx, `
+			insert into settings (name, value, created_at, updated_at)
+			values (?, ?, ?, ?)
+			on duplicate key update value = values(value), updated_at = values(updated_at)`,
+			settingRequire2FA, value, time.Now(), time.Now())
+		if err != nil || !required {
+			return err
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx, `
+			delete t from tokens t
+			inner join users u on t.user_id = u.id
+			where u.totp_enabled = 0 and t.scope in (?, ?)`,
+			ScopeRefresh, ScopeAuthentication)
+		return err
+	})
+}
+
+// NewLoginChallenge is for a login that got the password right, and still
+// has to pass the second step. The challenge token stands in for the
+// password until then. label and userAgent are kept for the session the
+// login will start.
+func (m *DBModel) NewLoginChallenge(user User, label, userAgent string, ttl time.Duration) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token, err := GenerateToken(user.ID, ttl, ScopeTwoFactor)
+	if err != nil {
+		return nil, err
+	}
+	token.Label = label
+	token.UserAgent = userAgent
+	err = insertToken(ctx, m.DB, token, user)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetLoginChallenge returns a challenge made by NewLoginChallenge. It
+// returns ErrTokenExpired if the challenge is too old.
+func (m *DBModel) GetLoginChallenge(challenge string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t Token
+	row := m.DB.QueryRowContext(ctx, `
+		select id, user_id, label, user_agent, expiry
+		from tokens
+		where token_hash = ? and scope = ?`,
+		CreateTokenHash(challenge), ScopeTwoFactor)
+	err := row.Scan(&t.ID, &t.UserID, &t.Label, &t.UserAgent, &t.Expiry)
+	if err != nil {
+		return nil, err
+	}
+	if t.Expiry.Before(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+	t.Scope = ScopeTwoFactor
+	return &t, nil
+}
+
+// DeleteToken deletes a token by its ID.
+func (m *DBModel) DeleteToken(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from tokens where id = ?`, id)
+	return err
+}
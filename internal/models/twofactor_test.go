@@ -0,0 +1,77 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/torenware/go-stripe/internal/testutil/fakedb"
+	"github.com/torenware/go-stripe/internal/totp"
+)
+
+// An authenticator code typed with a space in it, as it is shown, is
+// checked as one, not as a recovery code.
+func TestCheckSecondFactorSpaced(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Handle("from users").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"totp_secret":    secret,
+			"totp_enabled":   true,
+			"totp_last_step": int64(0),
+		})
+	}
+	used := fake.Handle("update users set totp_last_step")
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CheckSecondFactor(1, code[:3]+" "+code[3:]+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used.Calls != 1 || fake.Ran("recovery_codes") != 0 {
+		t.Errorf("code used %d times; statements %q", used.Calls, fake.Log)
+	}
+}
+
+// A recovery code can be typed in any case, with or without its dash, but
+// only used once.
+func TestCheckSecondFactorRecoveryCode(t *testing.T) {
+	db, fake := fakedb.New(t)
+	m := DBModel{DB: db}
+
+	fake.Handle("update recovery_codes").Exec = func(q string, args []driver.Value) (driver.Result, error) {
+		if !bytes.Equal(args[3].([]byte), CreateTokenHash("abcdefghij")) {
+			return fakedb.Result{}, nil
+		}
+		return fakedb.Result{Affected: 1}, nil
+	}
+	fake.Handle("from users").Query = func(q string, args []driver.Value) (*fakedb.Rows, error) {
+		return fakedb.RowsFrom(q, map[string]driver.Value{
+			"totp_secret":    "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+			"totp_enabled":   true,
+			"totp_last_step": int64(0),
+		})
+	}
+
+	err := m.CheckSecondFactor(1, " ABCDE-fghij\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CheckSecondFactor(1, "abcde-fghik")
+	if !errors.Is(err, ErrBadCode) {
+		t.Errorf("wrong code: got %v", err)
+	}
+	if fake.Ran("update users") != 0 {
+		t.Error("a recovery code was checked as an authenticator code")
+	}
+}
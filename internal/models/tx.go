@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so that the insert
+// helpers can run inside or outside of a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is the same for lookups.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Tx is a database transaction in progress. Get one from WithTx.
+type Tx struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+// WithTx runs fn inside a database transaction. The transaction is
+// committed if fn returns nil, and rolled back otherwise.
+func (m *DBModel) WithTx(ctx context.Context, fn func(tx *Tx) error) error {
+	sqlTx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = sqlTx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(&Tx{ctx: ctx, tx: sqlTx})
+	if err != nil {
+		_ = sqlTx.Rollback()
+		return err
+	}
+
+	return sqlTx.Commit()
+}
+
+// InsertTransaction inserts a new txn, and returns its id
+func (tx *Tx) InsertTransaction(txn Transaction) (int, error) {
+	return insertTransaction(tx.ctx, tx.tx, txn)
+}
+
+// InsertOrder inserts a new order, and returns its id
+func (tx *Tx) InsertOrder(order Order) (int, error) {
+	return insertOrder(tx.ctx, tx.tx, order)
+}
+
+// Purchase is everything we write for a completed payment.
+type Purchase struct {
+	Customer Customer
+	// CustomerVerified is set when the buyer showed they own the email
+	// address, by logging in. Only then may a purchase change the name or
+	// gateway customer of someone who has bought before.
+	CustomerVerified bool
+	Transaction      Transaction
+	// Order is nil for the virtual terminal, which has no order.
+	Order *Order
+	// Items are the lines of the order. If there are none, the order is
+	// recorded as a single line for its widget.
+	Items []OrderItem
+	// Subscription is set when the order is for a subscription.
+	Subscription *Subscription
+	// PaymentMethod is set when the customer saved their card.
+	PaymentMethod *PaymentMethod
+}
+
+// RecordPurchase writes the customer, transaction and order of a purchase
+// in a single database transaction, so that a failure part way through
+// does not leave orphan rows behind. A customer who has bought before
+// keeps their existing record. The customer, transaction and order
+// IDs are filled in for you, including the subscription's. The items are taken out of stock, and if
+// there aren't enough nothing is written and the error matches
+// ErrOutOfStock. A pending order's items are only held, for
+// PendingPaymentHold, until ClearPendingPayment takes them.
+func (m *DBModel) RecordPurchase(p Purchase) (customerID, txnID, orderID int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.WithTx(ctx, func(tx *Tx) error {
+		var err error
+		customerID, err = tx.UpsertCustomer(p.Customer, p.CustomerVerified)
+		if err != nil {
+			return err
+		}
+
+		txnID, err = tx.InsertTransaction(p.Transaction)
+		if err != nil {
+			return err
+		}
+
+		if p.PaymentMethod != nil {
+			pm := *p.PaymentMethod
+			pm.CustomerID = customerID
+			err = tx.SavePaymentMethod(pm)
+			if err != nil {
+				return err
+			}
+		}
+
+		if p.Order == nil {
+			return nil
+		}
+
+		order := *p.Order
+		order.CustomerID = customerID
+		order.TransactionID = txnID
+		orderID, err = tx.InsertOrder(order)
+		if err != nil {
+			return err
+		}
+
+		items := p.Items
+		if len(items) == 0 {
+			unitPrice := order.Amount
+			if order.Quantity > 0 {
+				unitPrice = order.Amount / order.Quantity
+			}
+			items = []OrderItem{{
+				WidgetID:  order.WidgetID,
+				Quantity:  order.Quantity,
+				UnitPrice: unitPrice,
+				Amount:    order.Amount,
+			}}
+		}
+		for _, item := range items {
+			item.OrderID = orderID
+			_, err = tx.InsertOrderItem(item)
+			if err != nil {
+				return err
+			}
+		}
+
+		if p.Subscription != nil {
+			subscription := *p.Subscription
+			subscription.OrderID = orderID
+			subscription.CustomerID = customerID
+			_, err = tx.InsertSubscription(subscription)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A pending payment may never go through, so its stock is only
+		// held, until the payment clears or the hold runs out.
+		if order.StatusID == OrderPending && order.Reference != "" {
+			return tx.reserve(order.Reference, PendingPaymentHold, items)
+		}
+		return tx.takeInventory(order.Reference, items)
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return customerID, txnID, orderID, nil
+}
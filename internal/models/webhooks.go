@@ -0,0 +1,60 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// StripeEvent is a webhook event we have already seen
+type StripeEvent struct {
+	ID        int       `json:"id"`
+	EventID   string    `json:"event_id"`
+	EventType string    `json:"event_type"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// RecordStripeEvent saves the ID of a webhook event. Stripe will happily
+// deliver the same event more than once, so this returns false if we
+// have already recorded it.
+func (m *DBModel) RecordStripeEvent(eventID, eventType string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert ignore into stripe_events
+			(event_id, event_type, created_at, updated_at)
+		values (?, ?, ?, ?)
+	`
+	result, err := m.DB.ExecContext(ctx, stmt,
+		eventID,
+		eventType,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// ForgetStripeEvent removes an event record, so that a redelivery of an
+// event we failed to process will be handled again.
+func (m *DBModel) ForgetStripeEvent(eventID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `delete from stripe_events where event_id = ?`
+	_, err := m.DB.ExecContext(ctx, stmt, eventID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// widgetColumns are the columns scanWidget reads, in order.
+const widgetColumns = `
+	id, name, description, inventory_level, price, coalesce(image, ''),
+	is_recurring, plan_id, currency, is_archived, slug, trial_days,
+	created_at, updated_at`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWidget(row rowScanner, widget *Widget) error {
+	return row.Scan(
+		&widget.ID,
+		&widget.Name,
+		&widget.Description,
+		&widget.InventoryLevel,
+		&widget.Price,
+		&widget.Image,
+		&widget.IsRecurring,
+		&widget.PlanID,
+		&widget.Currency,
+		&widget.IsArchived,
+		&widget.Slug,
+		&widget.TrialDays,
+		&widget.CreatedAt,
+		&widget.UpdatedAt,
+	)
+}
+
+var slugRX = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slugify turns a widget name into something fit for a URL.
+func Slugify(name string) string {
+	return strings.Trim(slugRX.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// GetWidgetBySlug finds a widget by the name it has in URLs.
+func (m *DBModel) GetWidgetBySlug(slug string) (Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var widget Widget
+	row := m.DB.QueryRowContext(ctx, `select `+widgetColumns+` from widgets where slug = ?`, slug)
+	err := scanWidget(row, &widget)
+	if err != nil {
+		return widget, err
+	}
+
+	return widget, nil
+}
+
+// GetAllWidgets returns the catalog, by name. Archived widgets are left
+// out unless includeArchived is set.
+func (m *DBModel) GetAllWidgets(includeArchived bool) ([]*Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select ` + widgetColumns + `
+		from
+			widgets
+		where
+			is_archived = 0 or ?
+		order by
+			name
+	`
+	rows, err := m.DB.QueryContext(ctx, query, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var widgets []*Widget
+	for rows.Next() {
+		var widget Widget
+		err = scanWidget(rows, &widget)
+		if err != nil {
+			return nil, err
+		}
+		widgets = append(widgets, &widget)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return widgets, nil
+}
+
+// InsertWidget adds a widget to the catalog, and returns its id
+func (m *DBModel) InsertWidget(widget Widget) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into widgets
+			(name, description, inventory_level, price, image,
+			 is_recurring, plan_id, currency, is_archived, slug, trial_days,
+			 created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		widget.Name,
+		widget.Description,
+		widget.InventoryLevel,
+		widget.Price,
+		widget.Image,
+		widget.IsRecurring,
+		widget.PlanID,
+		widget.Currency,
+		widget.IsArchived,
+		widget.Slug,
+		widget.TrialDays,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// UpdateWidget saves changes to a widget. Orders keep the price they were
+// sold at in their items, so changing the price here is safe.
+func (m *DBModel) UpdateWidget(widget Widget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update widgets set
+			name = ?, description = ?, inventory_level = ?, price = ?, image = ?,
+			is_recurring = ?, plan_id = ?, currency = ?, is_archived = ?,
+			slug = ?, trial_days = ?, updated_at = ?
+		where id = ?
+	`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		widget.Name,
+		widget.Description,
+		widget.InventoryLevel,
+		widget.Price,
+		widget.Image,
+		widget.IsRecurring,
+		widget.PlanID,
+		widget.Currency,
+		widget.IsArchived,
+		widget.Slug,
+		widget.TrialDays,
+		time.Now(),
+		widget.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ArchiveWidget retires a widget, so it can no longer be bought. We never
+// delete widgets, since old orders refer to them.
+func (m *DBModel) ArchiveWidget(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update widgets set is_archived = 1, updated_at = ? where id = ?`
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package models
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"Widget":              "widget",
+		"  Big Red Widget!  ": "big-red-widget",
+		"Gold -- Plan":        "gold-plan",
+	}
+	for name, want := range tests {
+		if got := Slugify(name); got != want {
+			t.Errorf("Slugify(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package fakedb is a database/sql driver for tests, so that code using
+// the database can be run without MySQL.
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// TB is the part of testing.TB the fake database uses. It is declared
+// here so that the package needn't import testing.
+type TB interface {
+	Helper()
+	Name() string
+	Errorf(format string, args ...interface{})
+	Fatal(args ...interface{})
+	Cleanup(func())
+}
+
+// DB is a fake database. Each statement goes to the first handler whose
+// pattern it contains; a statement nothing handles fails the test.
+type DB struct {
+	t        TB
+	mu       sync.Mutex
+	handlers []*Handler
+	// Log is every statement run, in order, with its whitespace squashed.
+	Log []string
+}
+
+// Handler answers the statements that contain Pattern. Query answers
+// selects, and Exec everything else; a nil one answers with no rows, or
+// with one row affected.
+type Handler struct {
+	Pattern string
+	Query   func(query string, args []driver.Value) (*Rows, error)
+	Exec    func(query string, args []driver.Value) (driver.Result, error)
+	// Calls counts the statements the handler answered.
+	Calls int
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = map[string]*DB{}
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// New returns a *sql.DB backed by a new fake database, closed when the
+// test ends.
+func New(t TB) (*sql.DB, *DB) {
+	t.Helper()
+
+	f := &DB{t: t}
+	fakeDBsMu.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(fakeDBs))
+	fakeDBs[name] = f
+	fakeDBsMu.Unlock()
+
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+		fakeDBsMu.Lock()
+		delete(fakeDBs, name)
+		fakeDBsMu.Unlock()
+	})
+	return db, f
+}
+
+// Handle adds a handler for statements containing pattern.
+func (f *DB) Handle(pattern string) *Handler {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := &Handler{Pattern: squash(pattern)}
+	f.handlers = append(f.handlers, h)
+	return h
+}
+
+// Ran says how many of the statements run contain pattern.
+func (f *DB) Ran(pattern string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, q := range f.Log {
+		if strings.Contains(q, squash(pattern)) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *DB) handler(query string) (*Handler, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Log = append(f.Log, query)
+	for _, h := range f.handlers {
+		if strings.Contains(query, h.Pattern) {
+			h.Calls++
+			return h, nil
+		}
+	}
+	f.t.Errorf("fakedb: unexpected statement: %s", query)
+	return nil, errors.New("fakedb: unexpected statement")
+}
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// squash lower cases s and folds its runs of whitespace into one space.
+func squash(s string) string {
+	return strings.TrimSpace(spaces.ReplaceAllString(strings.ToLower(s), " "))
+}
+
+// selectColumns returns the names of the columns a select returns: the
+// alias if there is one, or else the column without its table.
+func selectColumns(query string) []string {
+	q := squash(query)
+	start := strings.Index(q, "select ")
+	if start < 0 {
+		return nil
+	}
+	q = q[start+len("select "):]
+
+	var cols []string
+	depth, from := 0, 0
+	for i := 0; i < len(q); i++ {
+		switch q[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				cols = append(cols, q[from:i])
+				from = i + 1
+			}
+		case ' ':
+			if depth == 0 && strings.HasPrefix(q[i:], " from ") {
+				cols = append(cols, q[from:i])
+				return columnNames(cols)
+			}
+		}
+	}
+	return columnNames(append(cols, q[from:]))
+}
+
+func columnNames(exprs []string) []string {
+	names := make([]string, len(exprs))
+	for i, e := range exprs {
+		e = strings.TrimSpace(e)
+		if j := strings.LastIndex(e, " as "); j >= 0 {
+			e = e[j+len(" as "):]
+		} else if !strings.Contains(e, "(") {
+			e = e[strings.LastIndex(e, ".")+1:]
+		}
+		names[i] = e
+	}
+	return names
+}
+
+// RowsFrom answers a select with one row for each of records, taking each
+// column from the record by name. A column missing from a record is an
+// error, so a test notices when a query changes.
+func RowsFrom(query string, records ...map[string]driver.Value) (*Rows, error) {
+	cols := selectColumns(query)
+	rows := &Rows{cols: cols}
+	for _, rec := range records {
+		row := make([]driver.Value, len(cols))
+		for i, c := range cols {
+			v, ok := rec[c]
+			if !ok {
+				return nil, fmt.Errorf("fakedb: no value for column %q", c)
+			}
+			row[i] = v
+		}
+		rows.rows = append(rows.rows, row)
+	}
+	return rows, nil
+}
+
+// Result is the result of an exec.
+type Result struct {
+	ID, Affected int64
+}
+
+func (r Result) LastInsertId() (int64, error) { return r.ID, nil }
+func (r Result) RowsAffected() (int64, error) { return r.Affected, nil }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	f, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("fakedb: no database %q", name)
+	}
+	return &fakeConn{db: f}, nil
+}
+
+type fakeConn struct {
+	db *DB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.query(query, values(args))
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.exec(query, values(args))
+}
+
+func (c *fakeConn) query(query string, args []driver.Value) (driver.Rows, error) {
+	h, err := c.db.handler(squash(query))
+	if err != nil {
+		return nil, err
+	}
+	if h.Query == nil {
+		return &Rows{cols: selectColumns(query)}, nil
+	}
+	rows, err := h.Query(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (c *fakeConn) exec(query string, args []driver.Value) (driver.Result, error) {
+	h, err := c.db.handler(squash(query))
+	if err != nil {
+		return nil, err
+	}
+	if h.Exec == nil {
+		return Result{ID: 1, Affected: 1}, nil
+	}
+	return h.Exec(query, args)
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, a := range args {
+		vals[i] = a.Value
+	}
+	return vals
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.exec(s.query, args)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(s.query, args)
+}
+
+// Rows are the rows a select returns.
+type Rows struct {
+	cols []string
+	rows [][]driver.Value
+	next int
+}
+
+func (r *Rows) Columns() []string { return r.cols }
+func (r *Rows) Close() error      { return nil }
+
+func (r *Rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
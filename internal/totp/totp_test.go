@@ -0,0 +1,57 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// secret is the SHA1 key of RFC 6238's test vectors, base32 encoded.
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The RFC's codes are eight digits; ours are their last six.
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("at %d: got %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+// A code is good for a step either side of its own, and no further.
+func TestVerify(t *testing.T) {
+	at := time.Unix(1111111109, 0)
+	want := Step(at)
+
+	for _, offset := range []time.Duration{-Period, 0, Period} {
+		step, ok := Verify(secret, "081 804", at.Add(offset))
+		if !ok || step != want {
+			t.Errorf("%v out: got step %d, %v", offset, step, ok)
+		}
+	}
+	for _, offset := range []time.Duration{-2 * Period, 2 * Period} {
+		if _, ok := Verify(secret, "081804", at.Add(offset)); ok {
+			t.Errorf("%v out: code accepted", offset)
+		}
+	}
+	if _, ok := Verify(secret, "081\t804 ", at); !ok {
+		t.Error("code with a tab refused")
+	}
+	if _, ok := Verify(secret, "81804", at); ok {
+		t.Error("short code accepted")
+	}
+}
@@ -1,6 +1,9 @@
 package urlsigner
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -48,6 +51,19 @@ func (s *Signer) ConfirmHashForString(hashed, payload string) error {
 	return err
 }
 
+// MAC signs payload with the secret. Unlike GetHashWithSalt it is cheap
+// to check, so it suits something checked on every request.
+func (s *Signer) MAC(payload string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckMAC says whether signed is the MAC of payload.
+func (s *Signer) CheckMAC(signed, payload string) bool {
+	return hmac.Equal([]byte(signed), []byte(s.MAC(payload)))
+}
+
 func (s *Signer) GenerateTokenFromString(data string) string {
 	var urlToSign string
 